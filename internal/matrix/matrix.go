@@ -18,7 +18,8 @@ type Client struct {
 	*mautrix.Client
 	log zerolog.Logger
 
-	opts options
+	opts   options
+	status *syncStatus
 }
 
 // options are the options for the Matrix client
@@ -170,6 +171,12 @@ func NewClient(homeserverURL, username, password string, opts ...ClientOption) (
 		client.Syncer.(mautrix.ExtensibleSyncer).OnEvent(client.StateStoreSyncHandler)
 	}
 
+	// track the sync loop, once the stores are done configuring the syncer
+	status := &syncStatus{}
+	syncer := &statusSyncer{DefaultSyncer: client.Syncer.(*mautrix.DefaultSyncer), status: status}
+	syncer.OnSync(status.synced)
+	client.Syncer = syncer
+
 	lreq := &mautrix.ReqLogin{
 		Type: mautrix.AuthTypePassword,
 		Identifier: mautrix.UserIdentifier{
@@ -212,7 +219,8 @@ func NewClient(homeserverURL, username, password string, opts ...ClientOption) (
 		Client: client,
 		log:    o.Log,
 
-		opts: *o,
+		opts:   *o,
+		status: status,
 	}
 
 	return c, nil
@@ -232,32 +240,37 @@ func (c *Client) OnEventType(evtType event.Type, f mautrix.EventHandler) {
 	s.OnEventType(evtType, f)
 }
 
+// Start joins the configured rooms and syncs until ctx is cancelled. It returns
+// nil when the sync was stopped by ctx.
 func (c *Client) Start(ctx context.Context) error {
-	ctx, cancel := context.WithCancelCause(ctx)
-
 	// TODO: include "runtime" rooms that the bot is invited into -- store in DB if not already in events as state?
 	if err := c.ensureRooms(); err != nil {
-		cancel(err)
 		return errors.Wrap(err, "failed to ensure rooms")
 	}
 
-	var errch chan error
-	go func(errch chan error) error {
-		c.SyncPresence = event.PresenceOnline
-		err := c.SyncWithContext(ctx)
-		if err != nil {
-			errch <- err
-		}
-		return nil
-	}(errch)
-
-	for {
-		select {
-		case err := <-errch:
-			cancel(err)
-			return errors.Wrap(err, "failed to sync")
+	c.SyncPresence = event.PresenceOnline
+
+	c.status.setSyncing(true)
+	defer c.status.setSyncing(false)
+
+	if err := c.SyncWithContext(ctx); err != nil {
+		if ctx.Err() != nil {
+			return nil
 		}
+
+		return errors.Wrap(err, "failed to sync")
 	}
+
+	return nil
+}
+
+// Close closes the crypto helper, if any
+func (c *Client) Close() error {
+	if ch, ok := c.Crypto.(*cryptohelper.CryptoHelper); ok {
+		return ch.Close()
+	}
+
+	return nil
 }
 
 func (c *Client) ensureRooms() error {
@@ -0,0 +1,110 @@
+package matrix
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// SendMessageEventContext is like SendMessageEvent, but the request is bound
+// to ctx so it can be cancelled
+func (c *Client) SendMessageEventContext(ctx context.Context, roomID id.RoomID, eventType event.Type, content interface{}) (*mautrix.RespSendEvent, error) {
+	return c.SendMessageEventTxn(ctx, roomID, eventType, content, c.TxnID())
+}
+
+// SendMessageEventTxn sends a message event with the given transaction ID.
+// Retrying a send with the same transaction ID doesn't duplicate the event.
+func (c *Client) SendMessageEventTxn(ctx context.Context, roomID id.RoomID, eventType event.Type, content interface{}, txnID string) (*mautrix.RespSendEvent, error) {
+	if c.Crypto != nil && eventType != event.EventReaction && c.StateStore.IsEncrypted(roomID) {
+		encrypted, err := c.Crypto.Encrypt(roomID, eventType, content)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to encrypt event")
+		}
+
+		content = encrypted
+		eventType = event.EventEncrypted
+	}
+
+	resp := &mautrix.RespSendEvent{}
+	_, err := c.MakeFullRequest(mautrix.FullRequest{
+		Method:       http.MethodPut,
+		URL:          c.BuildClientURL("v3", "rooms", roomID, "send", eventType.String(), txnID),
+		RequestJSON:  content,
+		ResponseJSON: resp,
+		Context:      ctx,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+// RedactEventContext is like RedactEvent, but the request is bound to ctx so
+// it can be cancelled
+func (c *Client) RedactEventContext(ctx context.Context, roomID id.RoomID, eventID id.EventID, reason string) (*mautrix.RespSendEvent, error) {
+	content := map[string]interface{}{}
+	if reason != "" {
+		content["reason"] = reason
+	}
+
+	resp := &mautrix.RespSendEvent{}
+	_, err := c.MakeFullRequest(mautrix.FullRequest{
+		Method:       http.MethodPut,
+		URL:          c.BuildClientURL("v3", "rooms", roomID, "redact", eventID, c.TxnID()),
+		RequestJSON:  content,
+		ResponseJSON: resp,
+		Context:      ctx,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+// UserTypingContext is like UserTyping, but the request is bound to ctx so it
+// can be cancelled
+func (c *Client) UserTypingContext(ctx context.Context, roomID id.RoomID, typing bool, timeout time.Duration) error {
+	_, err := c.MakeFullRequest(mautrix.FullRequest{
+		Method:      http.MethodPut,
+		URL:         c.BuildClientURL("v3", "rooms", roomID, "typing", c.UserID),
+		RequestJSON: mautrix.ReqTyping{Typing: typing, Timeout: timeout.Milliseconds()},
+		Context:     ctx,
+	})
+	return err
+}
+
+// SendReceiptContext is like SendReceipt, but the request is bound to ctx so
+// it can be cancelled
+func (c *Client) SendReceiptContext(ctx context.Context, roomID id.RoomID, eventID id.EventID, receiptType event.ReceiptType) error {
+	_, err := c.MakeFullRequest(mautrix.FullRequest{
+		Method:      http.MethodPost,
+		URL:         c.BuildClientURL("v3", "rooms", roomID, "receipt", receiptType, eventID),
+		RequestJSON: struct{}{},
+		Context:     ctx,
+	})
+	return err
+}
+
+// ResolveAliasContext is like ResolveAlias, but the request is bound to ctx so
+// it can be cancelled
+func (c *Client) ResolveAliasContext(ctx context.Context, alias id.RoomAlias) (*mautrix.RespAliasResolve, error) {
+	resp := &mautrix.RespAliasResolve{}
+	_, err := c.MakeFullRequest(mautrix.FullRequest{
+		Method:       http.MethodGet,
+		URL:          c.BuildClientURL("v3", "directory", "room", alias),
+		ResponseJSON: resp,
+		Context:      ctx,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
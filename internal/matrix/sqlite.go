@@ -62,7 +62,7 @@ func WithSQLiteSyncStore(db *sql.DB) SyncStoreOption[SQLiteStore] {
 
 // SaveFilterID saves the filter ID for the given user ID
 func (s *SQLiteStore) SaveFilterID(userID id.UserID, filterID string) {
-	_, _ = s.Exec("INSERT INTO filter_ids (user_id, filter_id) VALUES (?, ?)", userID, filterID)
+	_, _ = s.Exec("INSERT INTO filter_ids (user_id, filter_id) VALUES (?, ?) ON CONFLICT (user_id) DO UPDATE SET filter_id = excluded.filter_id", userID, filterID)
 }
 
 // LoadFilterID loads the filter ID for the given user ID
@@ -77,7 +77,7 @@ func (s *SQLiteStore) LoadFilterID(userID id.UserID) string {
 
 // SaveNextBatch saves the next batch for the given user ID
 func (s *SQLiteStore) SaveNextBatch(userID id.UserID, nextBatch string) {
-	_, _ = s.Exec("INSERT INTO next_batch (user_id, next_batch) VALUES (?, ?)", userID, nextBatch)
+	_, _ = s.Exec("INSERT INTO next_batch (user_id, next_batch) VALUES (?, ?) ON CONFLICT (user_id) DO UPDATE SET next_batch = excluded.next_batch", userID, nextBatch)
 }
 
 // LoadNextBatch loads the next batch for the given user ID
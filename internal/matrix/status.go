@@ -0,0 +1,104 @@
+package matrix
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"maunium.net/go/mautrix"
+)
+
+var (
+	syncErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "athenais",
+		Name:      "sync_errors_total",
+		Help:      "Syncs with the homeserver that failed.",
+	})
+
+	lastSync = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "athenais",
+		Name:      "sync_last_success_timestamp_seconds",
+		Help:      "Unix time of the last successful sync with the homeserver.",
+	})
+)
+
+// SyncStatus is the state of the sync loop
+type SyncStatus struct {
+	// Syncing is whether the sync loop is running
+	Syncing bool `json:"syncing"`
+
+	// LastSync is when the last sync succeeded
+	LastSync time.Time `json:"last_sync,omitempty"`
+
+	// LastError is the error of the last failed sync, if it failed after the
+	// last successful sync
+	LastError string `json:"last_error,omitempty"`
+
+	// LastErrorAt is when the last sync failed
+	LastErrorAt time.Time `json:"last_error_at,omitempty"`
+
+	// Failures is the number of syncs that failed since the last success
+	Failures int `json:"failures"`
+}
+
+// syncStatus tracks the sync loop
+type syncStatus struct {
+	mu     sync.RWMutex
+	status SyncStatus
+}
+
+func (s *syncStatus) get() SyncStatus {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.status
+}
+
+func (s *syncStatus) setSyncing(syncing bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.status.Syncing = syncing
+}
+
+func (s *syncStatus) synced(_ *mautrix.RespSync, _ string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.status.LastSync = time.Now()
+	lastSync.Set(float64(s.status.LastSync.Unix()))
+	s.status.LastError = ""
+	s.status.Failures = 0
+
+	return true
+}
+
+func (s *syncStatus) failed(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.status.LastError = err.Error()
+	s.status.LastErrorAt = time.Now()
+	s.status.Failures++
+	syncErrors.Inc()
+}
+
+// statusSyncer is the default syncer, recording failed syncs
+type statusSyncer struct {
+	*mautrix.DefaultSyncer
+	status *syncStatus
+}
+
+func (s *statusSyncer) OnFailedSync(res *mautrix.RespSync, err error) (time.Duration, error) {
+	s.status.failed(err)
+	return s.DefaultSyncer.OnFailedSync(res, err)
+}
+
+// SyncStatus returns the state of the sync loop
+func (c *Client) SyncStatus() SyncStatus {
+	if c.status == nil {
+		return SyncStatus{}
+	}
+	return c.status.get()
+}
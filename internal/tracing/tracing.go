@@ -0,0 +1,132 @@
+// Package tracing sets up OpenTelemetry tracing, exporting spans over OTLP or
+// as JSON to stdout or a file
+package tracing
+
+import (
+	"context"
+	"io"
+	"os"
+
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+)
+
+// Exporters
+const (
+	// ExporterNone disables tracing
+	ExporterNone = "none"
+
+	// ExporterOTLP exports spans over OTLP/HTTP, configured with the standard
+	// OTEL_EXPORTER_OTLP_* environment variables
+	ExporterOTLP = "otlp"
+
+	// ExporterStdout writes spans as JSON to stdout
+	ExporterStdout = "stdout"
+
+	// ExporterFile writes spans as JSON to a file
+	ExporterFile = "file"
+)
+
+// ServiceName is the service name spans are reported under
+const ServiceName = "athenais"
+
+// Shutdown flushes the spans not yet exported and stops the exporter
+type Shutdown func(context.Context) error
+
+type options struct {
+	file  string
+	ratio float64
+}
+
+// Option is an option for the tracer provider
+type Option func(*options)
+
+// WithFile sets the file ExporterFile appends spans to
+func WithFile(path string) Option {
+	return func(o *options) {
+		o.file = path
+	}
+}
+
+// WithSampleRatio sets the ratio of traces sampled, between 0 and 1
+func WithSampleRatio(ratio float64) Option {
+	return func(o *options) {
+		o.ratio = ratio
+	}
+}
+
+// Setup installs the global tracer provider, exporting spans with the given
+// exporter. With ExporterNone spans are not recorded.
+func Setup(ctx context.Context, exporter string, opts ...Option) (Shutdown, error) {
+	o := &options{ratio: 1}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	var (
+		exp     sdktrace.SpanExporter
+		closers []io.Closer
+		err     error
+	)
+	switch exporter {
+	case "", ExporterNone:
+		return func(context.Context) error { return nil }, nil
+	case ExporterOTLP:
+		exp, err = otlptracehttp.New(ctx)
+	case ExporterStdout:
+		exp, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	case ExporterFile:
+		if o.file == "" {
+			return nil, errors.New("a file is required to export spans to a file")
+		}
+
+		f, ferr := os.OpenFile(o.file, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if ferr != nil {
+			return nil, errors.Wrap(ferr, "failed to open trace file")
+		}
+		closers = append(closers, f)
+
+		exp, err = stdouttrace.New(stdouttrace.WithWriter(f))
+	default:
+		return nil, errors.Errorf("unknown trace exporter %q, expected one of none, otlp, stdout or file", exporter)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create trace exporter")
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(
+		semconv.SchemaURL,
+		semconv.ServiceName(ServiceName),
+	))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create trace resource")
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exp),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(o.ratio))),
+	)
+
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+
+	return func(ctx context.Context) error {
+		err := tp.Shutdown(ctx)
+		for _, c := range closers {
+			if cerr := c.Close(); cerr != nil && err == nil {
+				err = cerr
+			}
+		}
+		return err
+	}, nil
+}
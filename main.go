@@ -1,16 +1,26 @@
 package main
 
 import (
+	"context"
 	"log"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/pkg/errors"
 	"github.com/rs/zerolog"
 	"github.com/unerror/athenais/internal/db"
 	"github.com/unerror/athenais/internal/matrix"
+	"github.com/unerror/athenais/internal/tracing"
 	"github.com/unerror/athenais/pkg/athenais"
+	"github.com/unerror/athenais/plugins/external"
 	"github.com/unerror/athenais/plugins/openai"
-	"github.com/unerror/athenais/plugins/sayhi"
+	_ "github.com/unerror/athenais/plugins/sayhi"
+	_ "github.com/unerror/athenais/plugins/scripting"
+	_ "github.com/unerror/athenais/plugins/webhook"
 	"github.com/urfave/cli/v2"
 	"maunium.net/go/mautrix/id"
 	"maunium.net/go/mautrix/util/dbutil"
@@ -21,27 +31,26 @@ func main() {
 		Name:  "athenias",
 		Usage: "Athenias is a Matrix bot for interacting with OpenAI",
 		Flags: []cli.Flag{
+			&cli.StringSliceFlag{
+				Name:    "plugins",
+				Usage:   "Plugins to enable, in order. Available: " + strings.Join(athenais.Registered(), ", "),
+				Value:   cli.NewStringSlice("openai", "sayhi"),
+				EnvVars: []string{"PLUGINS"},
+			},
+			&cli.StringSliceFlag{
+				Name:    "external-plugins",
+				Usage:   "Names of plugins run as separate executables, configured by their section of the config file",
+				EnvVars: []string{"EXTERNAL_PLUGINS"},
+			},
 			&cli.StringFlag{
 				Name:    "eventstore-url",
 				Usage:   "The URL to the event store to use",
 				EnvVars: []string{"EVENTSTORE_URL"},
 			},
 			&cli.StringFlag{
-				Name:    "openai-key",
-				Usage:   "OpenAI API key",
-				EnvVars: []string{"OPEN_AI_KEY"},
-			},
-			&cli.StringFlag{
-				Name:    "openai-prompt",
-				Usage:   "The prompt to use for the system chat",
-				Value:   openai.DefaultPrompt,
-				EnvVars: []string{"OPENAI_PROMPT"},
-			},
-			&cli.IntFlag{
-				Name:    "openai-chance",
-				Usage:   "The chance to respond to a message. 0 = never, 100 = always",
-				Value:   openai.DefaultChance,
-				EnvVars: []string{"OPENAI_CHANCE"},
+				Name:    "config",
+				Usage:   "Path to the YAML config file with a section per plugin",
+				EnvVars: []string{"CONFIG_FILE"},
 			},
 			&cli.StringFlag{
 				Name:    "matrix-homeserver",
@@ -75,6 +84,159 @@ func main() {
 				Value:   "athenias.sqlite3",
 				EnvVars: []string{"DATABASE_DSN"},
 			},
+			&cli.DurationFlag{
+				Name:    "handler-timeout",
+				Usage:   "Default deadline for route handlers. 0 = no deadline",
+				Value:   time.Minute,
+				EnvVars: []string{"HANDLER_TIMEOUT"},
+			},
+			&cli.BoolFlag{
+				Name:    "error-notices",
+				Usage:   "Post a notice into the room when a plugin fails to handle a message",
+				EnvVars: []string{"ERROR_NOTICES"},
+			},
+			&cli.StringFlag{
+				Name:    "error-report-room",
+				Usage:   "Room ID to post plugin error details into",
+				EnvVars: []string{"ERROR_REPORT_ROOM"},
+			},
+			&cli.DurationFlag{
+				Name:    "shutdown-timeout",
+				Usage:   "How long to wait for handlers to drain and plugins to stop on shutdown",
+				Value:   athenais.DefaultShutdownTimeout,
+				EnvVars: []string{"SHUTDOWN_TIMEOUT"},
+			},
+			&cli.IntFlag{
+				Name:    "dispatch-workers",
+				Usage:   "Number of workers handling events in parallel",
+				Value:   athenais.DefaultWorkers,
+				EnvVars: []string{"DISPATCH_WORKERS"},
+			},
+			&cli.IntFlag{
+				Name:    "dispatch-queue-depth",
+				Usage:   "Number of events each dispatch worker can queue",
+				Value:   athenais.DefaultQueueDepth,
+				EnvVars: []string{"DISPATCH_QUEUE_DEPTH"},
+			},
+			&cli.StringFlag{
+				Name:    "dispatch-drop-policy",
+				Usage:   "What to do when a dispatch queue is full. block, drop-newest or drop-oldest",
+				Value:   "block",
+				EnvVars: []string{"DISPATCH_DROP_POLICY"},
+			},
+			&cli.IntFlag{
+				Name:    "send-attempts",
+				Usage:   "Number of times a message is sent before it is given up on",
+				Value:   athenais.DefaultSendAttempts,
+				EnvVars: []string{"SEND_ATTEMPTS"},
+			},
+			&cli.StringFlag{
+				Name:    "catch-up",
+				Usage:   "Which events sent while the bot was down to handle. ignore, mentions or replay",
+				Value:   "ignore",
+				EnvVars: []string{"CATCH_UP"},
+			},
+			&cli.DurationFlag{
+				Name:    "catch-up-max-age",
+				Usage:   "Never handle events older than this. 0 = no limit",
+				Value:   time.Hour,
+				EnvVars: []string{"CATCH_UP_MAX_AGE"},
+			},
+			&cli.DurationFlag{
+				Name:    "event-retention",
+				Usage:   "How long to remember handled events to skip duplicates",
+				Value:   athenais.DefaultEventRetention,
+				EnvVars: []string{"EVENT_RETENTION"},
+			},
+			&cli.StringFlag{
+				Name:    "rate-limit-user",
+				Usage:   "Rate limit of messages per user, as count/duration, e.g. 10/1m",
+				EnvVars: []string{"RATE_LIMIT_USER"},
+			},
+			&cli.StringFlag{
+				Name:    "rate-limit-room",
+				Usage:   "Rate limit of messages per room, as count/duration",
+				EnvVars: []string{"RATE_LIMIT_ROOM"},
+			},
+			&cli.StringFlag{
+				Name:    "rate-limit-global",
+				Usage:   "Rate limit of all messages, as count/duration",
+				EnvVars: []string{"RATE_LIMIT_GLOBAL"},
+			},
+			&cli.StringFlag{
+				Name:    "rate-limit-action",
+				Usage:   "What to do with rate limited messages. drop, react or notice",
+				Value:   "drop",
+				EnvVars: []string{"RATE_LIMIT_ACTION"},
+			},
+			&cli.BoolFlag{
+				Name:    "receipts-disabled",
+				Usage:   "Don't send read receipts",
+				EnvVars: []string{"RECEIPTS_DISABLED"},
+			},
+			&cli.BoolFlag{
+				Name:    "receipts-after-success",
+				Usage:   "Only mark messages read that were handled without errors",
+				EnvVars: []string{"RECEIPTS_AFTER_SUCCESS"},
+			},
+			&cli.DurationFlag{
+				Name:    "receipts-batch-interval",
+				Usage:   "Send read receipts at most once per interval per room. 0 = right away",
+				EnvVars: []string{"RECEIPTS_BATCH_INTERVAL"},
+			},
+			&cli.BoolFlag{
+				Name:    "receipts-private",
+				Usage:   "Send private read receipts",
+				EnvVars: []string{"RECEIPTS_PRIVATE"},
+			},
+			&cli.StringSliceFlag{
+				Name:    "receipts-disabled-rooms",
+				Usage:   "Room IDs to never send read receipts in",
+				EnvVars: []string{"RECEIPTS_DISABLED_ROOMS"},
+			},
+			&cli.StringSliceFlag{
+				Name:    "admins",
+				Usage:   "Matrix IDs of bot admins, who have every permission in every room",
+				EnvVars: []string{"ADMINS"},
+			},
+			&cli.StringSliceFlag{
+				Name:    "permission-levels",
+				Usage:   "Power levels required for named permissions, as name=level",
+				EnvVars: []string{"PERMISSION_LEVELS"},
+			},
+			&cli.StringFlag{
+				Name:    "admin-listen",
+				Usage:   "Address to serve the HTTP admin API on, e.g. " + athenais.DefaultAdminListen + ". Disabled if empty",
+				EnvVars: []string{"ADMIN_LISTEN"},
+			},
+			&cli.StringFlag{
+				Name:    "admin-token",
+				Usage:   "Bearer token authenticating admin API requests",
+				EnvVars: []string{"ADMIN_TOKEN"},
+			},
+			&cli.StringFlag{
+				Name:    "metrics-listen",
+				Usage:   "Address to serve Prometheus metrics at /metrics on, e.g. 127.0.0.1:9090. Disabled if empty",
+				EnvVars: []string{"METRICS_LISTEN"},
+			},
+			&cli.StringFlag{
+				Name:    "trace-exporter",
+				Usage:   "Export OpenTelemetry traces: none, otlp (configured with OTEL_EXPORTER_OTLP_* variables), stdout or file",
+				Value:   tracing.ExporterNone,
+				EnvVars: []string{"TRACE_EXPORTER"},
+			},
+			&cli.StringFlag{
+				Name:    "trace-file",
+				Usage:   "File to append traces to with --trace-exporter=file",
+				Value:   "traces.json",
+				EnvVars: []string{"TRACE_FILE"},
+			},
+			&cli.Float64Flag{
+				Name:    "trace-sample-ratio",
+				Usage:   "Ratio of events traced, between 0 and 1",
+				Value:   1,
+				EnvVars: []string{"TRACE_SAMPLE_RATIO"},
+			},
 			&cli.IntFlag{
 				Name:    "log-level",
 				Usage:   "Log level. 0 = Debug, 1 = Info, 2 = Warn, 3 = Error, 4 = Fatal, 5 = Panic",
@@ -89,20 +251,50 @@ func main() {
 			},
 		},
 		Action: func(c *cli.Context) error {
+			// the level is global, so the admin API can change it at runtime
+			zerolog.SetGlobalLevel(zerolog.Level(c.Int("log-level")))
 			log := zerolog.New(os.Stdout).With().
 				Timestamp().
-				Logger().
-				Level(zerolog.Level(c.Int("log-level")))
+				Logger()
 
 			if c.Bool("log-pretty") {
 				log = log.Output(zerolog.ConsoleWriter{Out: os.Stdout})
 			}
 
+			// load and validate the config before connecting to anything
+			cfg, err := athenais.LoadConfig(c.String("config"))
+			if err != nil {
+				return err
+			}
+
+			ctx, stop := signal.NotifyContext(c.Context, os.Interrupt, syscall.SIGTERM)
+			defer stop()
+
+			shutdownTracing, err := tracing.Setup(ctx, c.String("trace-exporter"),
+				tracing.WithFile(c.String("trace-file")),
+				tracing.WithSampleRatio(c.Float64("trace-sample-ratio")),
+			)
+			if err != nil {
+				return err
+			}
+			defer func() {
+				ctx, cancel := context.WithTimeout(context.Background(), c.Duration("shutdown-timeout"))
+				defer cancel()
+				if err := shutdownTracing(ctx); err != nil {
+					log.Error().Err(err).Msg("Failed to flush traces")
+				}
+			}()
+
 			// connect to the database
 			conn, err := db.Open(c.String("database-dsn"))
 			if err != nil {
 				return errors.Wrap(err, "failed to open database")
 			}
+			defer func() {
+				if err := conn.Close(); err != nil {
+					log.Error().Err(err).Msg("Failed to close database")
+				}
+			}()
 
 			dbu, err := dbutil.NewWithDB(conn.DB, db.Driver)
 			if err != nil {
@@ -132,20 +324,140 @@ func main() {
 			if err != nil {
 				return err
 			}
+			defer func() {
+				if err := mc.Close(); err != nil {
+					log.Error().Err(err).Msg("Failed to close matrix client")
+				}
+			}()
+
+			dropPolicy, err := athenais.ParseDropPolicy(c.String("dispatch-drop-policy"))
+			if err != nil {
+				return err
+			}
+
+			catchUp, err := athenais.ParseCatchUpPolicy(c.String("catch-up"))
+			if err != nil {
+				return err
+			}
 
-			b := athenais.New(
-				mc,
+			var limits athenais.RateLimits
+			if limits.User, err = athenais.ParseRateLimit(c.String("rate-limit-user")); err != nil {
+				return err
+			}
+			if limits.Room, err = athenais.ParseRateLimit(c.String("rate-limit-room")); err != nil {
+				return err
+			}
+			if limits.Global, err = athenais.ParseRateLimit(c.String("rate-limit-global")); err != nil {
+				return err
+			}
+			if limits.Action, err = athenais.ParseRateLimitAction(c.String("rate-limit-action")); err != nil {
+				return err
+			}
+
+			botOpts := []athenais.Option{
 				athenais.WithLogger(&log),
-				athenais.WithPlugins(
-					openai.NewPlugin(openai.Configuration{
-						Prompt: c.String("openai-prompt"),
-						Chance: c.Int("openai-chance"),
-						APIKey: c.String("openai-key"),
-					}),
-					sayhi.NewPlugin(),
-				),
-			)
-			if err := b.Run(c.Context); err != nil {
+				athenais.WithDatabase(dbu),
+				athenais.WithHandlerTimeout(c.Duration("handler-timeout")),
+				athenais.WithShutdownTimeout(c.Duration("shutdown-timeout")),
+				athenais.WithWorkers(c.Int("dispatch-workers")),
+				athenais.WithQueueDepth(c.Int("dispatch-queue-depth")),
+				athenais.WithDropPolicy(dropPolicy),
+				athenais.WithRateLimits(limits),
+				athenais.WithSendAttempts(c.Int("send-attempts")),
+				athenais.WithEventRetention(c.Duration("event-retention")),
+				athenais.WithCatchUpPolicy(catchUp),
+				athenais.WithMaxCatchUpAge(c.Duration("catch-up-max-age")),
+			}
+
+			receipts := athenais.Receipts{
+				Disabled:      c.Bool("receipts-disabled"),
+				AfterSuccess:  c.Bool("receipts-after-success"),
+				BatchInterval: c.Duration("receipts-batch-interval"),
+				Private:       c.Bool("receipts-private"),
+			}
+			for _, room := range c.StringSlice("receipts-disabled-rooms") {
+				receipts.DisabledRooms = append(receipts.DisabledRooms, id.RoomID(room))
+			}
+			botOpts = append(botOpts, athenais.WithReceipts(receipts))
+
+			for _, admin := range c.StringSlice("admins") {
+				botOpts = append(botOpts, athenais.WithAdmins(id.UserID(admin)))
+			}
+
+			levels := make(map[string]int)
+			for _, pl := range c.StringSlice("permission-levels") {
+				name, level, ok := strings.Cut(pl, "=")
+				n, err := strconv.Atoi(level)
+				if !ok || err != nil {
+					return errors.Errorf("invalid permission level %q, expected name=level", pl)
+				}
+				levels[name] = n
+			}
+			botOpts = append(botOpts, athenais.WithPermissionLevels(levels))
+
+			if c.Bool("error-notices") {
+				botOpts = append(botOpts, athenais.WithErrorNotices())
+			}
+
+			if room := c.String("error-report-room"); room != "" {
+				botOpts = append(botOpts, athenais.WithErrorReportRoom(id.RoomID(room)))
+			}
+
+			if listen := c.String("metrics-listen"); listen != "" {
+				botOpts = append(botOpts, athenais.WithMetrics(listen))
+			}
+
+			if listen := c.String("admin-listen"); listen != "" {
+				if c.String("admin-token") == "" {
+					return errors.New("--admin-token is required to serve the admin API")
+				}
+
+				botOpts = append(botOpts, athenais.WithAdminAPI(athenais.AdminAPI{
+					Listen:     listen,
+					Token:      c.String("admin-token"),
+					ConfigFile: c.String("config"),
+				}))
+			}
+
+			// external plugins are registered by name, and enabled after the
+			// plugins listed in --plugins unless listed there
+			names := c.StringSlice("plugins")
+			enabled := make(map[string]bool, len(names))
+			for _, name := range names {
+				enabled[name] = true
+			}
+
+			builtin := make(map[string]bool)
+			for _, name := range athenais.Registered() {
+				builtin[name] = true
+			}
+
+			for _, name := range c.StringSlice("external-plugins") {
+				if builtin[name] {
+					return errors.Errorf("external plugin %s is already registered", name)
+				}
+				athenais.Register(name, external.Factory(name))
+				builtin[name] = true
+
+				if !enabled[name] {
+					names = append(names, name)
+					enabled[name] = true
+				}
+			}
+
+			plugins, err := athenais.NewPlugins(names...)
+			if err != nil {
+				return err
+			}
+
+			if err := cfg.ConfigurePlugins(plugins...); err != nil {
+				return err
+			}
+
+			botOpts = append(botOpts, athenais.WithPlugins(plugins...))
+
+			b := athenais.New(mc, botOpts...)
+			if err := b.Run(ctx); err != nil {
 				return err
 			}
 
@@ -0,0 +1,374 @@
+package athenais
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+	"github.com/unerror/athenais/internal/matrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// DefaultAdminListen is the default address of the admin API
+const DefaultAdminListen = "127.0.0.1:8091"
+
+// AdminAPI configures the HTTP admin API, which inspects and steers the
+// running bot. Requests authenticate with the token as a bearer token.
+//
+//	GET  /api/v1/rooms           joined rooms
+//	POST /api/v1/rooms/join      {"room": "#alias:example.com"}
+//	POST /api/v1/rooms/leave     {"room_id": "!id:example.com"}
+//	GET  /api/v1/plugins         plugins, their health, routes and commands
+//	GET  /api/v1/sync            sync loop and dispatcher status
+//	POST /api/v1/send            {"room_id": "...", "text": "...", "format": "text|notice|markdown"}
+//	POST /api/v1/config/reload   reload the config file into plugins implementing Reloader
+//	GET  /api/v1/log-level       the log level
+//	PUT  /api/v1/log-level       {"level": "debug"}
+type AdminAPI struct {
+	// Listen is the address the admin API listens on
+	Listen string
+
+	// Token is the secret requests authenticate with. Every request is
+	// rejected without one.
+	Token string
+
+	// ConfigFile is the config file reloaded by /api/v1/config/reload
+	ConfigFile string
+}
+
+// adminServer serves the admin API
+type adminServer struct {
+	b      *Bot
+	cfg    AdminAPI
+	server *http.Server
+}
+
+func newAdminServer(b *Bot, cfg AdminAPI) *adminServer {
+	a := &adminServer{b: b, cfg: cfg}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/rooms", a.get(a.handleRooms))
+	mux.HandleFunc("/api/v1/rooms/join", a.post(a.handleJoin))
+	mux.HandleFunc("/api/v1/rooms/leave", a.post(a.handleLeave))
+	mux.HandleFunc("/api/v1/plugins", a.get(a.handlePlugins))
+	mux.HandleFunc("/api/v1/sync", a.get(a.handleSync))
+	mux.HandleFunc("/api/v1/send", a.post(a.handleSend))
+	mux.HandleFunc("/api/v1/config/reload", a.post(a.handleReload))
+	mux.HandleFunc("/api/v1/log-level", a.handleLogLevel)
+
+	a.server = &http.Server{
+		Addr:              cfg.Listen,
+		Handler:           a.authenticate(mux),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	return a
+}
+
+// start listens and serves the admin API in the background
+func (a *adminServer) start() error {
+	l, err := net.Listen("tcp", a.cfg.Listen)
+	if err != nil {
+		return errors.Wrap(err, "failed to listen for the admin API")
+	}
+
+	a.b.log.Info().Str("listen", l.Addr().String()).Msg("Serving admin API")
+
+	go func() {
+		if err := a.server.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			a.b.log.Error().Err(err).Msg("Admin API failed")
+		}
+	}()
+
+	return nil
+}
+
+// stop stops the admin API, waiting for requests in flight
+func (a *adminServer) stop(ctx context.Context) {
+	if err := a.server.Shutdown(ctx); err != nil {
+		a.b.log.Error().Err(err).Msg("Failed to stop admin API")
+	}
+}
+
+func (a *adminServer) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if a.cfg.Token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(a.cfg.Token)) != 1 {
+			writeError(w, http.StatusUnauthorized, errors.New("unauthorized"))
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (a *adminServer) get(h http.HandlerFunc) http.HandlerFunc {
+	return allowMethod(http.MethodGet, h)
+}
+
+func (a *adminServer) post(h http.HandlerFunc) http.HandlerFunc {
+	return allowMethod(http.MethodPost, h)
+}
+
+func allowMethod(method string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			w.Header().Set("Allow", method)
+			writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+			return
+		}
+
+		h(w, r)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+func readJSON(w http.ResponseWriter, r *http.Request, v any) bool {
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		writeError(w, http.StatusBadRequest, errors.Wrap(err, "invalid request"))
+		return false
+	}
+
+	return true
+}
+
+func (a *adminServer) handleRooms(w http.ResponseWriter, r *http.Request) {
+	resp, err := a.b.mc.JoinedRooms()
+	if err != nil {
+		writeError(w, http.StatusBadGateway, errors.Wrap(err, "failed to get joined rooms"))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{"rooms": resp.JoinedRooms})
+}
+
+func (a *adminServer) handleJoin(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Room string `json:"room"`
+	}
+	if !readJSON(w, r, &req) {
+		return
+	}
+
+	if req.Room == "" {
+		writeError(w, http.StatusBadRequest, errors.New("room is required"))
+		return
+	}
+
+	resp, err := a.b.mc.JoinRoom(req.Room, "", nil)
+	if err != nil {
+		writeError(w, http.StatusBadGateway, errors.Wrap(err, "failed to join room"))
+		return
+	}
+
+	a.b.log.Info().Stringer("room_id", resp.RoomID).Msg("Joined room through the admin API")
+	writeJSON(w, http.StatusOK, map[string]id.RoomID{"room_id": resp.RoomID})
+}
+
+func (a *adminServer) handleLeave(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		RoomID id.RoomID `json:"room_id"`
+	}
+	if !readJSON(w, r, &req) {
+		return
+	}
+
+	if req.RoomID == "" {
+		writeError(w, http.StatusBadRequest, errors.New("room_id is required"))
+		return
+	}
+
+	if _, err := a.b.mc.LeaveRoom(req.RoomID); err != nil {
+		writeError(w, http.StatusBadGateway, errors.Wrap(err, "failed to leave room"))
+		return
+	}
+
+	a.b.log.Info().Stringer("room_id", req.RoomID).Msg("Left room through the admin API")
+	writeJSON(w, http.StatusOK, map[string]id.RoomID{"room_id": req.RoomID})
+}
+
+func (a *adminServer) handlePlugins(w http.ResponseWriter, r *http.Request) {
+	type pluginInfo struct {
+		Name  string `json:"name"`
+		Error string `json:"error,omitempty"`
+	}
+
+	type routeInfo struct {
+		Name       string `json:"name"`
+		Plugin     string `json:"plugin,omitempty"`
+		EventType  string `json:"event_type"`
+		Permission string `json:"permission,omitempty"`
+	}
+
+	type commandInfo struct {
+		Synopsis   string `json:"synopsis"`
+		Usage      string `json:"usage,omitempty"`
+		Plugin     string `json:"plugin,omitempty"`
+		Permission string `json:"permission,omitempty"`
+	}
+
+	health := a.b.Health()
+	plugins := make([]pluginInfo, 0, len(a.b.plugins))
+	for _, plug := range a.b.plugins {
+		info := pluginInfo{Name: plug.Name()}
+		if err := health[plug.Name()]; err != nil {
+			info.Error = err.Error()
+		}
+		plugins = append(plugins, info)
+	}
+
+	routes := make([]routeInfo, 0)
+	for _, route := range a.b.Routes() {
+		info := routeInfo{Name: route.Name, Plugin: route.Plugin, EventType: route.EventType.Type}
+		if route.Permission.required() {
+			info.Permission = route.Permission.String()
+		}
+		routes = append(routes, info)
+	}
+
+	commands := make([]commandInfo, 0)
+	for _, cmd := range a.b.Commands() {
+		info := commandInfo{Synopsis: cmd.Synopsis(), Usage: cmd.Usage, Plugin: cmd.Plugin}
+		if cmd.Permission.required() {
+			info.Permission = cmd.Permission.String()
+		}
+		commands = append(commands, info)
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"plugins":  plugins,
+		"routes":   routes,
+		"commands": commands,
+	})
+}
+
+func (a *adminServer) handleSync(w http.ResponseWriter, r *http.Request) {
+	stats := a.b.DispatcherStats()
+
+	writeJSON(w, http.StatusOK, struct {
+		Sync       matrix.SyncStatus `json:"sync"`
+		Started    time.Time         `json:"started"`
+		Dispatcher map[string]any    `json:"dispatcher"`
+	}{
+		Sync:    a.b.mc.SyncStatus(),
+		Started: a.b.started,
+		Dispatcher: map[string]any{
+			"queued":       stats.Queued,
+			"processed":    stats.Processed,
+			"dropped":      stats.Dropped,
+			"rate_limited": stats.RateLimited,
+			"last_lag_ms":  stats.LastLag.Milliseconds(),
+			"max_lag_ms":   stats.MaxLag.Milliseconds(),
+		},
+	})
+}
+
+func (a *adminServer) handleSend(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		RoomID id.RoomID `json:"room_id"`
+		Text   string    `json:"text"`
+		Format string    `json:"format"`
+	}
+	if !readJSON(w, r, &req) {
+		return
+	}
+
+	if req.RoomID == "" || req.Text == "" {
+		writeError(w, http.StatusBadRequest, errors.New("room_id and text are required"))
+		return
+	}
+
+	var content event.MessageEventContent
+	switch req.Format {
+	case "", "text":
+		content = event.MessageEventContent{MsgType: event.MsgText, Body: req.Text}
+	case "notice":
+		content = event.MessageEventContent{MsgType: event.MsgNotice, Body: req.Text}
+	case "markdown":
+		content = renderMarkdown(req.Text)
+	default:
+		writeError(w, http.StatusBadRequest, errors.Errorf("unknown format: %s", req.Format))
+		return
+	}
+
+	evtID, err := a.b.SendMessage(r.Context(), req.RoomID, &content)
+	if errors.Is(err, ErrQueued) {
+		writeJSON(w, http.StatusAccepted, map[string]string{"status": "queued"})
+		return
+	} else if err != nil {
+		writeError(w, http.StatusBadGateway, errors.Wrap(err, "failed to send message"))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]id.EventID{"event_id": evtID})
+}
+
+func (a *adminServer) handleReload(w http.ResponseWriter, r *http.Request) {
+	cfg, err := LoadConfig(a.cfg.ConfigFile)
+	if err != nil {
+		writeError(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+
+	reloaded := make([]string, 0)
+	for _, plug := range a.b.plugins {
+		if _, ok := plug.(Reloader); ok {
+			reloaded = append(reloaded, plug.Name())
+		}
+	}
+	sort.Strings(reloaded)
+
+	if err := a.b.ReloadConfig(r.Context(), cfg); err != nil {
+		writeError(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{"reloaded": reloaded})
+}
+
+func (a *adminServer) handleLogLevel(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var req struct {
+			Level string `json:"level"`
+		}
+		if !readJSON(w, r, &req) {
+			return
+		}
+
+		level, err := zerolog.ParseLevel(req.Level)
+		if err != nil || req.Level == "" {
+			writeError(w, http.StatusBadRequest, errors.Errorf("unknown log level: %q", req.Level))
+			return
+		}
+
+		zerolog.SetGlobalLevel(level)
+		a.b.log.WithLevel(level).Stringer("level", level).Msg("Changed log level through the admin API")
+	default:
+		w.Header().Set("Allow", "GET, PUT")
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]string{"level": zerolog.GlobalLevel().String()})
+}
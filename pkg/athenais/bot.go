@@ -2,18 +2,58 @@ package athenais
 
 import (
 	"context"
+	"time"
 
+	"github.com/pkg/errors"
 	"github.com/rs/zerolog"
 	"github.com/unerror/athenais/internal/matrix"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"maunium.net/go/mautrix"
 	"maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/id"
+	"maunium.net/go/mautrix/util/dbutil"
 )
 
+// DefaultShutdownTimeout is the default time shutdown waits for handlers to
+// drain and plugins to stop
+const DefaultShutdownTimeout = 30 * time.Second
+
 type options struct {
 	log *zerolog.Logger
+	db  *dbutil.Database
 
-	plugins []Plugin
+	plugins        []Plugin
+	middleware     []Middleware
+	handlerTimeout time.Duration
+
+	errorNotices    bool
+	errorReportRoom id.RoomID
+
+	shutdownTimeout time.Duration
+
+	admins           []id.UserID
+	permissionLevels map[string]int
+
+	workers     int
+	queueDepth  int
+	dropPolicy  DropPolicy
+	dispatchKey DispatchKey
+
+	rateLimits RateLimits
+
+	sendAttempts int
+
+	eventRetention time.Duration
+
+	catchUp       CatchUpPolicy
+	maxCatchUpAge time.Duration
+
+	receipts Receipts
+
+	adminAPI *AdminAPI
+
+	metricsListen string
 }
 
 type Option func(*options)
@@ -24,38 +64,329 @@ func WithLogger(log *zerolog.Logger) Option {
 	}
 }
 
+// WithDatabase sets the database the bot keeps its state in, such as room
+// plugin policies and plugin storage
+func WithDatabase(db *dbutil.Database) Option {
+	return func(o *options) {
+		o.db = db
+	}
+}
+
 func WithPlugins(plugins ...Plugin) Option {
 	return func(o *options) {
 		o.plugins = plugins
 	}
 }
 
+// WithMiddleware sets middleware wrapping every route handler, after the
+// built-in panic recovery
+func WithMiddleware(mws ...Middleware) Option {
+	return func(o *options) {
+		o.middleware = append(o.middleware, mws...)
+	}
+}
+
+// WithHandlerTimeout sets the default deadline for route handlers
+func WithHandlerTimeout(d time.Duration) Option {
+	return func(o *options) {
+		o.handlerTimeout = d
+	}
+}
+
+// WithErrorNotices posts a notice into the room when a plugin fails to handle
+// an event
+func WithErrorNotices() Option {
+	return func(o *options) {
+		o.errorNotices = true
+	}
+}
+
+// WithErrorReportRoom posts the details of plugin errors into the given room
+func WithErrorReportRoom(roomID id.RoomID) Option {
+	return func(o *options) {
+		o.errorReportRoom = roomID
+	}
+}
+
+// WithShutdownTimeout sets how long shutdown waits for in-flight handlers to
+// drain, and for each plugin to stop
+func WithShutdownTimeout(d time.Duration) Option {
+	return func(o *options) {
+		o.shutdownTimeout = d
+	}
+}
+
+// WithAdmins sets the bot admins, who have every permission in every room
+func WithAdmins(admins ...id.UserID) Option {
+	return func(o *options) {
+		o.admins = append(o.admins, admins...)
+	}
+}
+
+// WithPermissionLevels sets the power levels required for named permissions
+func WithPermissionLevels(levels map[string]int) Option {
+	return func(o *options) {
+		o.permissionLevels = levels
+	}
+}
+
+// WithWorkers sets the number of workers handling events in parallel
+func WithWorkers(n int) Option {
+	return func(o *options) {
+		o.workers = n
+	}
+}
+
+// WithQueueDepth sets the number of events each worker can queue
+func WithQueueDepth(n int) Option {
+	return func(o *options) {
+		o.queueDepth = n
+	}
+}
+
+// WithDropPolicy sets what happens to events when a worker's queue is full
+func WithDropPolicy(p DropPolicy) Option {
+	return func(o *options) {
+		o.dropPolicy = p
+	}
+}
+
+// WithDispatchKey sets how events are ordered. Defaults to RoomKey.
+func WithDispatchKey(key DispatchKey) Option {
+	return func(o *options) {
+		o.dispatchKey = key
+	}
+}
+
+// WithRateLimits sets the rate limits of the bot's responses
+func WithRateLimits(limits RateLimits) Option {
+	return func(o *options) {
+		o.rateLimits = limits
+	}
+}
+
+// WithSendAttempts sets how many times a message is sent before it is given
+// up on
+func WithSendAttempts(n int) Option {
+	return func(o *options) {
+		o.sendAttempts = n
+	}
+}
+
+// WithEventRetention sets how long the IDs of handled events are remembered
+// to skip duplicates
+func WithEventRetention(d time.Duration) Option {
+	return func(o *options) {
+		o.eventRetention = d
+	}
+}
+
+// WithCatchUpPolicy sets which events sent before the bot started are
+// handled. Defaults to CatchUpIgnore.
+func WithCatchUpPolicy(p CatchUpPolicy) Option {
+	return func(o *options) {
+		o.catchUp = p
+	}
+}
+
+// WithMaxCatchUpAge sets the age after which events are never handled,
+// whatever the catch-up policy
+func WithMaxCatchUpAge(d time.Duration) Option {
+	return func(o *options) {
+		o.maxCatchUpAge = d
+	}
+}
+
+// WithReceipts sets how the bot sends read receipts
+func WithReceipts(r Receipts) Option {
+	return func(o *options) {
+		o.receipts = r
+	}
+}
+
+// WithAdminAPI serves the HTTP admin API while the bot runs
+func WithAdminAPI(cfg AdminAPI) Option {
+	return func(o *options) {
+		o.adminAPI = &cfg
+	}
+}
+
+// WithMetrics serves Prometheus metrics at /metrics on the given address
+// while the bot runs
+func WithMetrics(listen string) Option {
+	return func(o *options) {
+		o.metricsListen = listen
+	}
+}
+
 // Bot represents the instance of the bot
 type Bot struct {
-	mc *matrix.Client
-	r  *Router
+	mc      *matrix.Client
+	r       *Router
+	d       *dispatcher
+	s       *scheduler
+	rl      *rateLimiter
+	o       *outbox
+	events  *eventLog
+	senders *senderCache
+	rc      *receipter
+	cmds    *commandSet
+	plugins []Plugin
+
+	db       *dbutil.Database
+	storage  *dbutil.Database
+	policies *policyStore
+
+	shutdownTimeout time.Duration
+
+	// started is when the bot started, mentions matches events addressed to
+	// the bot; both are used by the catch-up policy
+	catchUp       CatchUpPolicy
+	maxCatchUpAge time.Duration
+	started       time.Time
+	mentions      Matcher
+
+	admins           map[id.UserID]struct{}
+	permissionLevels map[string]int
+
+	// reporters report route errors
+	reporters []ErrorReporter
+
+	// admin serves the admin API, if enabled
+	admin *adminServer
+
+	// metrics serves the metrics, if enabled
+	metrics *metricsServer
+
+	// plugin is the name of the plugin currently being initialized, used to
+	// attribute routes and commands to their plugin
+	plugin string
 
 	log *zerolog.Logger
 }
 
 // New creates a new instance of the bot
 func New(mc *matrix.Client, opts ...Option) *Bot {
-	o := &options{}
+	o := &options{
+		shutdownTimeout: DefaultShutdownTimeout,
+		workers:         DefaultWorkers,
+		queueDepth:      DefaultQueueDepth,
+		dispatchKey:     RoomKey,
+		sendAttempts:    DefaultSendAttempts,
+		eventRetention:  DefaultEventRetention,
+	}
 	for _, opt := range opts {
 		opt(o)
 	}
 
 	b := &Bot{
-		mc: mc,
-		r:  NewRouter(),
+		mc:      mc,
+		r:       NewRouter(),
+		cmds:    newCommandSet(),
+		plugins: o.plugins,
+
+		policies: newPolicyStore(),
+
+		shutdownTimeout: o.shutdownTimeout,
+
+		catchUp:       o.catchUp,
+		maxCatchUpAge: o.maxCatchUpAge,
+
+		admins:           make(map[id.UserID]struct{}, len(o.admins)),
+		permissionLevels: o.permissionLevels,
 
 		log: o.log,
 	}
 
+	for _, admin := range o.admins {
+		b.admins[admin] = struct{}{}
+	}
+
+	b.d = newDispatcher(b.handle, o)
+	b.s = newScheduler(o.log)
+	b.rl = newRateLimiter(o.rateLimits)
+	b.o = newOutbox(mc, o)
+	b.events = newEventLog(o.eventRetention)
+	b.rc = newReceipter(mc, o)
+	b.senders = newSenderCache()
+
+	if o.db != nil {
+		b.db = o.db.Child(VersionTableName, upgrades, dbutil.ZeroLogger(*o.log))
+		b.policies.db = b.db
+		b.s.db = b.db
+		b.o.db = b.db
+		b.events.db = b.db
+		b.storage = o.db.Child(StorageVersionTableName, storageUpgrades, dbutil.ZeroLogger(*o.log))
+	}
+
+	if o.errorNotices {
+		b.OnError(b.noticeInRoom())
+	}
+
+	if o.errorReportRoom != "" {
+		b.OnError(b.reportToRoom(o.errorReportRoom))
+	}
+
+	if o.adminAPI != nil {
+		b.admin = newAdminServer(b, *o.adminAPI)
+	}
+
+	if o.metricsListen != "" {
+		b.metrics = newMetricsServer(o.metricsListen, o.log)
+	}
+
+	b.HandleJob(purgeEventsJob, b.purgeEvents)
+
+	b.r.SetTimeout(o.handlerTimeout)
+	b.r.SetFilter(b.allowRoute)
+	b.r.Use(Recover(o.log))
+	b.r.Use(o.middleware...)
+
+	b.Route(Route{
+		Name:      "commands",
+		EventType: event.EventMessage,
+		Matchers:  []Matcher{MatcherFunc(func(e *event.Event, _ *Match) bool { return b.IsCommand(e) })},
+		Handler:   b.handleCommand,
+	})
+
+	if err := b.Command(Command{
+		Name:    "help",
+		Usage:   "List commands, or show usage for a command",
+		Args:    []Arg{{Name: "command", Optional: true}},
+		Handler: b.handleHelp,
+	}); err != nil {
+		b.log.Error().Err(err).Msg("Failed to register help command")
+	}
+
+	if err := b.Command(Command{
+		Name:    "plugins",
+		Usage:   "List plugins and their settings in this room",
+		Handler: b.handlePlugins,
+	}); err != nil {
+		b.log.Error().Err(err).Msg("Failed to register plugins command")
+	}
+
+	if err := b.Command(Command{
+		Name:  "plugin",
+		Usage: "Enable, disable or configure a plugin in this room (moderators only)",
+		Args: []Arg{
+			{Name: "action"},
+			{Name: "plugin"},
+			{Name: "key", Optional: true},
+			{Name: "value", Optional: true, Rest: true},
+		},
+		Handler:    b.handlePlugin,
+		Permission: Permission{Name: PermissionManagePlugins},
+	}); err != nil {
+		b.log.Error().Err(err).Msg("Failed to register plugin command")
+	}
+
 	for _, plug := range o.plugins {
 		l := o.log.With().Str("plugin", plug.Name()).Logger()
+		b.plugin = plug.Name()
 		plug.Init(b, &l)
 	}
+	b.plugin = ""
 
 	return b
 }
@@ -65,39 +396,345 @@ func (b *Bot) ID() id.UserID {
 	return b.mc.UserID
 }
 
-// Run runs the bot
+// Run starts the plugins and runs the bot until ctx is cancelled. On shutdown
+// the bot stops syncing, drains in-flight handlers and stops the plugins in
+// reverse order.
 func (b *Bot) Run(ctx context.Context) error {
+	if b.db != nil {
+		if err := b.db.Upgrade(); err != nil {
+			return errors.Wrap(err, "failed to upgrade database")
+		}
+	}
+
+	if b.storage != nil {
+		if err := b.storage.Upgrade(); err != nil {
+			return errors.Wrap(err, "failed to upgrade storage database")
+		}
+
+		n, err := purgeExpired(ctx, b.storage)
+		if err != nil {
+			return err
+		}
+		b.log.Debug().Int64("count", n).Msg("Purged expired storage entries")
+	}
+
+	if err := b.s.load(ctx); err != nil {
+		return err
+	}
+
+	if err := b.o.load(ctx); err != nil {
+		return err
+	}
+
+	if _, err := b.Schedule(ctx, purgeEventsJob, "@hourly", WithJobID(purgeEventsJob)); err != nil {
+		return err
+	}
+
+	// handlers and plugins outlive ctx, so in-flight work can drain on shutdown
+	runCtx, cancelRun := context.WithCancel(context.Background())
+	defer cancelRun()
+
+	b.o.start(runCtx)
+
+	started, err := b.startPlugins(runCtx)
+	if err != nil {
+		cancelRun()
+		b.stopPlugins(started)
+		return err
+	}
+
+	b.d.start(runCtx)
+	b.s.start(runCtx)
+	b.rc.start(runCtx)
+
+	b.started = time.Now()
+	b.mentions = b.Addressed(b.ID())
+
+	if err := b.startServers(); err != nil {
+		b.drain(cancelRun)
+		b.stopPlugins(started)
+		return err
+	}
+
 	b.mc.OnEvent(func(src mautrix.EventSource, evt *event.Event) {
 		b.log.Debug().
 			Interface("event", evt).
 			Stringer("src", src).
 			Msg("Received event")
 
+		eventsReceived.WithLabelValues(evt.Type.Type, src.String()).Inc()
+		if evt.Timestamp > 0 {
+			eventLag.Observe(time.Since(time.UnixMilli(evt.Timestamp)).Seconds())
+		}
+
+		b.senders.put(evt.ID, evt.Sender)
+
 		if evt.Sender == b.mc.UserID {
 			return
 		}
 
-		if err := b.r.Handle(evt); err != nil {
-			b.log.Error().Err(err).Msg("Failed to handle event")
+		// the receipt span is the root of the event's trace; handling it
+		// continues the trace on a dispatcher worker
+		evtCtx, span := tracer().Start(context.Background(), "receive event",
+			trace.WithSpanKind(trace.SpanKindConsumer),
+			trace.WithAttributes(eventAttributes(evt)...),
+			trace.WithAttributes(attribute.String("matrix.source", src.String())),
+		)
+		defer span.End()
+
+		if !b.caughtUp(evt) {
+			span.AddEvent("skipped, sent before start")
+			b.log.Debug().Stringer("event_id", evt.ID).Msg("Skipping event sent before start")
+			return
 		}
 
-		if evt.ID != "" && evt.RoomID != "" {
-			if err := b.mc.MarkRead(evt.RoomID, evt.ID); err != nil {
-				b.log.Error().Err(err).Msg("Failed to mark read")
-			}
+		if !b.d.submit(evtCtx, evt) {
+			span.AddEvent("dropped, queue full")
 		}
 	})
 
-	return b.mc.Start(ctx)
+	err = b.mc.Start(ctx)
+
+	b.log.Info().Msg("Sync stopped, shutting down")
+	b.stopServers()
+	b.drain(cancelRun)
+	b.stopPlugins(started)
+	b.log.Info().Msg("Shut down")
+
+	return err
+}
+
+// startServers starts the admin API and metrics servers, if enabled
+func (b *Bot) startServers() error {
+	if b.metrics != nil {
+		if err := b.metrics.start(); err != nil {
+			return err
+		}
+	}
+
+	if b.admin != nil {
+		if err := b.admin.start(); err != nil {
+			b.stopServers()
+			return err
+		}
+	}
+
+	return nil
+}
+
+// stopServers stops the admin API and metrics servers
+func (b *Bot) stopServers() {
+	ctx, cancel := context.WithTimeout(context.Background(), b.shutdownTimeout)
+	defer cancel()
+
+	if b.admin != nil {
+		b.admin.stop(ctx)
+	}
+
+	if b.metrics != nil {
+		b.metrics.stop(ctx)
+	}
+}
+
+// startPlugins starts the plugins implementing Starter, returning the plugins
+// that were started
+func (b *Bot) startPlugins(ctx context.Context) ([]Plugin, error) {
+	started := make([]Plugin, 0, len(b.plugins))
+	for _, plug := range b.plugins {
+		if s, ok := plug.(Starter); ok {
+			if err := s.Start(ctx); err != nil {
+				return started, errors.Wrapf(err, "failed to start plugin %s", plug.Name())
+			}
+		}
+
+		started = append(started, plug)
+	}
+
+	return started, nil
+}
+
+// stopPlugins stops the plugins implementing Stopper in reverse order
+func (b *Bot) stopPlugins(plugins []Plugin) {
+	for i := len(plugins) - 1; i >= 0; i-- {
+		s, ok := plugins[i].(Stopper)
+		if !ok {
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), b.shutdownTimeout)
+		if err := s.Stop(ctx); err != nil {
+			b.log.Error().Err(err).Str("plugin", plugins[i].Name()).Msg("Failed to stop plugin")
+		}
+		cancel()
+	}
+}
+
+// drain waits for queued events and running jobs to be handled, and queued
+// messages to be sent. If they don't finish within the shutdown timeout, they
+// are cancelled; unsent messages are sent on the next start.
+func (b *Bot) drain(cancel context.CancelFunc) {
+	done := make(chan struct{})
+	go func() {
+		b.d.stop()
+		b.s.stop()
+		b.rc.stop()
+		b.o.wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(b.shutdownTimeout):
+		b.log.Warn().Msg("Handlers did not drain in time, cancelling")
+		cancel()
+		<-done
+	}
+
+	cancel()
+}
+
+// Plugins returns the plugins of the bot
+func (b *Bot) Plugins() []Plugin {
+	return b.plugins
+}
+
+// Routes returns the routes of the bot
+func (b *Bot) Routes() []Route {
+	return b.r.GetRoutes()
+}
+
+// Health returns the health of each plugin implementing HealthChecker, keyed
+// by plugin name. A nil error means the plugin is healthy.
+func (b *Bot) Health() map[string]error {
+	health := make(map[string]error)
+	for _, plug := range b.plugins {
+		if hc, ok := plug.(HealthChecker); ok {
+			health[plug.Name()] = hc.Health()
+		}
+	}
+
+	return health
+}
+
+// DispatcherStats returns the statistics of the event dispatcher
+func (b *Bot) DispatcherStats() DispatcherStats {
+	stats := b.d.stats()
+	stats.RateLimited = b.rl.limited.Load()
+
+	return stats
+}
+
+// handle routes an event, called by the dispatcher workers. Duplicate events
+// are skipped.
+func (b *Bot) handle(ctx context.Context, evt *event.Event) {
+	ctx, span := tracer().Start(withEventID(ctx, evt.ID), "handle event", trace.WithAttributes(eventAttributes(evt)...))
+	defer span.End()
+
+	if b.duplicate(ctx, evt) {
+		span.AddEvent("skipped, duplicate")
+		return
+	}
+
+	err := b.r.Handle(ctx, evt)
+	b.markHandled(ctx, evt)
+
+	if err != nil {
+		recordError(span, err)
+		b.reportError(ctx, evt, err)
+	}
+
+	b.rc.markRead(ctx, evt, true, err)
+}
+
+// OnError adds a reporter called for every route error
+func (b *Bot) OnError(r ErrorReporter) {
+	b.reporters = append(b.reporters, r)
+}
+
+// reportError logs the route errors of an event and passes them to the reporters
+func (b *Bot) reportError(ctx context.Context, evt *event.Event, err error) {
+	var herr *HandleError
+	if !errors.As(err, &herr) {
+		b.log.Error().Err(err).Stringer("event_id", evt.ID).Msg("Failed to handle event")
+		return
+	}
+
+	for _, rerr := range herr.Errors {
+		b.log.Error().
+			Err(rerr.Err).
+			Str("plugin", rerr.Plugin).
+			Str("route", rerr.Route).
+			Stringer("event_id", evt.ID).
+			Stringer("room_id", evt.RoomID).
+			Msg("Failed to handle event")
+
+		for _, report := range b.reporters {
+			report(ctx, evt, rerr)
+		}
+	}
 }
 
 // Route registers a route handler
 func (b *Bot) Route(route Route) {
+	if route.Plugin == "" {
+		route.Plugin = b.plugin
+	}
+
 	b.r.AddRoute(route)
 }
 
-// SendText sends a text message to a room
-func (b *Bot) SendText(roomID id.RoomID, text string) error {
-	_, err := b.mc.SendText(roomID, text)
-	return err
+// RemoveRoutes removes the routes registered by a plugin, e.g. so a plugin
+// reloading its configuration can register them again. It returns how many
+// routes were removed.
+func (b *Bot) RemoveRoutes(plugin string) int {
+	return b.r.RemoveRoutes(plugin)
+}
+
+// InRoomAliases resolves the aliases to their rooms and matches events in
+// them, like InRooms, so the route is indexed by room. Temporary failures are
+// retried with backoff until ctx is done. Call it once the bot is running,
+// e.g. in the plugin's Start.
+func (b *Bot) InRoomAliases(ctx context.Context, aliases ...id.RoomAlias) (Matcher, error) {
+	rooms := make([]id.RoomID, 0, len(aliases))
+	for _, alias := range aliases {
+		room, err := b.resolveAlias(ctx, alias)
+		if err != nil {
+			return nil, err
+		}
+
+		rooms = append(rooms, room)
+	}
+
+	return InRooms(rooms...), nil
+}
+
+// resolveAlias resolves a room alias, retrying temporary failures
+func (b *Bot) resolveAlias(ctx context.Context, alias id.RoomAlias) (id.RoomID, error) {
+	for attempt := 1; ; attempt++ {
+		resp, err := b.mc.ResolveAliasContext(ctx, alias)
+		if err == nil {
+			return resp.RoomID, nil
+		}
+
+		retryAfter, ok := retryable(err)
+		if !ok || ctx.Err() != nil {
+			return "", errors.Wrapf(err, "failed to resolve room alias %s", alias)
+		}
+
+		backoff := sendBackoff(attempt, retryAfter)
+		b.log.Warn().Err(err).Stringer("alias", alias).Dur("backoff", backoff).Msg("Failed to resolve room alias, retrying")
+
+		t := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return "", errors.Wrapf(ctx.Err(), "failed to resolve room alias %s", alias)
+		case <-t.C:
+		}
+	}
+}
+
+// Use adds middleware wrapping every route handler
+func (b *Bot) Use(mws ...Middleware) {
+	b.r.Use(mws...)
 }
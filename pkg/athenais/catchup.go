@@ -0,0 +1,91 @@
+package athenais
+
+import (
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// CatchUpPolicy decides which events sent before the bot started are handled,
+// e.g. the timeline of the first sync after a restart
+type CatchUpPolicy int
+
+const (
+	// CatchUpIgnore skips all events sent before the bot started
+	CatchUpIgnore CatchUpPolicy = iota
+
+	// CatchUpMentions only handles missed events that mention or reply to the
+	// bot, as matched by Bot.Addressed, or that were sent in direct chats
+	CatchUpMentions
+
+	// CatchUpReplay handles all missed events
+	CatchUpReplay
+)
+
+// ParseCatchUpPolicy parses a catch-up policy name: ignore, mentions or replay
+func ParseCatchUpPolicy(s string) (CatchUpPolicy, error) {
+	switch strings.ToLower(s) {
+	case "", "ignore":
+		return CatchUpIgnore, nil
+	case "mentions":
+		return CatchUpMentions, nil
+	case "replay":
+		return CatchUpReplay, nil
+	default:
+		return CatchUpIgnore, errors.Errorf("unknown catch-up policy: %s", s)
+	}
+}
+
+// roomMembers is implemented by state stores that can list the members of a
+// room, like the SQL state store
+type roomMembers interface {
+	GetRoomJoinedOrInvitedMembers(roomID id.RoomID) ([]id.UserID, error)
+}
+
+// caughtUp returns whether an event is handled under the catch-up policy.
+// Events older than the maximum catch-up age are never handled.
+func (b *Bot) caughtUp(evt *event.Event) bool {
+	if evt.Timestamp == 0 {
+		// ephemeral events
+		return true
+	}
+
+	sent := time.UnixMilli(evt.Timestamp)
+	if b.maxCatchUpAge > 0 && time.Since(sent) > b.maxCatchUpAge {
+		return false
+	}
+
+	if !sent.Before(b.started) {
+		return true
+	}
+
+	switch b.catchUp {
+	case CatchUpReplay:
+		return true
+	case CatchUpMentions:
+		return evt.Type == event.EventMessage && (b.mentions.Match(evt, &Match{}) || b.isDirect(evt.RoomID))
+	default:
+		return false
+	}
+}
+
+// isDirect returns whether a room is a direct chat with the bot: either the
+// bot was invited to it as a direct chat, or it has only one other member
+func (b *Bot) isDirect(roomID id.RoomID) bool {
+	if member := b.mc.StateStore.GetMember(roomID, b.ID()); member != nil && member.IsDirect {
+		return true
+	}
+
+	if store, ok := b.mc.StateStore.(roomMembers); ok {
+		members, err := store.GetRoomJoinedOrInvitedMembers(roomID)
+		if err == nil {
+			return len(members) == 2
+		}
+		b.log.Error().Err(err).Stringer("room_id", roomID).Msg("Failed to get room members")
+	}
+
+	return false
+}
@@ -0,0 +1,718 @@
+package athenais
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/pkg/errors"
+	"maunium.net/go/mautrix/event"
+)
+
+// DefaultCommandPrefix is the prefix used by commands that don't set their own
+const DefaultCommandPrefix = "!"
+
+// ArgType is the type of a command argument or flag value
+type ArgType int
+
+const (
+	// ArgString is a plain string value
+	ArgString ArgType = iota
+	// ArgInt is an integer value
+	ArgInt
+	// ArgFloat is a floating point value
+	ArgFloat
+	// ArgBool is a boolean value. Bool flags may be given without a value.
+	ArgBool
+	// ArgDuration is a time.Duration value, e.g. "5m"
+	ArgDuration
+)
+
+func (t ArgType) String() string {
+	switch t {
+	case ArgInt:
+		return "int"
+	case ArgFloat:
+		return "float"
+	case ArgBool:
+		return "bool"
+	case ArgDuration:
+		return "duration"
+	default:
+		return "string"
+	}
+}
+
+// ParseArgType parses an argument type name: string, int, float, bool or
+// duration
+func ParseArgType(s string) (ArgType, error) {
+	switch strings.ToLower(s) {
+	case "", "string":
+		return ArgString, nil
+	case "int":
+		return ArgInt, nil
+	case "float":
+		return ArgFloat, nil
+	case "bool":
+		return ArgBool, nil
+	case "duration":
+		return ArgDuration, nil
+	default:
+		return ArgString, errors.Errorf("unknown argument type: %s", s)
+	}
+}
+
+func (t ArgType) parse(s string) (any, error) {
+	switch t {
+	case ArgInt:
+		return strconv.Atoi(s)
+	case ArgFloat:
+		return strconv.ParseFloat(s, 64)
+	case ArgBool:
+		return strconv.ParseBool(s)
+	case ArgDuration:
+		return time.ParseDuration(s)
+	default:
+		return s, nil
+	}
+}
+
+// Arg is a positional command argument
+type Arg struct {
+	// Name is the name of the argument, used for lookups and usage text
+	Name string
+
+	// Type is the type of the argument
+	Type ArgType
+
+	// Optional marks the argument as optional. Optional arguments must come
+	// after all required arguments.
+	Optional bool
+
+	// Rest consumes all remaining positional arguments into this argument,
+	// joined by spaces. Only valid for the last argument.
+	Rest bool
+}
+
+// Flag is a named command flag, given as --name=value or --name value
+type Flag struct {
+	// Name is the name of the flag, without leading dashes
+	Name string
+
+	// Type is the type of the flag value
+	Type ArgType
+
+	// Default is the default value of the flag, parsed using Type
+	Default string
+
+	// Usage describes the flag in help output
+	Usage string
+}
+
+// CommandHandler handles an invocation of a command
+type CommandHandler func(context.Context, *CommandContext) error
+
+// Command is a named command that can be invoked by users, e.g. "!say hello"
+type Command struct {
+	// Name is the name of the command
+	Name string
+
+	// Aliases are alternative names for the command
+	Aliases []string
+
+	// Prefix is the prefix to trigger the command. Defaults to DefaultCommandPrefix.
+	Prefix string
+
+	// Usage is a short description of the command
+	Usage string
+
+	// Args are the positional arguments of the command
+	Args []Arg
+
+	// Flags are the flags of the command
+	Flags []Flag
+
+	// Handler is the handler to call
+	Handler CommandHandler
+
+	// Permission is what the sender needs to run the command
+	Permission Permission
+
+	// Plugin is the name of the plugin that registered the command
+	Plugin string
+}
+
+// Synopsis returns the one-line usage of the command, e.g. "!remind <when> [text...]"
+func (c *Command) Synopsis() string {
+	var sb strings.Builder
+	sb.WriteString(c.Prefix)
+	sb.WriteString(c.Name)
+
+	for _, f := range c.Flags {
+		if f.Type == ArgBool {
+			fmt.Fprintf(&sb, " [--%s]", f.Name)
+		} else {
+			fmt.Fprintf(&sb, " [--%s=%s]", f.Name, f.Type)
+		}
+	}
+
+	for _, a := range c.Args {
+		name := a.Name
+		if a.Rest {
+			name += "..."
+		}
+
+		if a.Optional {
+			fmt.Fprintf(&sb, " [%s]", name)
+		} else {
+			fmt.Fprintf(&sb, " <%s>", name)
+		}
+	}
+
+	return sb.String()
+}
+
+// Help returns the detailed help text for the command
+func (c *Command) Help() string {
+	var sb strings.Builder
+	sb.WriteString(c.Synopsis())
+	if c.Usage != "" {
+		sb.WriteString("\n  ")
+		sb.WriteString(c.Usage)
+	}
+
+	if len(c.Aliases) > 0 {
+		sb.WriteString("\n  aliases: ")
+		sb.WriteString(strings.Join(c.Aliases, ", "))
+	}
+
+	for _, f := range c.Flags {
+		fmt.Fprintf(&sb, "\n  --%s (%s", f.Name, f.Type)
+		if f.Default != "" {
+			fmt.Fprintf(&sb, ", default %s", f.Default)
+		}
+		sb.WriteString(")")
+		if f.Usage != "" {
+			sb.WriteString(": ")
+			sb.WriteString(f.Usage)
+		}
+	}
+
+	return sb.String()
+}
+
+func (c *Command) validate() error {
+	if c.Name == "" {
+		return errors.New("command name is required")
+	}
+
+	if c.Handler == nil {
+		return errors.Errorf("command %s has no handler", c.Name)
+	}
+
+	optional := false
+	for i, a := range c.Args {
+		if a.Rest && i != len(c.Args)-1 {
+			return errors.Errorf("command %s: rest argument %s must be last", c.Name, a.Name)
+		}
+
+		if optional && !a.Optional {
+			return errors.Errorf("command %s: required argument %s follows an optional argument", c.Name, a.Name)
+		}
+		optional = a.Optional
+	}
+
+	for _, f := range c.Flags {
+		if f.Default == "" {
+			continue
+		}
+
+		if _, err := f.Type.parse(f.Default); err != nil {
+			return errors.Wrapf(err, "command %s: invalid default for flag %s", c.Name, f.Name)
+		}
+	}
+
+	return nil
+}
+
+// CommandContext is a parsed invocation of a command
+type CommandContext struct {
+	// Event is the event that invoked the command
+	Event *event.Event
+
+	// Command is the command that was invoked
+	Command *Command
+
+	// Invoked is the name or alias the command was invoked with
+	Invoked string
+
+	// Values are the parsed arguments and flags, keyed by name
+	Values map[string]any
+}
+
+// Has returns whether an argument or flag was given or has a default
+func (c *CommandContext) Has(name string) bool {
+	_, ok := c.Values[name]
+	return ok
+}
+
+// String returns the value of a string argument or flag
+func (c *CommandContext) String(name string) string {
+	v, _ := c.Values[name].(string)
+	return v
+}
+
+// Int returns the value of an int argument or flag
+func (c *CommandContext) Int(name string) int {
+	v, _ := c.Values[name].(int)
+	return v
+}
+
+// Float returns the value of a float argument or flag
+func (c *CommandContext) Float(name string) float64 {
+	v, _ := c.Values[name].(float64)
+	return v
+}
+
+// Bool returns the value of a bool argument or flag
+func (c *CommandContext) Bool(name string) bool {
+	v, _ := c.Values[name].(bool)
+	return v
+}
+
+// Duration returns the value of a duration argument or flag
+func (c *CommandContext) Duration(name string) time.Duration {
+	v, _ := c.Values[name].(time.Duration)
+	return v
+}
+
+// UsageError is returned when a command invocation can't be parsed
+type UsageError struct {
+	Command *Command
+	Err     error
+}
+
+func (e *UsageError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *UsageError) Unwrap() error {
+	return e.Err
+}
+
+// parse parses the input following the command name into a CommandContext
+func (c *Command) parse(input string) (*CommandContext, error) {
+	cc := &CommandContext{
+		Command: c,
+		Values:  make(map[string]any),
+	}
+
+	usageErr := func(format string, args ...any) error {
+		return &UsageError{Command: c, Err: errors.Errorf(format, args...)}
+	}
+
+	for _, f := range c.Flags {
+		if f.Default == "" {
+			continue
+		}
+
+		// validated on registration
+		cc.Values[f.Name], _ = f.Type.parse(f.Default)
+	}
+
+	tokens, err := tokenize(input)
+	if err != nil {
+		return nil, usageErr("%s", err)
+	}
+
+	positional := make([]token, 0, len(tokens))
+	for i := 0; i < len(tokens); i++ {
+		tok := tokens[i]
+		if tok.quoted || !strings.HasPrefix(tok.value, "--") {
+			positional = append(positional, tok)
+			continue
+		}
+
+		if tok.value == "--" {
+			positional = append(positional, tokens[i+1:]...)
+			break
+		}
+
+		name, value, hasValue := strings.Cut(strings.TrimPrefix(tok.value, "--"), "=")
+		flag := c.flag(name)
+		if flag == nil {
+			return nil, usageErr("unknown flag --%s", name)
+		}
+
+		if !hasValue {
+			if flag.Type == ArgBool {
+				value = "true"
+			} else if i+1 < len(tokens) {
+				i++
+				value = tokens[i].value
+			} else {
+				return nil, usageErr("flag --%s requires a value", name)
+			}
+		}
+
+		v, err := flag.Type.parse(value)
+		if err != nil {
+			return nil, usageErr("invalid value %q for flag --%s: expected %s", value, name, flag.Type)
+		}
+		cc.Values[flag.Name] = v
+	}
+
+	for i, a := range c.Args {
+		if i >= len(positional) {
+			if !a.Optional {
+				return nil, usageErr("missing argument <%s>", a.Name)
+			}
+			break
+		}
+
+		raw := positional[i].value
+		if a.Rest {
+			// the remaining positional tokens, so flags among them are parsed
+			// as flags and quotes are removed like for other arguments
+			rest := make([]string, 0, len(positional)-i)
+			for _, tok := range positional[i:] {
+				rest = append(rest, tok.value)
+			}
+			raw = strings.Join(rest, " ")
+			positional = positional[:i+1]
+		}
+
+		v, err := a.Type.parse(raw)
+		if err != nil {
+			return nil, usageErr("invalid value %q for <%s>: expected %s", raw, a.Name, a.Type)
+		}
+		cc.Values[a.Name] = v
+	}
+
+	if len(positional) > len(c.Args) {
+		return nil, usageErr("too many arguments")
+	}
+
+	return cc, nil
+}
+
+func (c *Command) flag(name string) *Flag {
+	for i := range c.Flags {
+		if c.Flags[i].Name == name {
+			return &c.Flags[i]
+		}
+	}
+
+	return nil
+}
+
+type token struct {
+	value  string
+	quoted bool
+}
+
+// tokenize splits input into whitespace separated tokens, honouring single
+// and double quotes and backslash escapes
+func tokenize(input string) ([]token, error) {
+	var (
+		tokens []token
+		cur    strings.Builder
+		quote  rune
+		inTok  bool
+		tok    token
+		escape bool
+	)
+
+	for _, r := range input {
+		switch {
+		case escape:
+			cur.WriteRune(r)
+			escape = false
+		case r == '\\' && quote != '\'':
+			if !inTok {
+				inTok, tok = true, token{}
+			}
+			escape = true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				cur.WriteRune(r)
+			}
+		case r == '"' || r == '\'':
+			if !inTok {
+				inTok, tok = true, token{}
+			}
+			quote = r
+			tok.quoted = true
+		case unicode.IsSpace(r):
+			if inTok {
+				tok.value = cur.String()
+				tokens = append(tokens, tok)
+				cur.Reset()
+				inTok = false
+			}
+		default:
+			if !inTok {
+				inTok, tok = true, token{}
+			}
+			cur.WriteRune(r)
+		}
+	}
+
+	if quote != 0 {
+		return nil, errors.New("unterminated quote")
+	}
+
+	if inTok {
+		tok.value = cur.String()
+		tokens = append(tokens, tok)
+	}
+
+	return tokens, nil
+}
+
+// commandSet is the set of registered commands. Commands may be added and
+// removed while events are handled.
+type commandSet struct {
+	mu       sync.RWMutex
+	commands []*Command
+
+	// index maps prefix+name (and aliases) to the command
+	index map[string]*Command
+
+	// prefixes are the distinct command prefixes, longest first
+	prefixes []string
+}
+
+func newCommandSet() *commandSet {
+	return &commandSet{
+		commands: make([]*Command, 0),
+		index:    make(map[string]*Command),
+	}
+}
+
+func (s *commandSet) add(cmd *Command) error {
+	if cmd.Prefix == "" {
+		cmd.Prefix = DefaultCommandPrefix
+	}
+
+	if err := cmd.validate(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	names := append([]string{cmd.Name}, cmd.Aliases...)
+	for _, name := range names {
+		key := cmd.Prefix + strings.ToLower(name)
+		if existing, ok := s.index[key]; ok {
+			return errors.Errorf("command %s already registered by %s", key, existing.Plugin)
+		}
+	}
+
+	for _, name := range names {
+		s.index[cmd.Prefix+strings.ToLower(name)] = cmd
+	}
+	s.commands = append(s.commands, cmd)
+
+	for _, p := range s.prefixes {
+		if p == cmd.Prefix {
+			return nil
+		}
+	}
+	s.prefixes = append(s.prefixes, cmd.Prefix)
+	sort.Slice(s.prefixes, func(i, j int) bool {
+		return len(s.prefixes[i]) > len(s.prefixes[j])
+	})
+
+	return nil
+}
+
+// remove removes the commands registered by a plugin, returning how many were
+// removed. Prefixes are kept, as they are cheap to check.
+func (s *commandSet) remove(plugin string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	kept := make([]*Command, 0, len(s.commands))
+	for _, cmd := range s.commands {
+		if cmd.Plugin != plugin {
+			kept = append(kept, cmd)
+		}
+	}
+
+	for key, cmd := range s.index {
+		if cmd.Plugin == plugin {
+			delete(s.index, key)
+		}
+	}
+
+	removed := len(s.commands) - len(kept)
+	s.commands = kept
+
+	return removed
+}
+
+// list returns the registered commands, in registration order
+func (s *commandSet) list() []*Command {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return append([]*Command(nil), s.commands...)
+}
+
+// lookup finds the command invoked by body, returning the command, the name
+// it was invoked with and the remaining input
+func (s *commandSet) lookup(body string) (*Command, string, string) {
+	body = strings.TrimLeftFunc(body, unicode.IsSpace)
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, prefix := range s.prefixes {
+		if !strings.HasPrefix(body, prefix) {
+			continue
+		}
+
+		rest := body[len(prefix):]
+		name, input := rest, ""
+		if i := strings.IndexFunc(rest, unicode.IsSpace); i >= 0 {
+			name, input = rest[:i], rest[i+1:]
+		}
+
+		if cmd, ok := s.index[prefix+strings.ToLower(name)]; ok {
+			return cmd, name, input
+		}
+	}
+
+	return nil, "", ""
+}
+
+// help renders the help listing for the registered commands passing filter
+func (s *commandSet) help(filter func(*Command) bool) string {
+	var sb strings.Builder
+	sb.WriteString("Available commands:")
+
+	for _, cmd := range s.list() {
+		if !filter(cmd) {
+			continue
+		}
+
+		fmt.Fprintf(&sb, "\n%s", cmd.Synopsis())
+		if cmd.Usage != "" {
+			fmt.Fprintf(&sb, " - %s", cmd.Usage)
+		}
+		if cmd.Plugin != "" {
+			fmt.Fprintf(&sb, " (%s)", cmd.Plugin)
+		}
+	}
+
+	return sb.String()
+}
+
+// Command registers a command. Commands registered by plugins are listed by
+// the built-in help command.
+func (b *Bot) Command(cmd Command) error {
+	if cmd.Plugin == "" {
+		cmd.Plugin = b.plugin
+	}
+
+	return b.cmds.add(&cmd)
+}
+
+// RemoveCommands removes the commands registered by a plugin, e.g. so a plugin
+// reloading its configuration can register them again. It returns how many
+// commands were removed.
+func (b *Bot) RemoveCommands(plugin string) int {
+	return b.cmds.remove(plugin)
+}
+
+// Commands returns the registered commands
+func (b *Bot) Commands() []*Command {
+	return b.cmds.list()
+}
+
+// IsCommand returns whether the event invokes a registered command
+func (b *Bot) IsCommand(evt *event.Event) bool {
+	msg := evt.Content.AsMessage()
+	if msg.MsgType != event.MsgText {
+		return false
+	}
+
+	cmd, _, _ := b.cmds.lookup(msg.Body)
+	return cmd != nil
+}
+
+func (b *Bot) handleCommand(ctx context.Context, evt *event.Event) error {
+	msg := evt.Content.AsMessage()
+	if msg.MsgType != event.MsgText {
+		return nil
+	}
+
+	cmd, name, input := b.cmds.lookup(msg.Body)
+	if cmd == nil {
+		return nil
+	}
+
+	if cmd.Plugin != "" && !b.PluginEnabled(ctx, evt.RoomID, cmd.Plugin) {
+		return nil
+	}
+
+	if !b.checkPermission(ctx, evt, cmd.Plugin, cmd.Prefix+cmd.Name, cmd.Permission) {
+		return nil
+	}
+
+	if !b.AllowResponse(ctx, evt) {
+		return nil
+	}
+
+	cc, err := cmd.parse(input)
+	var uerr *UsageError
+	if errors.As(err, &uerr) {
+		return b.sendNotice(ctx, evt.RoomID, uerr.Error()+"\nusage: "+cmd.Synopsis())
+	} else if err != nil {
+		return err
+	}
+
+	cc.Event = evt
+	cc.Invoked = name
+
+	b.log.Debug().
+		Str("command", cmd.Name).
+		Str("plugin", cmd.Plugin).
+		Stringer("room_id", evt.RoomID).
+		Msg("Handling command")
+
+	if err := cmd.Handler(ctx, cc); err != nil {
+		return &RouteError{Plugin: cmd.Plugin, Route: cmd.Prefix + cmd.Name, Err: err}
+	}
+
+	return nil
+}
+
+func (b *Bot) handleHelp(ctx context.Context, cc *CommandContext) error {
+	text := b.cmds.help(func(cmd *Command) bool {
+		return cmd.Plugin == "" || b.PluginEnabled(ctx, cc.Event.RoomID, cmd.Plugin)
+	})
+	if name := cc.String("command"); name != "" {
+		cmd, _, _ := b.cmds.lookup(name)
+		if cmd == nil {
+			cmd, _, _ = b.cmds.lookup(DefaultCommandPrefix + name)
+		}
+
+		if cmd == nil {
+			text = "Unknown command: " + name
+		} else {
+			text = cmd.Help()
+		}
+	}
+
+	return b.sendNotice(ctx, cc.Event.RoomID, text)
+}
@@ -0,0 +1,174 @@
+package athenais
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestTokenize(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    []string
+		quoted  []bool
+		wantErr bool
+	}{
+		{name: "empty", input: "", want: nil},
+		{name: "whitespace", input: "  \t ", want: nil},
+		{name: "words", input: "a b  c", want: []string{"a", "b", "c"}, quoted: []bool{false, false, false}},
+		{name: "double quotes", input: `say "hello world"`, want: []string{"say", "hello world"}, quoted: []bool{false, true}},
+		{name: "single quotes", input: `'a "b"' c`, want: []string{`a "b"`, "c"}, quoted: []bool{true, false}},
+		{name: "quotes within a word", input: `foo"bar baz"`, want: []string{"foobar baz"}, quoted: []bool{true}},
+		{name: "empty quotes", input: `"" x`, want: []string{"", "x"}, quoted: []bool{true, false}},
+		{name: "escaped space", input: `a\ b c`, want: []string{"a b", "c"}, quoted: []bool{false, false}},
+		{name: "escaped quote", input: `\"a`, want: []string{`"a`}, quoted: []bool{false}},
+		{name: "escape in double quotes", input: `"a\"b"`, want: []string{`a"b`}, quoted: []bool{true}},
+		{name: "no escape in single quotes", input: `'a\b'`, want: []string{`a\b`}, quoted: []bool{true}},
+		{name: "unterminated quote", input: `"abc`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tokens, err := tokenize(tt.input)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("tokenize(%q) = %v, want error", tt.input, tokens)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("tokenize(%q) error: %v", tt.input, err)
+			}
+
+			var (
+				got    []string
+				quoted []bool
+			)
+			for _, tok := range tokens {
+				got = append(got, tok.value)
+				quoted = append(quoted, tok.quoted)
+			}
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("tokenize(%q) = %q, want %q", tt.input, got, tt.want)
+			}
+			if !reflect.DeepEqual(quoted, tt.quoted) {
+				t.Errorf("tokenize(%q) quoted = %v, want %v", tt.input, quoted, tt.quoted)
+			}
+		})
+	}
+}
+
+func TestCommandParse(t *testing.T) {
+	remind := &Command{
+		Name: "remind",
+		Args: []Arg{
+			{Name: "when", Type: ArgDuration},
+			{Name: "text", Optional: true, Rest: true},
+		},
+		Flags: []Flag{
+			{Name: "loud", Type: ArgBool},
+			{Name: "times", Type: ArgInt, Default: "1"},
+		},
+	}
+
+	add := &Command{
+		Name: "add",
+		Args: []Arg{
+			{Name: "a", Type: ArgInt},
+			{Name: "b", Type: ArgFloat, Optional: true},
+		},
+	}
+
+	tests := []struct {
+		name    string
+		cmd     *Command
+		input   string
+		want    map[string]any
+		wantErr bool
+	}{
+		{
+			name:  "defaults",
+			cmd:   remind,
+			input: "5m",
+			want:  map[string]any{"when": 5 * time.Minute, "times": 1},
+		},
+		{
+			name:  "rest joins the remaining tokens",
+			cmd:   remind,
+			input: "5m  take out   the bins",
+			want:  map[string]any{"when": 5 * time.Minute, "times": 1, "text": "take out the bins"},
+		},
+		{
+			name:  "rest strips quotes",
+			cmd:   remind,
+			input: `5m "take out" 'the bins'`,
+			want:  map[string]any{"when": 5 * time.Minute, "times": 1, "text": "take out the bins"},
+		},
+		{
+			name:  "flags after rest are parsed",
+			cmd:   remind,
+			input: "5m take out the bins --loud --times 3",
+			want:  map[string]any{"when": 5 * time.Minute, "times": 3, "loud": true, "text": "take out the bins"},
+		},
+		{
+			name:  "flags before arguments",
+			cmd:   remind,
+			input: "--times=2 --loud=false 1h stretch",
+			want:  map[string]any{"when": time.Hour, "times": 2, "loud": false, "text": "stretch"},
+		},
+		{
+			name:  "double dash ends flags",
+			cmd:   remind,
+			input: "1h -- --loud is text",
+			want:  map[string]any{"when": time.Hour, "times": 1, "text": "--loud is text"},
+		},
+		{
+			name:  "quoted flags are arguments",
+			cmd:   remind,
+			input: `1h "--loud"`,
+			want:  map[string]any{"when": time.Hour, "times": 1, "text": "--loud"},
+		},
+		{
+			name:  "typed arguments",
+			cmd:   add,
+			input: "1 2.5",
+			want:  map[string]any{"a": 1, "b": 2.5},
+		},
+		{
+			name:  "optional argument missing",
+			cmd:   add,
+			input: "1",
+			want:  map[string]any{"a": 1},
+		},
+		{name: "missing argument", cmd: add, input: "", wantErr: true},
+		{name: "invalid argument", cmd: add, input: "one", wantErr: true},
+		{name: "too many arguments", cmd: add, input: "1 2 3", wantErr: true},
+		{name: "unknown flag", cmd: remind, input: "5m --nope", wantErr: true},
+		{name: "flag without value", cmd: remind, input: "5m --times", wantErr: true},
+		{name: "invalid flag value", cmd: remind, input: "5m --times=x", wantErr: true},
+		{name: "unterminated quote", cmd: remind, input: `5m "oops`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cc, err := tt.cmd.parse(tt.input)
+			if tt.wantErr {
+				var uerr *UsageError
+				if !errors.As(err, &uerr) {
+					t.Fatalf("parse(%q) error = %v, want a UsageError", tt.input, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parse(%q) error: %v", tt.input, err)
+			}
+
+			if !reflect.DeepEqual(cc.Values, tt.want) {
+				t.Errorf("parse(%q) = %v, want %v", tt.input, cc.Values, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,312 @@
+package athenais
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+)
+
+// EnvPrefix is the prefix of the environment variables overriding plugin
+// configuration, e.g. ATHENAIS_OPENAI_CHANCE overrides the chance key of the
+// openai section
+const EnvPrefix = "ATHENAIS"
+
+// Validator is implemented by plugin configurations that validate themselves
+// after they are loaded
+type Validator interface {
+	Validate() error
+}
+
+// Config is the configuration file of the bot
+//
+//	plugins:
+//	  openai:
+//	    chance: 30
+type Config struct {
+	// Plugins are the configuration sections of the plugins, keyed by plugin name
+	Plugins map[string]yaml.Node `yaml:"plugins"`
+}
+
+// LoadConfig loads the configuration file at path. An empty path loads an
+// empty configuration, so plugins get their defaults and environment overrides.
+func LoadConfig(path string) (*Config, error) {
+	cfg := &Config{}
+	if path == "" {
+		return cfg, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read config file")
+	}
+
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(cfg); err != nil {
+		return nil, errors.Wrapf(err, "invalid config file %s", path)
+	}
+
+	return cfg, nil
+}
+
+// ConfigurationError lists the problems found while configuring plugins
+type ConfigurationError struct {
+	Problems []string
+}
+
+func (e *ConfigurationError) Error() string {
+	return "invalid configuration:\n  " + strings.Join(e.Problems, "\n  ")
+}
+
+// ConfigurePlugins decodes the section of each Configurable plugin into its
+// configuration, applies environment overrides and validates the result. It
+// must be called before the plugins are passed to New.
+func (c *Config) ConfigurePlugins(plugins ...Plugin) error {
+	cerr := &ConfigurationError{}
+
+	registered := make(map[string]struct{})
+	for _, name := range Registered() {
+		registered[name] = struct{}{}
+	}
+	for _, plug := range plugins {
+		registered[plug.Name()] = struct{}{}
+	}
+
+	for name := range c.Plugins {
+		if _, ok := registered[name]; !ok {
+			cerr.Problems = append(cerr.Problems, "plugins."+name+": unknown plugin")
+		}
+	}
+
+	for _, plug := range plugins {
+		cp, ok := plug.(Configurable)
+		if !ok {
+			continue
+		}
+
+		if err := c.configure(plug.Name(), cp.Config()); err != nil {
+			cerr.Problems = append(cerr.Problems, "plugins."+plug.Name()+": "+err.Error())
+		}
+	}
+
+	if len(cerr.Problems) > 0 {
+		return cerr
+	}
+
+	return nil
+}
+
+// configure decodes the named plugin's section into target, applies
+// environment overrides and validates the result
+func (c *Config) configure(name string, target any) error {
+	if node, ok := c.Plugins[name]; ok {
+		if err := decodeStrict(&node, target); err != nil {
+			return err
+		}
+	}
+
+	if err := applyEnv(reflect.ValueOf(target), envName(EnvPrefix, name)); err != nil {
+		return err
+	}
+
+	if v, ok := target.(Validator); ok {
+		return v.Validate()
+	}
+
+	return nil
+}
+
+// ReloadConfig applies a configuration to the running plugins implementing
+// Reloader. Each one is passed a new configuration with its defaults, decoded
+// from its section. Nothing is applied if any section is invalid.
+func (b *Bot) ReloadConfig(ctx context.Context, cfg *Config) error {
+	type reload struct {
+		plugin Reloader
+		name   string
+		target any
+	}
+
+	cerr := &ConfigurationError{}
+	var reloads []reload
+	for _, plug := range b.plugins {
+		r, ok := plug.(Reloader)
+		if !ok {
+			continue
+		}
+
+		name := plug.Name()
+		fresh, ok := newPlugin(name).(Configurable)
+		if !ok {
+			continue
+		}
+
+		target := fresh.Config()
+		if err := cfg.configure(name, target); err != nil {
+			cerr.Problems = append(cerr.Problems, "plugins."+name+": "+err.Error())
+			continue
+		}
+
+		reloads = append(reloads, reload{plugin: r, name: name, target: target})
+	}
+
+	if len(cerr.Problems) > 0 {
+		return cerr
+	}
+
+	for _, r := range reloads {
+		if err := r.plugin.Reload(ctx, r.target); err != nil {
+			cerr.Problems = append(cerr.Problems, "plugins."+r.name+": "+err.Error())
+			continue
+		}
+
+		b.log.Info().Str("plugin", r.name).Msg("Reloaded plugin configuration")
+	}
+
+	if len(cerr.Problems) > 0 {
+		return cerr
+	}
+
+	return nil
+}
+
+// decodeStrict decodes node into target, rejecting unknown keys
+func decodeStrict(node *yaml.Node, target any) error {
+	data, err := yaml.Marshal(node)
+	if err != nil {
+		return err
+	}
+
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(target); err != nil {
+		var terr *yaml.TypeError
+		if errors.As(err, &terr) {
+			return errors.New(strings.Join(terr.Errors, "; "))
+		}
+		return err
+	}
+
+	return nil
+}
+
+var envNameReplacer = regexp.MustCompile(`[^A-Z0-9]+`)
+
+func envName(parts ...string) string {
+	return envNameReplacer.ReplaceAllString(strings.ToUpper(strings.Join(parts, "_")), "_")
+}
+
+// applyEnv overrides the fields of the struct v points to from environment
+// variables. A field is overridden by the variable in its env tag, or else by
+// the prefix followed by its yaml key.
+func applyEnv(v reflect.Value, prefix string) error {
+	if v.Kind() != reflect.Pointer || v.Elem().Kind() != reflect.Struct {
+		return nil
+	}
+	v = v.Elem()
+
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		if !field.IsExported() {
+			continue
+		}
+
+		key, _, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+		if key == "-" {
+			continue
+		}
+		if key == "" {
+			key = strings.ToLower(field.Name)
+		}
+
+		fv := v.Field(i)
+		if fv.Kind() == reflect.Struct && fv.Type() != reflect.TypeOf(time.Duration(0)) {
+			if err := applyEnv(fv.Addr(), envName(prefix, key)); err != nil {
+				return err
+			}
+			continue
+		}
+
+		names := []string{envName(prefix, key)}
+		if tag := field.Tag.Get("env"); tag != "" {
+			names = append(names, tag)
+		}
+
+		for _, name := range names {
+			raw, ok := os.LookupEnv(name)
+			if !ok {
+				continue
+			}
+
+			if err := setField(fv, raw); err != nil {
+				return errors.Wrapf(err, "%s: invalid value from $%s", key, name)
+			}
+		}
+	}
+
+	return nil
+}
+
+func setField(fv reflect.Value, raw string) error {
+	if fv.Type() == reflect.TypeOf(time.Duration(0)) {
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return err
+		}
+		fv.SetInt(int64(d))
+		return nil
+	}
+
+	switch fv.Kind() {
+	case reflect.String:
+		fv.SetString(raw)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return err
+		}
+		fv.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(raw, 10, fv.Type().Bits())
+		if err != nil {
+			return err
+		}
+		fv.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(raw, 10, fv.Type().Bits())
+		if err != nil {
+			return err
+		}
+		fv.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(raw, fv.Type().Bits())
+		if err != nil {
+			return err
+		}
+		fv.SetFloat(f)
+	case reflect.Slice:
+		if fv.Type().Elem().Kind() != reflect.String {
+			return errors.Errorf("unsupported type %s", fv.Type())
+		}
+
+		parts := strings.Split(raw, ",")
+		s := reflect.MakeSlice(fv.Type(), 0, len(parts))
+		for _, p := range parts {
+			if p = strings.TrimSpace(p); p != "" {
+				s = reflect.Append(s, reflect.ValueOf(p).Convert(fv.Type().Elem()))
+			}
+		}
+		fv.Set(s)
+	default:
+		return errors.Errorf("unsupported type %s", fv.Type())
+	}
+
+	return nil
+}
@@ -0,0 +1,148 @@
+package athenais
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+type testNested struct {
+	Enabled bool   `yaml:"enabled"`
+	Name    string `yaml:"name"`
+}
+
+type testConfig struct {
+	Chance   int           `yaml:"chance"`
+	Model    string        `yaml:"model" env:"TEST_MODEL"`
+	Ratio    float64       `yaml:"ratio"`
+	Timeout  time.Duration `yaml:"timeout"`
+	Rooms    []string      `yaml:"rooms"`
+	Limit    uint          `yaml:"limit"`
+	Nested   testNested    `yaml:"nested_section"`
+	Skipped  string        `yaml:"-"`
+	Untagged string
+	hidden   string
+}
+
+func TestDecodeStrict(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    testConfig
+		wantErr string
+	}{
+		{
+			name:  "known keys",
+			input: "chance: 30\nmodel: gpt\ntimeout: 5s\nrooms: [a, b]\nnested_section:\n  enabled: true\n",
+			want: testConfig{
+				Chance:  30,
+				Model:   "gpt",
+				Timeout: 5 * time.Second,
+				Rooms:   []string{"a", "b"},
+				Nested:  testNested{Enabled: true},
+			},
+		},
+		{name: "unknown key", input: "chance: 30\nchanse: 40\n", wantErr: "field chanse not found"},
+		{name: "unknown nested key", input: "nested_section:\n  enable: true\n", wantErr: "field enable not found"},
+		{name: "invalid type", input: "chance: lots\n", wantErr: "cannot unmarshal"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var doc yaml.Node
+			if err := yaml.Unmarshal([]byte(tt.input), &doc); err != nil {
+				t.Fatalf("invalid test input: %v", err)
+			}
+
+			var got testConfig
+			err := decodeStrict(doc.Content[0], &got)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("decodeStrict error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("decodeStrict error: %v", err)
+			}
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("decodeStrict = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestApplyEnv(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		want    testConfig
+		wantErr string
+	}{
+		{name: "no variables", want: testConfig{Chance: 10}},
+		{
+			name: "yaml keys",
+			env: map[string]string{
+				"ATHENAIS_TEST_CHANCE":                 "30",
+				"ATHENAIS_TEST_MODEL":                  "gpt",
+				"ATHENAIS_TEST_RATIO":                  "0.5",
+				"ATHENAIS_TEST_TIMEOUT":                "1m",
+				"ATHENAIS_TEST_ROOMS":                  "!a:x, ,!b:x",
+				"ATHENAIS_TEST_LIMIT":                  "7",
+				"ATHENAIS_TEST_NESTED_SECTION_ENABLED": "true",
+				"ATHENAIS_TEST_UNTAGGED":               "u",
+			},
+			want: testConfig{
+				Chance:   30,
+				Model:    "gpt",
+				Ratio:    0.5,
+				Timeout:  time.Minute,
+				Rooms:    []string{"!a:x", "!b:x"},
+				Limit:    7,
+				Nested:   testNested{Enabled: true},
+				Untagged: "u",
+			},
+		},
+		{
+			name: "env tag wins",
+			env:  map[string]string{"ATHENAIS_TEST_MODEL": "gpt", "TEST_MODEL": "other"},
+			want: testConfig{Chance: 10, Model: "other"},
+		},
+		{
+			name: "ignored fields",
+			env:  map[string]string{"ATHENAIS_TEST_SKIPPED": "x", "ATHENAIS_TEST_HIDDEN": "x"},
+			want: testConfig{Chance: 10},
+		},
+		{name: "invalid int", env: map[string]string{"ATHENAIS_TEST_CHANCE": "lots"}, wantErr: "chance: invalid value from $ATHENAIS_TEST_CHANCE"},
+		{name: "invalid duration", env: map[string]string{"ATHENAIS_TEST_TIMEOUT": "5"}, wantErr: "timeout: invalid value"},
+		{name: "negative uint", env: map[string]string{"ATHENAIS_TEST_LIMIT": "-1"}, wantErr: "limit: invalid value"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+
+			got := testConfig{Chance: 10}
+			err := applyEnv(reflect.ValueOf(&got), envName(EnvPrefix, "test"))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("applyEnv error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("applyEnv error: %v", err)
+			}
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("applyEnv = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
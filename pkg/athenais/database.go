@@ -0,0 +1,68 @@
+package athenais
+
+import (
+	"maunium.net/go/mautrix/util/dbutil"
+)
+
+// VersionTableName is the table tracking the schema version of the bot's tables
+const VersionTableName = "athenais_version"
+
+// upgrades are the schema upgrades of the bot's tables
+var upgrades dbutil.UpgradeTable
+
+func init() {
+	upgrades.Register(-1, 1, "Add room plugin policies", true, func(tx dbutil.Execable, db *dbutil.Database) error {
+		_, err := tx.Exec(`
+CREATE TABLE athenais_room_plugins (
+	room_id  TEXT    NOT NULL,
+	plugin   TEXT    NOT NULL,
+	enabled  BOOLEAN NOT NULL DEFAULT true,
+	settings TEXT    NOT NULL DEFAULT '{}',
+	PRIMARY KEY (room_id, plugin)
+);
+`)
+		return err
+	})
+
+	upgrades.Register(1, 2, "Add scheduled jobs", true, func(tx dbutil.Execable, db *dbutil.Database) error {
+		_, err := tx.Exec(`
+CREATE TABLE athenais_jobs (
+	id       TEXT   PRIMARY KEY,
+	plugin   TEXT   NOT NULL,
+	handler  TEXT   NOT NULL,
+	spec     TEXT   NOT NULL DEFAULT '',
+	payload  TEXT   NOT NULL DEFAULT '',
+	missed   TEXT   NOT NULL,
+	next_run BIGINT NOT NULL
+);
+`)
+		return err
+	})
+
+	upgrades.Register(2, 3, "Add outbound event queue", true, func(tx dbutil.Execable, db *dbutil.Database) error {
+		_, err := tx.Exec(`
+CREATE TABLE athenais_outbox (
+	id         INTEGER PRIMARY KEY,
+	room_id    TEXT    NOT NULL,
+	event_type TEXT    NOT NULL,
+	content    TEXT    NOT NULL,
+	txn_id     TEXT    NOT NULL,
+	attempts   INTEGER NOT NULL DEFAULT 0,
+	created_at BIGINT  NOT NULL
+);
+`)
+		return err
+	})
+
+	upgrades.Register(3, 4, "Add handled events log", true, func(tx dbutil.Execable, db *dbutil.Database) error {
+		_, err := tx.Exec(`
+CREATE TABLE athenais_processed_events (
+	event_id     TEXT   PRIMARY KEY,
+	room_id      TEXT   NOT NULL,
+	processed_at BIGINT NOT NULL
+);
+CREATE INDEX athenais_processed_events_processed_at_idx ON athenais_processed_events (processed_at);
+`)
+		return err
+	})
+}
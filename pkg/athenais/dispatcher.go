@@ -0,0 +1,257 @@
+package athenais
+
+import (
+	"context"
+	"hash/fnv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel/trace"
+	"maunium.net/go/mautrix/event"
+)
+
+const (
+	// DefaultWorkers is the default number of dispatch workers
+	DefaultWorkers = 4
+
+	// DefaultQueueDepth is the default number of events queued per worker
+	DefaultQueueDepth = 64
+)
+
+// DropPolicy decides what happens to an event when its dispatch queue is full
+type DropPolicy int
+
+const (
+	// Block waits for room in the queue, applying backpressure to the sync loop
+	Block DropPolicy = iota
+
+	// DropNewest drops the incoming event
+	DropNewest
+
+	// DropOldest drops the oldest queued event to make room for the incoming one
+	DropOldest
+)
+
+// ParseDropPolicy parses a drop policy name: block, drop-newest or drop-oldest
+func ParseDropPolicy(s string) (DropPolicy, error) {
+	switch strings.ToLower(s) {
+	case "", "block":
+		return Block, nil
+	case "drop-newest":
+		return DropNewest, nil
+	case "drop-oldest":
+		return DropOldest, nil
+	default:
+		return Block, errors.Errorf("unknown drop policy: %s", s)
+	}
+}
+
+// DispatchKey returns the key that orders events. Events with the same key
+// are handled in the order they were received.
+type DispatchKey func(*event.Event) string
+
+// RoomKey orders events per room
+func RoomKey(evt *event.Event) string {
+	return evt.RoomID.String()
+}
+
+// ThreadKey orders events per thread, and the main timeline of a room
+// separately from its threads
+func ThreadKey(evt *event.Event) string {
+	if root := threadRoot(evt); root != "" {
+		return evt.RoomID.String() + "/" + root.String()
+	}
+
+	return evt.RoomID.String()
+}
+
+// DispatcherStats are the statistics of the event dispatcher
+type DispatcherStats struct {
+	// Queued is the number of events waiting to be handled
+	Queued int64
+
+	// Processed is the number of events handled
+	Processed uint64
+
+	// Dropped is the number of events dropped because a queue was full
+	Dropped uint64
+
+	// RateLimited is the number of events not handled because of rate limits
+	RateLimited uint64
+
+	// LastLag is the time the last handled event spent queued
+	LastLag time.Duration
+
+	// MaxLag is the longest time an event spent queued
+	MaxLag time.Duration
+}
+
+type dispatchJob struct {
+	evt    *event.Event
+	queued time.Time
+
+	// span is the span the event was received in, continued by its handling
+	span trace.SpanContext
+}
+
+// dispatcher hands events to a fixed pool of workers. Events are assigned to
+// a worker by their DispatchKey, so events with the same key are handled in
+// order while different keys are handled in parallel.
+type dispatcher struct {
+	handle func(context.Context, *event.Event)
+	key    DispatchKey
+	policy DropPolicy
+	log    *zerolog.Logger
+
+	queues []chan dispatchJob
+	wg     sync.WaitGroup
+
+	// mu guards closed, so no event is submitted to a closed queue
+	mu     sync.RWMutex
+	closed bool
+
+	queued    atomic.Int64
+	processed atomic.Uint64
+	dropped   atomic.Uint64
+	lastLag   atomic.Int64
+	maxLag    atomic.Int64
+}
+
+func newDispatcher(handle func(context.Context, *event.Event), o *options) *dispatcher {
+	if o.workers < 1 {
+		o.workers = 1
+	}
+
+	if o.queueDepth < 0 {
+		o.queueDepth = 0
+	}
+
+	d := &dispatcher{
+		handle: handle,
+		key:    o.dispatchKey,
+		policy: o.dropPolicy,
+		log:    o.log,
+		queues: make([]chan dispatchJob, o.workers),
+	}
+
+	for i := range d.queues {
+		d.queues[i] = make(chan dispatchJob, o.queueDepth)
+	}
+
+	return d
+}
+
+// start starts the workers, handling events with ctx
+func (d *dispatcher) start(ctx context.Context) {
+	for _, q := range d.queues {
+		d.wg.Add(1)
+		go d.work(ctx, q)
+	}
+}
+
+// stop stops accepting events and waits for the queued events to be handled
+func (d *dispatcher) stop() {
+	d.mu.Lock()
+	if d.closed {
+		d.mu.Unlock()
+		return
+	}
+	d.closed = true
+	for _, q := range d.queues {
+		close(q)
+	}
+	d.mu.Unlock()
+
+	d.wg.Wait()
+}
+
+func (d *dispatcher) work(ctx context.Context, q chan dispatchJob) {
+	defer d.wg.Done()
+
+	for job := range q {
+		d.queued.Add(-1)
+
+		lag := time.Since(job.queued)
+		d.lastLag.Store(int64(lag))
+		for {
+			prev := d.maxLag.Load()
+			if int64(lag) <= prev || d.maxLag.CompareAndSwap(prev, int64(lag)) {
+				break
+			}
+		}
+
+		d.handle(trace.ContextWithSpanContext(ctx, job.span), job.evt)
+		d.processed.Add(1)
+	}
+}
+
+// submit queues an event, applying the drop policy if its queue is full. It
+// returns false if the event was dropped. The event is handled in the span of
+// ctx.
+func (d *dispatcher) submit(ctx context.Context, evt *event.Event) bool {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	if d.closed {
+		d.dropped.Add(1)
+		return false
+	}
+
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(d.key(evt)))
+	q := d.queues[h.Sum32()%uint32(len(d.queues))]
+
+	job := dispatchJob{evt: evt, queued: time.Now(), span: trace.SpanContextFromContext(ctx)}
+	d.queued.Add(1)
+
+	switch d.policy {
+	case DropNewest:
+		select {
+		case q <- job:
+		default:
+			d.queued.Add(-1)
+			d.drop(evt)
+			return false
+		}
+	case DropOldest:
+		for sent := false; !sent; {
+			select {
+			case q <- job:
+				sent = true
+			default:
+				select {
+				case old := <-q:
+					d.queued.Add(-1)
+					d.drop(old.evt)
+				default:
+				}
+			}
+		}
+	default:
+		q <- job
+	}
+
+	return true
+}
+
+func (d *dispatcher) drop(evt *event.Event) {
+	d.dropped.Add(1)
+	d.log.Warn().
+		Stringer("event_id", evt.ID).
+		Stringer("room_id", evt.RoomID).
+		Msg("Dispatch queue full, dropping event")
+}
+
+func (d *dispatcher) stats() DispatcherStats {
+	return DispatcherStats{
+		Queued:    d.queued.Load(),
+		Processed: d.processed.Load(),
+		Dropped:   d.dropped.Load(),
+		LastLag:   time.Duration(d.lastLag.Load()),
+		MaxLag:    time.Duration(d.maxLag.Load()),
+	}
+}
@@ -0,0 +1,195 @@
+package athenais
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// recorder records the events handled by a dispatcher, in order
+type recorder struct {
+	mu     sync.Mutex
+	events []id.EventID
+}
+
+func (r *recorder) handle(_ context.Context, evt *event.Event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.events = append(r.events, evt.ID)
+}
+
+func testDispatcher(handle func(context.Context, *event.Event), workers, depth int, policy DropPolicy) *dispatcher {
+	log := zerolog.Nop()
+
+	return newDispatcher(handle, &options{
+		log:         &log,
+		workers:     workers,
+		queueDepth:  depth,
+		dropPolicy:  policy,
+		dispatchKey: RoomKey,
+	})
+}
+
+func TestParseDropPolicy(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    DropPolicy
+		wantErr bool
+	}{
+		{input: "", want: Block},
+		{input: "block", want: Block},
+		{input: "drop-newest", want: DropNewest},
+		{input: "Drop-Oldest", want: DropOldest},
+		{input: "drop", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseDropPolicy(tt.input)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseDropPolicy(%q) error = %v, want error %v", tt.input, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseDropPolicy(%q) = %v, want %v", tt.input, got, tt.want)
+		}
+	}
+}
+
+func TestDispatcherRoomOrder(t *testing.T) {
+	const perRoom = 100
+
+	tests := []struct {
+		name    string
+		workers int
+		rooms   int
+	}{
+		{name: "one worker", workers: 1, rooms: 3},
+		{name: "worker per room", workers: 4, rooms: 4},
+		{name: "rooms share workers", workers: 3, rooms: 10},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				mu  sync.Mutex
+				got = make(map[id.RoomID][]id.EventID)
+			)
+			d := testDispatcher(func(_ context.Context, evt *event.Event) {
+				mu.Lock()
+				defer mu.Unlock()
+
+				got[evt.RoomID] = append(got[evt.RoomID], evt.ID)
+			}, tt.workers, 8, Block)
+			d.start(context.Background())
+
+			want := make(map[id.RoomID][]id.EventID)
+			for i := 0; i < perRoom; i++ {
+				for r := 0; r < tt.rooms; r++ {
+					room := id.RoomID(fmt.Sprintf("!%d:example.org", r))
+					evtID := id.EventID(fmt.Sprintf("$%d-%d", r, i))
+					want[room] = append(want[room], evtID)
+
+					if !d.submit(context.Background(), &event.Event{ID: evtID, RoomID: room}) {
+						t.Fatalf("submit(%s) dropped the event", evtID)
+					}
+				}
+			}
+			d.stop()
+
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("events handled out of order per room:\ngot  %v\nwant %v", got, want)
+			}
+			if stats := d.stats(); stats.Processed != uint64(perRoom*tt.rooms) || stats.Queued != 0 {
+				t.Errorf("stats = %+v, want %d processed and none queued", stats, perRoom*tt.rooms)
+			}
+		})
+	}
+}
+
+func TestDispatcherDropPolicy(t *testing.T) {
+	tests := []struct {
+		name        string
+		policy      DropPolicy
+		depth       int
+		submit      int
+		wantOK      []bool
+		wantHandled []id.EventID
+		wantDropped uint64
+	}{
+		{
+			name:        "queue not full",
+			policy:      DropNewest,
+			depth:       4,
+			submit:      3,
+			wantOK:      []bool{true, true, true},
+			wantHandled: []id.EventID{"$0", "$1", "$2"},
+		},
+		{
+			name:        "drop newest",
+			policy:      DropNewest,
+			depth:       2,
+			submit:      4,
+			wantOK:      []bool{true, true, false, false},
+			wantHandled: []id.EventID{"$0", "$1"},
+			wantDropped: 2,
+		},
+		{
+			name:        "drop oldest",
+			policy:      DropOldest,
+			depth:       2,
+			submit:      4,
+			wantOK:      []bool{true, true, true, true},
+			wantHandled: []id.EventID{"$2", "$3"},
+			wantDropped: 2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := &recorder{}
+			d := testDispatcher(rec.handle, 1, tt.depth, tt.policy)
+
+			// the workers aren't running yet, so the queue fills up
+			var ok []bool
+			for i := 0; i < tt.submit; i++ {
+				evt := &event.Event{ID: id.EventID(fmt.Sprintf("$%d", i)), RoomID: testRoom}
+				ok = append(ok, d.submit(context.Background(), evt))
+			}
+
+			d.start(context.Background())
+			d.stop()
+
+			if !reflect.DeepEqual(ok, tt.wantOK) {
+				t.Errorf("submit = %v, want %v", ok, tt.wantOK)
+			}
+			if !reflect.DeepEqual(rec.events, tt.wantHandled) {
+				t.Errorf("handled %v, want %v", rec.events, tt.wantHandled)
+			}
+			if stats := d.stats(); stats.Dropped != tt.wantDropped || stats.Queued != 0 {
+				t.Errorf("stats = %+v, want %d dropped and none queued", stats, tt.wantDropped)
+			}
+		})
+	}
+}
+
+func TestDispatcherStopped(t *testing.T) {
+	rec := &recorder{}
+	d := testDispatcher(rec.handle, 2, 4, Block)
+	d.start(context.Background())
+	d.stop()
+	d.stop()
+
+	if d.submit(context.Background(), &event.Event{ID: "$late", RoomID: testRoom}) {
+		t.Error("submit after stop accepted the event")
+	}
+	if len(rec.events) != 0 || d.stats().Dropped != 1 {
+		t.Errorf("handled %v with %d dropped, want none handled and 1 dropped", rec.events, d.stats().Dropped)
+	}
+}
@@ -0,0 +1,88 @@
+package athenais
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// RouteError is an error returned by a route handler, attributed to the
+// plugin and route that produced it
+type RouteError struct {
+	// Plugin is the name of the plugin that registered the route
+	Plugin string
+
+	// Route is the name of the route, or the command that failed
+	Route string
+
+	// Err is the error returned by the handler
+	Err error
+}
+
+func (e *RouteError) Error() string {
+	if e.Plugin == "" {
+		return fmt.Sprintf("%s: %s", e.Route, e.Err)
+	}
+
+	return fmt.Sprintf("%s/%s: %s", e.Plugin, e.Route, e.Err)
+}
+
+func (e *RouteError) Unwrap() error {
+	return e.Err
+}
+
+// HandleError aggregates the errors of all routes that failed to handle an
+// event
+type HandleError struct {
+	Errors []*RouteError
+}
+
+func (e *HandleError) Error() string {
+	msgs := make([]string, 0, len(e.Errors))
+	for _, err := range e.Errors {
+		msgs = append(msgs, err.Error())
+	}
+
+	return strings.Join(msgs, "; ")
+}
+
+func (e *HandleError) Unwrap() []error {
+	errs := make([]error, 0, len(e.Errors))
+	for _, err := range e.Errors {
+		errs = append(errs, err)
+	}
+
+	return errs
+}
+
+// ErrorReporter reports a route error for an event, e.g. by posting a notice
+type ErrorReporter func(ctx context.Context, evt *event.Event, err *RouteError)
+
+// noticeInRoom returns an ErrorReporter that posts a short notice into the room
+// the event was sent in. Error details are not included.
+func (b *Bot) noticeInRoom() ErrorReporter {
+	return func(ctx context.Context, evt *event.Event, rerr *RouteError) {
+		text := "Sorry, something went wrong handling your message."
+		if rerr.Plugin != "" {
+			text = fmt.Sprintf("Sorry, the %s plugin failed to handle your message.", rerr.Plugin)
+		}
+
+		if err := b.sendNotice(ctx, evt.RoomID, text); err != nil {
+			b.log.Error().Err(err).Msg("Failed to send error notice")
+		}
+	}
+}
+
+// reportToRoom returns an ErrorReporter that posts the error details into the
+// given room, e.g. an operators' room
+func (b *Bot) reportToRoom(roomID id.RoomID) ErrorReporter {
+	return func(ctx context.Context, evt *event.Event, rerr *RouteError) {
+		text := fmt.Sprintf("Error handling %s in %s from %s: %s", evt.ID, evt.RoomID, evt.Sender, rerr)
+		if err := b.sendNotice(ctx, roomID, text); err != nil {
+			b.log.Error().Err(err).Msg("Failed to send error report")
+		}
+	}
+}
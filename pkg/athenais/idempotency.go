@@ -0,0 +1,153 @@
+package athenais
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+	"maunium.net/go/mautrix/util/dbutil"
+)
+
+// DefaultEventRetention is the default time handled event IDs are remembered
+const DefaultEventRetention = 7 * 24 * time.Hour
+
+// purgeEventsJob is the ID and handler of the job forgetting old event IDs
+const purgeEventsJob = "athenais.purge-events"
+
+// eventLog records the IDs of handled events, so events replayed by the
+// homeserver, e.g. after the sync token was lost, are not handled twice.
+// Without a database the IDs only live in memory.
+type eventLog struct {
+	db        *dbutil.Database
+	retention time.Duration
+
+	mu   sync.Mutex
+	seen map[id.EventID]time.Time
+}
+
+func newEventLog(retention time.Duration) *eventLog {
+	return &eventLog{
+		retention: retention,
+		seen:      make(map[id.EventID]time.Time),
+	}
+}
+
+// handled returns whether an event was recorded as handled
+func (l *eventLog) handled(ctx context.Context, evt *event.Event) (bool, error) {
+	if l.db == nil {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+
+		_, ok := l.seen[evt.ID]
+		return ok, nil
+	}
+
+	var n int
+	err := l.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM athenais_processed_events WHERE event_id = $1", evt.ID).Scan(&n)
+	if err != nil {
+		return false, errors.Wrap(err, "failed to look up event")
+	}
+
+	return n > 0, nil
+}
+
+// record records an event as handled. Events are recorded once handling
+// finished, so an event cut short by a crash is handled again when replayed.
+// Events with the same dispatch key are handled in order, so an event is
+// never handled twice at the same time.
+func (l *eventLog) record(ctx context.Context, evt *event.Event) error {
+	now := time.Now()
+
+	if l.db == nil {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+
+		l.seen[evt.ID] = now
+		return nil
+	}
+
+	_, err := l.db.ExecContext(ctx, `
+INSERT INTO athenais_processed_events (event_id, room_id, processed_at) VALUES ($1, $2, $3)
+ON CONFLICT (event_id) DO NOTHING
+`, evt.ID, evt.RoomID, now.UnixMilli())
+	if err != nil {
+		return errors.Wrap(err, "failed to record event")
+	}
+
+	return nil
+}
+
+// purge forgets the events handled before the retention window
+func (l *eventLog) purge(ctx context.Context) (int64, error) {
+	cutoff := time.Now().Add(-l.retention)
+
+	if l.db == nil {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+
+		var n int64
+		for evtID, t := range l.seen {
+			if t.Before(cutoff) {
+				delete(l.seen, evtID)
+				n++
+			}
+		}
+
+		return n, nil
+	}
+
+	res, err := l.db.ExecContext(ctx, "DELETE FROM athenais_processed_events WHERE processed_at < $1", cutoff.UnixMilli())
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to purge handled events")
+	}
+
+	return res.RowsAffected()
+}
+
+// duplicate returns whether the event was handled before. Events that can't
+// be checked are handled, rather than risking dropping them.
+func (b *Bot) duplicate(ctx context.Context, evt *event.Event) bool {
+	if evt.ID == "" {
+		return false
+	}
+
+	handled, err := b.events.handled(ctx, evt)
+	if err != nil {
+		b.log.Error().Err(err).Stringer("event_id", evt.ID).Msg("Failed to check for duplicate event")
+		return false
+	}
+
+	if handled {
+		b.log.Debug().
+			Stringer("event_id", evt.ID).
+			Stringer("room_id", evt.RoomID).
+			Msg("Skipping duplicate event")
+	}
+
+	return handled
+}
+
+// markHandled records the event as handled, unless handling was cut short by
+// shutdown, so it is handled again if the homeserver replays it
+func (b *Bot) markHandled(ctx context.Context, evt *event.Event) {
+	if evt.ID == "" || ctx.Err() != nil {
+		return
+	}
+
+	if err := b.events.record(ctx, evt); err != nil {
+		b.log.Error().Err(err).Stringer("event_id", evt.ID).Msg("Failed to record handled event")
+	}
+}
+
+func (b *Bot) purgeEvents(ctx context.Context, job Job, scheduled time.Time) error {
+	n, err := b.events.purge(ctx)
+	if err != nil {
+		return err
+	}
+
+	b.log.Debug().Int64("count", n).Msg("Purged handled events")
+	return nil
+}
@@ -0,0 +1,130 @@
+package athenais
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestDuplicateSuppression(t *testing.T) {
+	type delivery struct {
+		evtID id.EventID
+
+		// cancelled cuts handling short, as on shutdown
+		cancelled bool
+	}
+
+	tests := []struct {
+		name       string
+		deliveries []delivery
+		want       []id.EventID
+	}{
+		{
+			name:       "distinct events",
+			deliveries: []delivery{{evtID: "$a"}, {evtID: "$b"}},
+			want:       []id.EventID{"$a", "$b"},
+		},
+		{
+			name:       "replayed events",
+			deliveries: []delivery{{evtID: "$a"}, {evtID: "$b"}, {evtID: "$a"}, {evtID: "$b"}},
+			want:       []id.EventID{"$a", "$b"},
+		},
+		{
+			name:       "events without ID",
+			deliveries: []delivery{{}, {}},
+			want:       []id.EventID{"", ""},
+		},
+		{
+			name:       "cut short by shutdown",
+			deliveries: []delivery{{evtID: "$a", cancelled: true}, {evtID: "$a"}, {evtID: "$a"}},
+			want:       []id.EventID{"$a", "$a"},
+		},
+	}
+
+	for _, database := range []bool{false, true} {
+		for _, tt := range tests {
+			name := tt.name
+			if database {
+				name += " persisted"
+			}
+
+			t.Run(name, func(t *testing.T) {
+				log := zerolog.Nop()
+				b := &Bot{log: &log, events: newEventLog(time.Hour)}
+				if database {
+					b.events.db = testDatabase(t)
+				}
+
+				var handled []id.EventID
+				for _, d := range tt.deliveries {
+					ctx, cancel := context.WithCancel(context.Background())
+					if d.cancelled {
+						cancel()
+					}
+
+					evt := &event.Event{ID: d.evtID, RoomID: testRoom}
+					if !b.duplicate(ctx, evt) {
+						handled = append(handled, evt.ID)
+						b.markHandled(ctx, evt)
+					}
+					cancel()
+				}
+
+				if !reflect.DeepEqual(handled, tt.want) {
+					t.Errorf("handled %v, want %v", handled, tt.want)
+				}
+			})
+		}
+	}
+}
+
+func TestEventLogPurge(t *testing.T) {
+	tests := []struct {
+		name       string
+		retention  time.Duration
+		database   bool
+		wantPurged int64
+	}{
+		{name: "within retention", retention: time.Hour},
+		{name: "past retention", retention: -time.Minute, wantPurged: 2},
+		{name: "within retention persisted", retention: time.Hour, database: true},
+		{name: "past retention persisted", retention: -time.Minute, database: true, wantPurged: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			l := newEventLog(tt.retention)
+			if tt.database {
+				l.db = testDatabase(t)
+			}
+
+			for _, evtID := range []id.EventID{"$a", "$b"} {
+				if err := l.record(ctx, &event.Event{ID: evtID, RoomID: testRoom}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			n, err := l.purge(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != tt.wantPurged {
+				t.Errorf("purged %d events, want %d", n, tt.wantPurged)
+			}
+
+			handled, err := l.handled(ctx, &event.Event{ID: "$a"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := tt.wantPurged == 0; handled != want {
+				t.Errorf("handled after purge = %v, want %v", handled, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,287 @@
+package athenais
+
+import (
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// Match holds the values captured while matching a route against an event
+type Match struct {
+	// Groups are the groups captured by a body regular expression. Groups[0]
+	// is the full match.
+	Groups []string
+
+	// Named are the named groups captured by a body regular expression
+	Named map[string]string
+}
+
+// Matcher decides whether a route applies to an event. Matchers may record
+// captured values in the Match.
+type Matcher interface {
+	Match(evt *event.Event, m *Match) bool
+}
+
+// MatcherFunc adapts a function to a Matcher
+type MatcherFunc func(evt *event.Event, m *Match) bool
+
+// Match calls f(evt, m)
+func (f MatcherFunc) Match(evt *event.Event, m *Match) bool {
+	return f(evt, m)
+}
+
+// roomMatcher matches events in a set of rooms. Routes with a roomMatcher are
+// indexed by room in the Router, so they are only considered for events in
+// those rooms.
+type roomMatcher map[id.RoomID]struct{}
+
+func (rm roomMatcher) Match(evt *event.Event, _ *Match) bool {
+	_, ok := rm[evt.RoomID]
+	return ok
+}
+
+// InRooms matches events in any of the given rooms
+func InRooms(rooms ...id.RoomID) Matcher {
+	rm := make(roomMatcher, len(rooms))
+	for _, room := range rooms {
+		rm[room] = struct{}{}
+	}
+
+	return rm
+}
+
+// FromSenders matches events sent by a user matching any of the given globs,
+// e.g. "@*:example.org"
+func FromSenders(globs ...string) Matcher {
+	return MatcherFunc(func(evt *event.Event, _ *Match) bool {
+		for _, glob := range globs {
+			if ok, _ := path.Match(glob, evt.Sender.String()); ok {
+				return true
+			}
+		}
+
+		return false
+	})
+}
+
+// MsgTypes matches message events with any of the given msgtypes
+func MsgTypes(types ...event.MessageType) Matcher {
+	return MatcherFunc(func(evt *event.Event, _ *Match) bool {
+		msg := evt.Content.AsMessage()
+		for _, t := range types {
+			if msg.MsgType == t {
+				return true
+			}
+		}
+
+		return false
+	})
+}
+
+// BodyRegex matches message events whose body matches re. The captured groups
+// are recorded in the Match.
+func BodyRegex(re *regexp.Regexp) Matcher {
+	return MatcherFunc(func(evt *event.Event, m *Match) bool {
+		groups := re.FindStringSubmatch(evt.Content.AsMessage().Body)
+		if groups == nil {
+			return false
+		}
+
+		m.Groups = groups
+		m.Named = make(map[string]string)
+		for i, name := range re.SubexpNames() {
+			if name != "" {
+				m.Named[name] = groups[i]
+			}
+		}
+
+		return true
+	})
+}
+
+// BodyMatches is like BodyRegex, but compiles the pattern. It panics if the
+// pattern is invalid.
+func BodyMatches(pattern string) Matcher {
+	return BodyRegex(regexp.MustCompile(pattern))
+}
+
+// Mentions matches message events that mention the user: in the m.mentions
+// of the event, by a pill in the formatted body, or by their full user ID in
+// the plain body. The reply fallback doesn't count as a mention.
+func Mentions(userID id.UserID) Matcher {
+	pills := []string{
+		"matrix.to/#/" + userID.String(),
+		"matrix.to/#/" + url.QueryEscape(userID.String()),
+	}
+
+	return MatcherFunc(func(evt *event.Event, _ *Match) bool {
+		msg := evt.Content.AsMessage()
+
+		for _, mentions := range []*event.Mentions{msg.Mentions, msg.UnstableMentions} {
+			if mentions == nil {
+				continue
+			}
+			for _, mentioned := range mentions.UserIDs {
+				if mentioned == userID {
+					return true
+				}
+			}
+		}
+
+		formatted := stripReplyFallbackHTML(msg.FormattedBody)
+		for _, pill := range pills {
+			if strings.Contains(formatted, pill) {
+				return true
+			}
+		}
+
+		return strings.Contains(stripReplyFallback(msg.Body), userID.String())
+	})
+}
+
+// RepliesTo matches message events replying to an event sent by the user,
+// based on the m.relates_to relation of the event. The sender of the replied
+// to event is looked up, and fetched from the homeserver if the bot hasn't
+// seen the event.
+func (b *Bot) RepliesTo(userID id.UserID) Matcher {
+	return MatcherFunc(func(evt *event.Event, _ *Match) bool {
+		msg := evt.Content.AsMessage()
+		if msg.RelatesTo == nil {
+			return false
+		}
+
+		replyTo := msg.RelatesTo.GetReplyTo()
+		if replyTo == "" {
+			return false
+		}
+
+		return b.senderOf(evt.RoomID, replyTo) == userID
+	})
+}
+
+// Addressed matches message events that mention or reply to the user
+func (b *Bot) Addressed(userID id.UserID) Matcher {
+	return Any(Mentions(userID), b.RepliesTo(userID))
+}
+
+// maxSenders is the number of event senders remembered for RepliesTo
+const maxSenders = 10000
+
+// senderCache remembers the senders of recent events, so replies to them can
+// be matched without asking the homeserver
+type senderCache struct {
+	mu      sync.Mutex
+	senders map[id.EventID]id.UserID
+	order   []id.EventID
+}
+
+func newSenderCache() *senderCache {
+	return &senderCache{senders: make(map[id.EventID]id.UserID)}
+}
+
+func (c *senderCache) get(evtID id.EventID) (id.UserID, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	sender, ok := c.senders[evtID]
+	return sender, ok
+}
+
+// put remembers the sender of an event, forgetting the oldest one when full
+func (c *senderCache) put(evtID id.EventID, sender id.UserID) {
+	if evtID == "" || sender == "" {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.senders[evtID]; ok {
+		return
+	}
+
+	if len(c.order) >= maxSenders {
+		delete(c.senders, c.order[0])
+		c.order = c.order[1:]
+	}
+
+	c.senders[evtID] = sender
+	c.order = append(c.order, evtID)
+}
+
+// senderOf returns the sender of an event, fetching it from the homeserver if
+// it isn't remembered. It returns "" if the event can't be fetched.
+func (b *Bot) senderOf(roomID id.RoomID, evtID id.EventID) id.UserID {
+	if sender, ok := b.senders.get(evtID); ok {
+		return sender
+	}
+
+	evt, err := b.mc.GetEvent(roomID, evtID)
+	if err != nil {
+		b.log.Warn().Err(err).Stringer("event_id", evtID).Msg("Failed to fetch replied to event")
+		return ""
+	}
+
+	b.senders.put(evtID, evt.Sender)
+	return evt.Sender
+}
+
+// All matches events matched by all of the given matchers
+func All(matchers ...Matcher) Matcher {
+	return MatcherFunc(func(evt *event.Event, m *Match) bool {
+		for _, matcher := range matchers {
+			if !matcher.Match(evt, m) {
+				return false
+			}
+		}
+
+		return true
+	})
+}
+
+// Any matches events matched by any of the given matchers
+func Any(matchers ...Matcher) Matcher {
+	return MatcherFunc(func(evt *event.Event, m *Match) bool {
+		for _, matcher := range matchers {
+			if matcher.Match(evt, m) {
+				return true
+			}
+		}
+
+		return false
+	})
+}
+
+// Not matches events that are not matched by the given matcher
+func Not(matcher Matcher) Matcher {
+	return MatcherFunc(func(evt *event.Event, _ *Match) bool {
+		return !matcher.Match(evt, &Match{})
+	})
+}
+
+// stripReplyFallbackHTML removes the <mx-reply> reply fallback from a
+// formatted body
+func stripReplyFallbackHTML(body string) string {
+	if i := strings.Index(body, "</mx-reply>"); i >= 0 {
+		return body[i+len("</mx-reply>"):]
+	}
+
+	return body
+}
+
+// stripReplyFallback removes the quoted reply fallback lines from a body
+func stripReplyFallback(body string) string {
+	lines := strings.Split(body, "\n")
+	for i, line := range lines {
+		if !strings.HasPrefix(line, "> ") && line != ">" {
+			return strings.Join(lines[i:], "\n")
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,206 @@
+package athenais
+
+import (
+	"reflect"
+	"regexp"
+	"testing"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+const (
+	testBot  = id.UserID("@athena:example.org")
+	testUser = id.UserID("@alice:example.org")
+	testRoom = id.RoomID("!room:example.org")
+)
+
+func message(msg *event.MessageEventContent) *event.Event {
+	if msg.MsgType == "" {
+		msg.MsgType = event.MsgText
+	}
+
+	return &event.Event{
+		Type:    event.EventMessage,
+		RoomID:  testRoom,
+		Sender:  testUser,
+		Content: event.Content{Parsed: msg},
+	}
+}
+
+func TestMentions(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  *event.MessageEventContent
+		want bool
+	}{
+		{
+			name: "m.mentions",
+			msg:  &event.MessageEventContent{Body: "hi", Mentions: &event.Mentions{UserIDs: []id.UserID{testUser, testBot}}},
+			want: true,
+		},
+		{
+			name: "unstable mentions",
+			msg:  &event.MessageEventContent{Body: "hi", UnstableMentions: &event.Mentions{UserIDs: []id.UserID{testBot}}},
+			want: true,
+		},
+		{
+			name: "m.mentions of someone else",
+			msg:  &event.MessageEventContent{Body: "hi", Mentions: &event.Mentions{UserIDs: []id.UserID{testUser}}},
+			want: false,
+		},
+		{
+			name: "pill",
+			msg: &event.MessageEventContent{
+				Body:          "athena: hi",
+				Format:        event.FormatHTML,
+				FormattedBody: `<a href="https://matrix.to/#/@athena:example.org">athena</a>: hi`,
+			},
+			want: true,
+		},
+		{
+			name: "escaped pill",
+			msg: &event.MessageEventContent{
+				Body:          "athena: hi",
+				Format:        event.FormatHTML,
+				FormattedBody: `<a href="https://matrix.to/#/%40athena%3Aexample.org">athena</a>: hi`,
+			},
+			want: true,
+		},
+		{
+			name: "full user ID",
+			msg:  &event.MessageEventContent{Body: "ping @athena:example.org"},
+			want: true,
+		},
+		{
+			name: "localpart only",
+			msg:  &event.MessageEventContent{Body: "athena is a goddess"},
+			want: false,
+		},
+		{
+			name: "reply fallback",
+			msg: &event.MessageEventContent{
+				Body:          "> <@athena:example.org> hello\n\nhi",
+				Format:        event.FormatHTML,
+				FormattedBody: `<mx-reply><blockquote><a href="https://matrix.to/#/@athena:example.org">athena</a> hello</blockquote></mx-reply>hi`,
+			},
+			want: false,
+		},
+	}
+
+	matcher := Mentions(testBot)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := matcher.Match(message(tt.msg), &Match{}); got != tt.want {
+				t.Errorf("Mentions(%s) = %v, want %v", testBot, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRepliesTo(t *testing.T) {
+	b := &Bot{senders: newSenderCache()}
+	b.senders.put("$bot", testBot)
+	b.senders.put("$user", testUser)
+
+	reply := func(evtID id.EventID) *event.MessageEventContent {
+		return &event.MessageEventContent{
+			Body:      "> <@athena:example.org> hello\n\nhi",
+			RelatesTo: &event.RelatesTo{InReplyTo: &event.InReplyTo{EventID: evtID}},
+		}
+	}
+
+	tests := []struct {
+		name string
+		msg  *event.MessageEventContent
+		want bool
+	}{
+		{name: "reply to the user", msg: reply("$bot"), want: true},
+		{name: "reply to someone else", msg: reply("$user"), want: false},
+		{name: "reply fallback without relation", msg: &event.MessageEventContent{Body: "> <@athena:example.org> hello\n\nhi"}, want: false},
+		{
+			name: "thread without reply",
+			msg:  &event.MessageEventContent{Body: "hi", RelatesTo: &event.RelatesTo{Type: event.RelThread, EventID: "$bot"}},
+			want: false,
+		},
+	}
+
+	matcher := b.RepliesTo(testBot)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := matcher.Match(message(tt.msg), &Match{}); got != tt.want {
+				t.Errorf("RepliesTo(%s) = %v, want %v", testBot, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMatchers(t *testing.T) {
+	evt := message(&event.MessageEventContent{MsgType: event.MsgNotice, Body: "remind me in 5m"})
+	yes := MatcherFunc(func(*event.Event, *Match) bool { return true })
+	no := MatcherFunc(func(*event.Event, *Match) bool { return false })
+
+	tests := []struct {
+		name    string
+		matcher Matcher
+		want    bool
+	}{
+		{name: "in room", matcher: InRooms("!other:example.org", testRoom), want: true},
+		{name: "not in room", matcher: InRooms("!other:example.org"), want: false},
+		{name: "sender glob", matcher: FromSenders("@bob:*", "@*:example.org"), want: true},
+		{name: "other sender", matcher: FromSenders("@*:example.com"), want: false},
+		{name: "msgtype", matcher: MsgTypes(event.MsgText, event.MsgNotice), want: true},
+		{name: "other msgtype", matcher: MsgTypes(event.MsgEmote), want: false},
+		{name: "body", matcher: BodyMatches(`in \d+m$`), want: true},
+		{name: "other body", matcher: BodyMatches(`^!remind`), want: false},
+		{name: "all", matcher: All(yes, yes), want: true},
+		{name: "not all", matcher: All(yes, no), want: false},
+		{name: "all of none", matcher: All(), want: true},
+		{name: "any", matcher: Any(no, yes), want: true},
+		{name: "not any", matcher: Any(no, no), want: false},
+		{name: "not", matcher: Not(no), want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.matcher.Match(evt, &Match{}); got != tt.want {
+				t.Errorf("Match = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBodyRegexCaptures(t *testing.T) {
+	evt := message(&event.MessageEventContent{Body: "remind me in 5m"})
+
+	m := &Match{}
+	if !BodyRegex(regexp.MustCompile(`in (?P<amount>\d+)(m|h)`)).Match(evt, m) {
+		t.Fatal("BodyRegex didn't match")
+	}
+
+	if want := []string{"in 5m", "5", "m"}; !reflect.DeepEqual(m.Groups, want) {
+		t.Errorf("Groups = %q, want %q", m.Groups, want)
+	}
+	if want := map[string]string{"amount": "5"}; !reflect.DeepEqual(m.Named, want) {
+		t.Errorf("Named = %v, want %v", m.Named, want)
+	}
+}
+
+func TestStripReplyFallback(t *testing.T) {
+	tests := []struct {
+		body string
+		want string
+	}{
+		{body: "hello", want: "hello"},
+		{body: "> <@a:b> quoted\n> more\n\nreply", want: "\nreply"},
+		{body: ">\n> quoted\nreply", want: "reply"},
+		{body: "> only quotes", want: ""},
+		{body: ">not a quote", want: ">not a quote"},
+	}
+
+	for _, tt := range tests {
+		if got := stripReplyFallback(tt.body); got != tt.want {
+			t.Errorf("stripReplyFallback(%q) = %q, want %q", tt.body, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package athenais
+
+import (
+	"context"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/format"
+	"maunium.net/go/mautrix/id"
+)
+
+// SendMessage sends a message event to a room and returns its event ID.
+// Messages are queued and sent in order per room, retrying failed sends. If
+// ctx is done before the message is sent, ErrQueued is returned and the
+// message is sent later. While the bot is not running ErrNotRunning is
+// returned.
+func (b *Bot) SendMessage(ctx context.Context, roomID id.RoomID, content *event.MessageEventContent) (id.EventID, error) {
+	return b.sendEvent(ctx, roomID, event.EventMessage, content)
+}
+
+// SendText sends a plain text message to a room
+func (b *Bot) SendText(ctx context.Context, roomID id.RoomID, text string) (id.EventID, error) {
+	return b.SendMessage(ctx, roomID, &event.MessageEventContent{
+		MsgType: event.MsgText,
+		Body:    text,
+	})
+}
+
+// SendNotice sends a plain text notice to a room. Notices are meant for
+// automated messages, and other bots don't respond to them.
+func (b *Bot) SendNotice(ctx context.Context, roomID id.RoomID, text string) (id.EventID, error) {
+	return b.SendMessage(ctx, roomID, &event.MessageEventContent{
+		MsgType: event.MsgNotice,
+		Body:    text,
+	})
+}
+
+// SendMarkdown sends a message to a room, rendering markdown into its
+// formatted body
+func (b *Bot) SendMarkdown(ctx context.Context, roomID id.RoomID, markdown string) (id.EventID, error) {
+	content := renderMarkdown(markdown)
+	return b.SendMessage(ctx, roomID, &content)
+}
+
+// Reply sends a markdown message replying to evt, with a reply fallback for
+// clients without reply support. Replies to events in a thread stay in the
+// thread.
+func (b *Bot) Reply(ctx context.Context, evt *event.Event, markdown string) (id.EventID, error) {
+	content := renderMarkdown(markdown)
+	content.SetReply(evt)
+
+	if root := threadRoot(evt); root != "" {
+		content.RelatesTo.Type = event.RelThread
+		content.RelatesTo.EventID = root
+	}
+
+	return b.SendMessage(ctx, evt.RoomID, &content)
+}
+
+// ReplyInThread sends a markdown message into the thread of evt, starting a
+// thread at evt if it is not in one
+func (b *Bot) ReplyInThread(ctx context.Context, evt *event.Event, markdown string) (id.EventID, error) {
+	root := threadRoot(evt)
+	if root == "" {
+		root = evt.ID
+	}
+
+	content := renderMarkdown(markdown)
+	content.RelatesTo = (&event.RelatesTo{}).SetThread(root, evt.ID)
+
+	return b.SendMessage(ctx, evt.RoomID, &content)
+}
+
+// SendThread sends a markdown message into the thread rooted at root
+func (b *Bot) SendThread(ctx context.Context, roomID id.RoomID, root id.EventID, markdown string) (id.EventID, error) {
+	content := renderMarkdown(markdown)
+	content.RelatesTo = (&event.RelatesTo{}).SetThread(root, root)
+
+	return b.SendMessage(ctx, roomID, &content)
+}
+
+// Edit replaces the content of a message the bot sent with markdown
+func (b *Bot) Edit(ctx context.Context, roomID id.RoomID, eventID id.EventID, markdown string) (id.EventID, error) {
+	content := renderMarkdown(markdown)
+	content.SetEdit(eventID)
+
+	return b.SendMessage(ctx, roomID, &content)
+}
+
+// React reacts to an event with key, usually an emoji
+func (b *Bot) React(ctx context.Context, roomID id.RoomID, eventID id.EventID, key string) (id.EventID, error) {
+	return b.sendEvent(ctx, roomID, event.EventReaction, &event.ReactionEventContent{
+		RelatesTo: *(&event.RelatesTo{}).SetAnnotation(eventID, key),
+	})
+}
+
+// Redact redacts an event, e.g. a message or reaction the bot sent, and
+// returns the ID of the redaction event
+func (b *Bot) Redact(ctx context.Context, roomID id.RoomID, eventID id.EventID, reason string) (id.EventID, error) {
+	resp, err := b.mc.RedactEventContext(ctx, roomID, eventID, reason)
+	if err != nil {
+		return "", err
+	}
+
+	return resp.EventID, nil
+}
+
+// sendNotice sends a notice to a room, for the bot's own messages
+func (b *Bot) sendNotice(ctx context.Context, roomID id.RoomID, text string) error {
+	_, err := b.SendNotice(ctx, roomID, text)
+	return err
+}
+
+// renderMarkdown renders markdown into a text message with a formatted body
+func renderMarkdown(markdown string) event.MessageEventContent {
+	return format.RenderMarkdown(markdown, true, false)
+}
+
+// threadRoot returns the root of the thread evt is in, if any
+func threadRoot(evt *event.Event) id.EventID {
+	msg := evt.Content.AsMessage()
+	if msg.RelatesTo != nil && msg.RelatesTo.Type == event.RelThread {
+		return msg.RelatesTo.EventID
+	}
+
+	return ""
+}
@@ -0,0 +1,110 @@
+package athenais
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/rs/zerolog"
+)
+
+// MetricsNamespace prefixes the names of the bot's metrics
+const MetricsNamespace = "athenais"
+
+var (
+	eventsReceived = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: MetricsNamespace,
+		Name:      "events_received_total",
+		Help:      "Events received from the homeserver, by event type and sync source.",
+	}, []string{"type", "source"})
+
+	eventLag = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: MetricsNamespace,
+		Name:      "event_lag_seconds",
+		Help:      "Time from an event being sent to the bot receiving it through sync.",
+		Buckets:   []float64{.05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 300},
+	})
+
+	routeDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: MetricsNamespace,
+		Name:      "route_duration_seconds",
+		Help:      "Time route handlers take to handle an event, by route and plugin.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "plugin"})
+
+	routeErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: MetricsNamespace,
+		Name:      "route_errors_total",
+		Help:      "Route handlers that returned an error, by route and plugin.",
+	}, []string{"route", "plugin"})
+
+	messagesSent = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: MetricsNamespace,
+		Name:      "messages_sent_total",
+		Help:      "Events sent to rooms, by event type.",
+	}, []string{"type"})
+
+	sendRetries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: MetricsNamespace,
+		Name:      "message_send_retries_total",
+		Help:      "Failed attempts to send an event that are retried, by event type.",
+	}, []string{"type"})
+
+	sendFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: MetricsNamespace,
+		Name:      "message_send_failures_total",
+		Help:      "Events that were given up on sending, by event type.",
+	}, []string{"type"})
+)
+
+// metricsServer serves the metrics of the default Prometheus registry
+type metricsServer struct {
+	listen string
+	server *http.Server
+	log    *zerolog.Logger
+}
+
+func newMetricsServer(listen string, log *zerolog.Logger) *metricsServer {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+
+	return &metricsServer{
+		listen: listen,
+		log:    log,
+		server: &http.Server{
+			Addr:              listen,
+			Handler:           mux,
+			ReadHeaderTimeout: 10 * time.Second,
+		},
+	}
+}
+
+// start listens and serves the metrics in the background
+func (m *metricsServer) start() error {
+	l, err := net.Listen("tcp", m.listen)
+	if err != nil {
+		return errors.Wrap(err, "failed to listen for metrics")
+	}
+
+	m.log.Info().Str("listen", l.Addr().String()).Msg("Serving metrics")
+
+	go func() {
+		if err := m.server.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			m.log.Error().Err(err).Msg("Metrics server failed")
+		}
+	}()
+
+	return nil
+}
+
+// stop stops serving the metrics
+func (m *metricsServer) stop(ctx context.Context) {
+	if err := m.server.Shutdown(ctx); err != nil {
+		m.log.Error().Err(err).Msg("Failed to stop metrics server")
+	}
+}
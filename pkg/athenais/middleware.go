@@ -0,0 +1,97 @@
+package athenais
+
+import (
+	"context"
+	"runtime/debug"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/event"
+)
+
+// ErrHandlerTimeout is returned when a handler runs past its timeout
+var ErrHandlerTimeout = errors.New("handler timed out")
+
+// Middleware wraps the handler of a route. Middleware registered on the Router
+// wraps every route, middleware set on a Route only wraps that route.
+type Middleware func(route Route, next RouteHandler) RouteHandler
+
+// chain wraps the handler in the middlewares, the first middleware being the
+// outermost
+func chain(route Route, h RouteHandler, mws []Middleware) RouteHandler {
+	for i := len(mws) - 1; i >= 0; i-- {
+		h = mws[i](route, h)
+	}
+
+	return h
+}
+
+// Recover recovers panics in handlers, logging the stack and returning the
+// panic as an error
+func Recover(log *zerolog.Logger) Middleware {
+	return func(route Route, next RouteHandler) RouteHandler {
+		return func(ctx context.Context, evt *event.Event) (err error) {
+			defer func() {
+				if rec := recover(); rec != nil {
+					log.Error().
+						Str("plugin", route.Plugin).
+						Str("route", route.Name).
+						Stringer("event_id", evt.ID).
+						Interface("panic", rec).
+						Bytes("stack", debug.Stack()).
+						Msg("Recovered panic in handler")
+
+					err = errors.Errorf("panic in route %s: %v", route.Name, rec)
+				}
+			}()
+
+			return next(ctx, evt)
+		}
+	}
+}
+
+// Timeout sets a deadline of d on the handler's context. Handlers failing once
+// the deadline expired return ErrHandlerTimeout.
+func Timeout(d time.Duration) Middleware {
+	return func(route Route, next RouteHandler) RouteHandler {
+		return func(ctx context.Context, evt *event.Event) error {
+			tctx, cancel := context.WithTimeout(ctx, d)
+			defer cancel()
+
+			err := next(tctx, evt)
+			// only map our own deadline, not the parent context's
+			if err != nil && errors.Is(tctx.Err(), context.DeadlineExceeded) && ctx.Err() == nil {
+				return errors.Wrapf(ErrHandlerTimeout, "route %s after %s", route.Name, d)
+			}
+
+			return err
+		}
+	}
+}
+
+// Logging logs every handler invocation with its plugin, route, event and
+// duration
+func Logging(log *zerolog.Logger) Middleware {
+	return func(route Route, next RouteHandler) RouteHandler {
+		return func(ctx context.Context, evt *event.Event) error {
+			start := time.Now()
+			err := next(ctx, evt)
+
+			l := log.Debug()
+			if err != nil {
+				l = log.Error().Err(err)
+			}
+
+			l.Str("plugin", route.Plugin).
+				Str("route", route.Name).
+				Stringer("event_id", evt.ID).
+				Stringer("room_id", evt.RoomID).
+				Stringer("sender", evt.Sender).
+				Dur("duration", time.Since(start)).
+				Msg("Handled event")
+
+			return err
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package athenais
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"maunium.net/go/mautrix/event"
+)
+
+func TestTimeout(t *testing.T) {
+	errFailed := errors.New("failed")
+	blocking := func(ctx context.Context, _ *event.Event) error {
+		<-ctx.Done()
+		return errors.Wrap(ctx.Err(), "waiting")
+	}
+
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	tests := []struct {
+		name    string
+		ctx     context.Context
+		handler RouteHandler
+		want    error
+	}{
+		{
+			name:    "finishes in time",
+			ctx:     context.Background(),
+			handler: func(context.Context, *event.Event) error { return nil },
+		},
+		{
+			name:    "fails in time",
+			ctx:     context.Background(),
+			handler: func(context.Context, *event.Event) error { return errFailed },
+			want:    errFailed,
+		},
+		{
+			name:    "deadline expires",
+			ctx:     context.Background(),
+			handler: blocking,
+			want:    ErrHandlerTimeout,
+		},
+		{
+			name:    "parent cancelled",
+			ctx:     cancelled,
+			handler: blocking,
+			want:    context.Canceled,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := Timeout(10*time.Millisecond)(Route{Name: "test"}, tt.handler)
+
+			err := h(tt.ctx, &event.Event{})
+			if !errors.Is(err, tt.want) {
+				t.Errorf("handler error = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
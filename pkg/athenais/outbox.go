@@ -0,0 +1,374 @@
+package athenais
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+	"github.com/unerror/athenais/internal/matrix"
+	"go.opentelemetry.io/otel/trace"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+	"maunium.net/go/mautrix/util/dbutil"
+)
+
+const (
+	// DefaultSendAttempts is the default number of times a message is sent
+	// before it is given up on
+	DefaultSendAttempts = 10
+
+	// minSendBackoff and maxSendBackoff bound the exponential backoff between
+	// send attempts, unless the homeserver asks for a longer wait
+	minSendBackoff = time.Second
+	maxSendBackoff = 5 * time.Minute
+)
+
+// ErrQueued is returned by sends that did not complete before their context
+// was done. The message stays queued and is sent later.
+var ErrQueued = errors.New("message queued for retry")
+
+// ErrNotRunning is returned by sends while the bot is not running, before
+// Run started it or after it shut down
+var ErrNotRunning = errors.New("bot is not running")
+
+type sendResult struct {
+	eventID id.EventID
+	err     error
+}
+
+// outboxItem is a queued outbound event
+type outboxItem struct {
+	id          int64
+	roomID      id.RoomID
+	eventType   event.Type
+	content     json.RawMessage
+	txnID       string
+	attempts    int
+	nextAttempt time.Time
+
+	// result receives the outcome of the send, if someone is waiting for it
+	result chan sendResult
+}
+
+// outbox sends events in order per room, retrying failed sends with
+// exponential backoff. Queued events are persisted in the database when there
+// is one, so they are sent after a restart.
+type outbox struct {
+	db          *dbutil.Database
+	mc          *matrix.Client
+	log         *zerolog.Logger
+	maxAttempts int
+
+	mu      sync.Mutex
+	ctx     context.Context
+	rooms   map[id.RoomID][]*outboxItem
+	working map[id.RoomID]bool
+	closed  bool
+	wg      sync.WaitGroup
+}
+
+func newOutbox(mc *matrix.Client, o *options) *outbox {
+	if o.sendAttempts < 1 {
+		o.sendAttempts = 1
+	}
+
+	return &outbox{
+		mc:          mc,
+		log:         o.log,
+		maxAttempts: o.sendAttempts,
+		rooms:       make(map[id.RoomID][]*outboxItem),
+		working:     make(map[id.RoomID]bool),
+	}
+}
+
+// load loads the events left queued by a previous run
+func (o *outbox) load(ctx context.Context) error {
+	if o.db == nil {
+		return nil
+	}
+
+	rows, err := o.db.QueryContext(ctx, "SELECT id, room_id, event_type, content, txn_id, attempts FROM athenais_outbox ORDER BY id")
+	if err != nil {
+		return errors.Wrap(err, "failed to load outbox")
+	}
+	defer rows.Close()
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	for rows.Next() {
+		var (
+			item      = &outboxItem{}
+			eventType string
+			content   string
+		)
+
+		if err := rows.Scan(&item.id, &item.roomID, &eventType, &content, &item.txnID, &item.attempts); err != nil {
+			return errors.Wrap(err, "failed to scan outbox event")
+		}
+
+		item.eventType = event.NewEventType(eventType)
+		item.content = json.RawMessage(content)
+		o.rooms[item.roomID] = append(o.rooms[item.roomID], item)
+	}
+
+	return rows.Err()
+}
+
+// start starts sending queued events with ctx
+func (o *outbox) start(ctx context.Context) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.ctx = ctx
+	for roomID := range o.rooms {
+		o.work(roomID)
+	}
+}
+
+// wait stops starting new senders and waits for the queues to empty. Events
+// that are still queued when ctx is cancelled are sent on the next start.
+func (o *outbox) wait() {
+	o.mu.Lock()
+	o.closed = true
+	o.mu.Unlock()
+
+	o.wg.Wait()
+}
+
+// enqueue queues an event, returning a channel receiving the outcome of its send
+func (o *outbox) enqueue(ctx context.Context, roomID id.RoomID, eventType event.Type, content interface{}) (<-chan sendResult, error) {
+	o.mu.Lock()
+	running := o.ctx != nil && !o.closed
+	o.mu.Unlock()
+	if !running {
+		return nil, ErrNotRunning
+	}
+
+	data, err := json.Marshal(content)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to marshal event")
+	}
+
+	item := &outboxItem{
+		roomID:    roomID,
+		eventType: eventType,
+		content:   data,
+		txnID:     o.mc.TxnID(),
+		result:    make(chan sendResult, 1),
+	}
+
+	if o.db != nil {
+		err := o.db.QueryRowContext(ctx, `
+INSERT INTO athenais_outbox (room_id, event_type, content, txn_id, attempts, created_at) VALUES ($1, $2, $3, $4, 0, $5)
+RETURNING id
+`, roomID, eventType.Type, string(data), item.txnID, time.Now().UnixMilli()).Scan(&item.id)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to queue event")
+		}
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.closed {
+		// shut down meanwhile; a persisted event is sent on the next start
+		if o.db != nil {
+			return nil, ErrQueued
+		}
+		return nil, ErrNotRunning
+	}
+
+	o.rooms[roomID] = append(o.rooms[roomID], item)
+	o.work(roomID)
+
+	return item.result, nil
+}
+
+// work starts the sender of a room if it isn't running. o.mu must be held.
+func (o *outbox) work(roomID id.RoomID) {
+	if o.ctx == nil || o.closed || o.working[roomID] {
+		return
+	}
+
+	o.working[roomID] = true
+	o.wg.Add(1)
+	go o.send(o.ctx, roomID)
+}
+
+// send sends the queued events of a room in order until the queue is empty
+func (o *outbox) send(ctx context.Context, roomID id.RoomID) {
+	defer o.wg.Done()
+
+	log := o.log.With().Stringer("room_id", roomID).Logger()
+
+	for {
+		o.mu.Lock()
+		queue := o.rooms[roomID]
+		if len(queue) == 0 || ctx.Err() != nil {
+			if len(queue) == 0 {
+				delete(o.rooms, roomID)
+			}
+			delete(o.working, roomID)
+			o.mu.Unlock()
+			return
+		}
+		item := queue[0]
+		o.mu.Unlock()
+
+		if wait := time.Until(item.nextAttempt); wait > 0 {
+			t := time.NewTimer(wait)
+			select {
+			case <-ctx.Done():
+				t.Stop()
+				continue
+			case <-t.C:
+			}
+		}
+
+		resp, err := o.mc.SendMessageEventTxn(ctx, roomID, item.eventType, item.content, item.txnID)
+		item.attempts++
+
+		if err != nil && ctx.Err() == nil {
+			if retryAfter, ok := retryable(err); ok && item.attempts < o.maxAttempts {
+				backoff := sendBackoff(item.attempts, retryAfter)
+				item.nextAttempt = time.Now().Add(backoff)
+
+				sendRetries.WithLabelValues(item.eventType.Type).Inc()
+				log.Warn().Err(err).
+					Int("attempts", item.attempts).
+					Dur("backoff", backoff).
+					Msg("Failed to send event, retrying")
+
+				o.saveAttempt(ctx, item)
+				continue
+			}
+
+			sendFailures.WithLabelValues(item.eventType.Type).Inc()
+			log.Error().Err(err).Int("attempts", item.attempts).Msg("Failed to send event, giving up")
+		} else if err != nil {
+			// shutting down, the event is sent on the next start
+			continue
+		} else {
+			messagesSent.WithLabelValues(item.eventType.Type).Inc()
+		}
+
+		o.remove(ctx, item)
+
+		if item.result != nil {
+			r := sendResult{err: err}
+			if resp != nil {
+				r.eventID = resp.EventID
+			}
+			item.result <- r
+		}
+	}
+}
+
+// saveAttempt persists the number of attempts of an item
+func (o *outbox) saveAttempt(ctx context.Context, item *outboxItem) {
+	if o.db == nil {
+		return
+	}
+
+	if _, err := o.db.ExecContext(ctx, "UPDATE athenais_outbox SET attempts = $1 WHERE id = $2", item.attempts, item.id); err != nil {
+		o.log.Error().Err(err).Msg("Failed to update queued event")
+	}
+}
+
+// remove removes the head of a room's queue once it is sent or given up on
+func (o *outbox) remove(ctx context.Context, item *outboxItem) {
+	o.mu.Lock()
+	queue := o.rooms[item.roomID]
+	if len(queue) > 0 && queue[0] == item {
+		o.rooms[item.roomID] = queue[1:]
+	}
+	o.mu.Unlock()
+
+	if o.db == nil {
+		return
+	}
+
+	if _, err := o.db.ExecContext(ctx, "DELETE FROM athenais_outbox WHERE id = $1", item.id); err != nil {
+		o.log.Error().Err(err).Msg("Failed to remove sent event from queue")
+	}
+}
+
+// retryable returns whether a send error is worth retrying, and how long the
+// homeserver asked to wait before retrying. Network errors, rate limits and
+// server errors are retried; errors that would fail the same way again, like
+// encryption and marshalling failures or client errors, are not.
+func retryable(err error) (time.Duration, bool) {
+	var herr mautrix.HTTPError
+	if !errors.As(err, &herr) {
+		// failed before reaching the homeserver, e.g. to encrypt the event
+		return 0, false
+	}
+
+	if herr.RespError != nil && herr.RespError.ErrCode == mautrix.MLimitExceeded.ErrCode {
+		if ms, ok := herr.RespError.ExtraData["retry_after_ms"].(float64); ok {
+			return time.Duration(ms) * time.Millisecond, true
+		}
+		return 0, true
+	}
+
+	if herr.Response == nil {
+		// network errors happen once there is a request, while building the
+		// request, e.g. marshalling the content, fails before there is one
+		return 0, herr.Request != nil
+	}
+
+	code := herr.Response.StatusCode
+	return 0, code == http.StatusTooManyRequests || code >= http.StatusInternalServerError
+}
+
+// sendBackoff returns the time to wait before the next attempt, doubling
+// with each attempt, but at least as long as the homeserver asked for
+func sendBackoff(attempts int, retryAfter time.Duration) time.Duration {
+	backoff := minSendBackoff << (attempts - 1)
+	if backoff > maxSendBackoff || backoff <= 0 {
+		backoff = maxSendBackoff
+	}
+
+	if retryAfter > backoff {
+		backoff = retryAfter
+	}
+
+	return backoff
+}
+
+// sendEvent queues an event and waits for it to be sent. If ctx is done
+// first, ErrQueued is returned and the event is sent later.
+func (b *Bot) sendEvent(ctx context.Context, roomID id.RoomID, eventType event.Type, content interface{}) (id.EventID, error) {
+	ctx, span := tracer().Start(ctx, "send event", trace.WithSpanKind(trace.SpanKindProducer), trace.WithAttributes(
+		AttrRoomID.String(roomID.String()),
+		AttrEventType.String(eventType.Type),
+	))
+	defer span.End()
+
+	if evtID, ok := EventIDFromContext(ctx); ok {
+		span.SetAttributes(AttrEventID.String(evtID.String()))
+	}
+
+	result, err := b.o.enqueue(ctx, roomID, eventType, content)
+	if err != nil {
+		recordError(span, err)
+		return "", err
+	}
+
+	select {
+	case r := <-result:
+		b.senders.put(r.eventID, b.ID())
+		recordError(span, r.err)
+		span.SetAttributes(AttrSentEventID.String(r.eventID.String()))
+		return r.eventID, r.err
+	case <-ctx.Done():
+		span.AddEvent("queued, sent later")
+		return "", ErrQueued
+	}
+}
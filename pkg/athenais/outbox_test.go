@@ -0,0 +1,339 @@
+package athenais
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+	"github.com/unerror/athenais/internal/db"
+	"github.com/unerror/athenais/internal/matrix"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+	"maunium.net/go/mautrix/util/dbutil"
+)
+
+// testDatabase opens a SQLite database with the bot's tables
+func testDatabase(t *testing.T) *dbutil.Database {
+	t.Helper()
+
+	conn, err := db.Open(filepath.Join(t.TempDir(), "athenais.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+
+	dbu, err := dbutil.NewWithDB(conn.DB, db.Driver)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	child := dbu.Child(VersionTableName, upgrades, dbutil.ZeroLogger(zerolog.Nop()))
+	if err := child.Upgrade(); err != nil {
+		t.Fatal(err)
+	}
+
+	return child
+}
+
+// homeserver records the events sent to it, per room
+type homeserver struct {
+	mu     sync.Mutex
+	bodies map[id.RoomID][]string
+	txnIDs []string
+	sent   chan struct{}
+}
+
+func newHomeserver(t *testing.T) (*homeserver, *matrix.Client) {
+	t.Helper()
+
+	hs := &homeserver{bodies: make(map[id.RoomID][]string), sent: make(chan struct{}, 1024)}
+	srv := httptest.NewServer(hs)
+	t.Cleanup(srv.Close)
+
+	mc, err := mautrix.NewClient(srv.URL, "@athena:example.org", "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return hs, &matrix.Client{Client: mc}
+}
+
+func (hs *homeserver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// /_matrix/client/v3/rooms/{roomID}/send/{eventType}/{txnID}
+	parts := strings.Split(r.URL.Path, "/")
+	if len(parts) != 9 || parts[6] != "send" {
+		http.NotFound(w, r)
+		return
+	}
+
+	var content event.MessageEventContent
+	if err := json.NewDecoder(r.Body).Decode(&content); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	hs.mu.Lock()
+	room := id.RoomID(parts[5])
+	hs.bodies[room] = append(hs.bodies[room], content.Body)
+	hs.txnIDs = append(hs.txnIDs, parts[8])
+	n := len(hs.txnIDs)
+	hs.mu.Unlock()
+
+	_ = json.NewEncoder(w).Encode(mautrix.RespSendEvent{EventID: id.EventID(fmt.Sprintf("$%d", n))})
+	hs.sent <- struct{}{}
+}
+
+// waitSent waits for n events to be sent
+func (hs *homeserver) waitSent(t *testing.T, n int) {
+	t.Helper()
+
+	for i := 0; i < n; i++ {
+		select {
+		case <-hs.sent:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%d of %d events sent", i, n)
+		}
+	}
+}
+
+// queuedMessage is a message queued for a room
+type queuedMessage struct {
+	room    id.RoomID
+	content *event.MessageEventContent
+}
+
+// queueMessages returns messages to the rooms, interleaving the rooms, and
+// the bodies each room must receive in order
+func queueMessages(rooms, perRoom int) (msgs []queuedMessage, want map[id.RoomID][]string) {
+	want = make(map[id.RoomID][]string)
+	for i := 0; i < perRoom; i++ {
+		for r := 0; r < rooms; r++ {
+			room := id.RoomID(fmt.Sprintf("!%d:example.org", r))
+			body := fmt.Sprintf("message %d", i)
+			msgs = append(msgs, queuedMessage{room: room, content: &event.MessageEventContent{MsgType: event.MsgText, Body: body}})
+			want[room] = append(want[room], body)
+		}
+	}
+
+	return msgs, want
+}
+
+func TestSendBackoff(t *testing.T) {
+	tests := []struct {
+		attempts   int
+		retryAfter time.Duration
+		want       time.Duration
+	}{
+		{attempts: 1, want: minSendBackoff},
+		{attempts: 2, want: 2 * minSendBackoff},
+		{attempts: 4, want: 8 * minSendBackoff},
+		{attempts: 10, want: maxSendBackoff},
+		{attempts: 100, want: maxSendBackoff},
+		{attempts: 1, retryAfter: 30 * time.Second, want: 30 * time.Second},
+		{attempts: 4, retryAfter: 500 * time.Millisecond, want: 8 * minSendBackoff},
+		{attempts: 10, retryAfter: time.Hour, want: time.Hour},
+	}
+
+	for _, tt := range tests {
+		if got := sendBackoff(tt.attempts, tt.retryAfter); got != tt.want {
+			t.Errorf("sendBackoff(%d, %s) = %s, want %s", tt.attempts, tt.retryAfter, got, tt.want)
+		}
+	}
+}
+
+func TestRetryable(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPut, "/", nil)
+	status := func(code int) *http.Response {
+		return &http.Response{StatusCode: code}
+	}
+
+	tests := []struct {
+		name           string
+		err            error
+		wantRetryAfter time.Duration
+		wantOK         bool
+	}{
+		{
+			name:   "network error",
+			err:    mautrix.HTTPError{Request: req, WrappedError: errors.New("connection refused")},
+			wantOK: true,
+		},
+		{
+			name:   "request not built",
+			err:    mautrix.HTTPError{WrappedError: errors.New("failed to marshal JSON")},
+			wantOK: false,
+		},
+		{
+			name:   "not an HTTP error",
+			err:    errors.New("failed to encrypt event"),
+			wantOK: false,
+		},
+		{
+			name: "rate limited with retry_after_ms",
+			err: mautrix.HTTPError{Request: req, Response: status(http.StatusTooManyRequests), RespError: &mautrix.RespError{
+				ErrCode:   mautrix.MLimitExceeded.ErrCode,
+				ExtraData: map[string]interface{}{"retry_after_ms": float64(2500)},
+			}},
+			wantRetryAfter: 2500 * time.Millisecond,
+			wantOK:         true,
+		},
+		{
+			name: "rate limited",
+			err: mautrix.HTTPError{Request: req, Response: status(http.StatusTooManyRequests), RespError: &mautrix.RespError{
+				ErrCode: mautrix.MLimitExceeded.ErrCode,
+			}},
+			wantOK: true,
+		},
+		{
+			name:   "wrapped rate limit",
+			err:    errors.Wrap(mautrix.HTTPError{Request: req, Response: status(http.StatusTooManyRequests)}, "failed to send"),
+			wantOK: true,
+		},
+		{
+			name:   "server error",
+			err:    mautrix.HTTPError{Request: req, Response: status(http.StatusBadGateway)},
+			wantOK: true,
+		},
+		{
+			name: "forbidden",
+			err: mautrix.HTTPError{Request: req, Response: status(http.StatusForbidden), RespError: &mautrix.RespError{
+				ErrCode: mautrix.MForbidden.ErrCode,
+			}},
+			wantOK: false,
+		},
+		{
+			name:   "bad request",
+			err:    mautrix.HTTPError{Request: req, Response: status(http.StatusBadRequest)},
+			wantOK: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			retryAfter, ok := retryable(tt.err)
+			if retryAfter != tt.wantRetryAfter || ok != tt.wantOK {
+				t.Errorf("retryable = %s, %v, want %s, %v", retryAfter, ok, tt.wantRetryAfter, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestOutboxRoomOrder(t *testing.T) {
+	tests := []struct {
+		name     string
+		database bool
+	}{
+		{name: "in memory"},
+		{name: "persisted", database: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hs, mc := newHomeserver(t)
+			log := zerolog.Nop()
+
+			o := newOutbox(mc, &options{log: &log, sendAttempts: 1})
+			if tt.database {
+				o.db = testDatabase(t)
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			o.start(ctx)
+
+			msgs, want := queueMessages(3, 20)
+			var results []<-chan sendResult
+			for _, msg := range msgs {
+				result, err := o.enqueue(ctx, msg.room, event.EventMessage, msg.content)
+				if err != nil {
+					t.Fatalf("enqueue: %v", err)
+				}
+				results = append(results, result)
+			}
+
+			for _, result := range results {
+				if r := <-result; r.err != nil || r.eventID == "" {
+					t.Errorf("send result = %+v, want an event ID", r)
+				}
+			}
+			o.wait()
+
+			if !reflect.DeepEqual(hs.bodies, want) {
+				t.Errorf("sent out of order per room:\ngot  %v\nwant %v", hs.bodies, want)
+			}
+		})
+	}
+}
+
+func TestOutboxRestart(t *testing.T) {
+	hs, mc := newHomeserver(t)
+	database := testDatabase(t)
+	log := zerolog.Nop()
+
+	// the first run shuts down before sending anything
+	stopped, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	first := newOutbox(mc, &options{log: &log, sendAttempts: 1})
+	first.db = database
+	first.start(stopped)
+
+	msgs, want := queueMessages(2, 10)
+	for _, msg := range msgs {
+		if _, err := first.enqueue(context.Background(), msg.room, event.EventMessage, msg.content); err != nil {
+			t.Fatalf("enqueue: %v", err)
+		}
+	}
+	first.wait()
+
+	var txnIDs []string
+	for _, queue := range first.rooms {
+		for _, item := range queue {
+			txnIDs = append(txnIDs, item.txnID)
+		}
+	}
+
+	second := newOutbox(mc, &options{log: &log, sendAttempts: 1})
+	second.db = database
+	if err := second.load(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancelSecond := context.WithCancel(context.Background())
+	defer cancelSecond()
+	second.start(ctx)
+	hs.waitSent(t, len(msgs))
+	second.wait()
+
+	if !reflect.DeepEqual(hs.bodies, want) {
+		t.Errorf("sent out of order per room after restart:\ngot  %v\nwant %v", hs.bodies, want)
+	}
+
+	// retries after a restart keep the transaction IDs, so the homeserver
+	// deduplicates events that were sent before the restart
+	sort.Strings(hs.txnIDs)
+	sort.Strings(txnIDs)
+	if !reflect.DeepEqual(hs.txnIDs, txnIDs) {
+		t.Errorf("sent transaction IDs %v, want %v", hs.txnIDs, txnIDs)
+	}
+
+	var left int
+	if err := database.QueryRow("SELECT COUNT(*) FROM athenais_outbox").Scan(&left); err != nil {
+		t.Fatal(err)
+	}
+	if left != 0 {
+		t.Errorf("%d events left queued, want none", left)
+	}
+}
@@ -0,0 +1,130 @@
+package athenais
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// PermissionManagePlugins is the named permission to enable, disable and
+// configure plugins in a room
+const PermissionManagePlugins = "plugins.manage"
+
+// Permission is what a sender needs to trigger a route or command. All
+// requirements that are set must be met; bot admins meet all of them.
+type Permission struct {
+	// PowerLevel is the minimum power level of the sender in the room. Zero
+	// requires nothing.
+	PowerLevel int
+
+	// Name is a named permission. Its power level is set with
+	// WithPermissionLevels, and defaults to the level needed to send state
+	// events in the room, i.e. moderators.
+	Name string
+
+	// Admin requires the sender to be a bot admin
+	Admin bool
+}
+
+// required returns whether the permission requires anything
+func (p Permission) required() bool {
+	return p.PowerLevel != 0 || p.Name != "" || p.Admin
+}
+
+func (p Permission) String() string {
+	var reqs []string
+	if p.Admin {
+		reqs = append(reqs, "bot admin rights")
+	}
+	if p.Name != "" {
+		reqs = append(reqs, "the "+p.Name+" permission")
+	}
+	if p.PowerLevel != 0 {
+		reqs = append(reqs, fmt.Sprintf("power level %d", p.PowerLevel))
+	}
+
+	return strings.Join(reqs, " and ")
+}
+
+// IsAdmin returns whether the user is a bot admin
+func (b *Bot) IsAdmin(userID id.UserID) bool {
+	_, ok := b.admins[userID]
+	return ok
+}
+
+// HasPermission returns whether the user has the permission in the room
+func (b *Bot) HasPermission(roomID id.RoomID, userID id.UserID, p Permission) bool {
+	if !p.required() || b.IsAdmin(userID) {
+		return true
+	}
+
+	if p.Admin {
+		return false
+	}
+
+	pl := b.powerLevels(roomID)
+	if pl == nil {
+		return false
+	}
+
+	level := pl.GetUserLevel(userID)
+	if p.PowerLevel != 0 && level < p.PowerLevel {
+		return false
+	}
+
+	if p.Name != "" {
+		required, ok := b.permissionLevels[p.Name]
+		if !ok {
+			required = pl.StateDefault()
+		}
+
+		if level < required {
+			return false
+		}
+	}
+
+	return true
+}
+
+// powerLevels returns the power levels of a room from the state store,
+// fetching them from the homeserver if they are not stored yet
+func (b *Bot) powerLevels(roomID id.RoomID) *event.PowerLevelsEventContent {
+	if pl := b.mc.StateStore.GetPowerLevels(roomID); pl != nil {
+		return pl
+	}
+
+	pl := &event.PowerLevelsEventContent{}
+	if err := b.mc.StateEvent(roomID, event.StatePowerLevels, "", pl); err != nil {
+		b.log.Error().Err(err).Stringer("room_id", roomID).Msg("Failed to get power levels")
+		return nil
+	}
+
+	return pl
+}
+
+// checkPermission returns whether the sender of a command has the permission.
+// Denials are logged and the sender is told politely, as they explicitly
+// invoked the command.
+func (b *Bot) checkPermission(ctx context.Context, evt *event.Event, plugin, command string, p Permission) bool {
+	if b.HasPermission(evt.RoomID, evt.Sender, p) {
+		return true
+	}
+
+	b.log.Info().
+		Str("plugin", plugin).
+		Str("command", command).
+		Stringer("room_id", evt.RoomID).
+		Stringer("sender", evt.Sender).
+		Stringer("permission", p).
+		Msg("Permission denied")
+
+	text := fmt.Sprintf("Sorry, you need %s to do that.", p)
+	if err := b.sendNotice(ctx, evt.RoomID, text); err != nil {
+		b.log.Error().Err(err).Msg("Failed to send permission notice")
+	}
+
+	return false
+}
@@ -1,10 +1,22 @@
 package athenais
 
 import (
+	"context"
+	"sort"
+	"sync"
+
+	"github.com/pkg/errors"
 	"github.com/rs/zerolog"
 )
 
-var plugins map[string]Plugin
+var (
+	// factories are the registered plugin factories, keyed by plugin name
+	factories   = make(map[string]Factory)
+	factoriesMu sync.RWMutex
+)
+
+// Factory creates a new instance of a plugin
+type Factory func() Plugin
 
 type Plugin interface {
 	// Name returns the name of the plugin
@@ -14,11 +26,102 @@ type Plugin interface {
 	Init(*Bot, *zerolog.Logger)
 }
 
-func Register(plug Plugin) {
-	name := plug.Name()
-	if _, ok := plugins[name]; ok {
+// Configurable is implemented by plugins that take configuration. Config
+// returns a pointer to the plugin's configuration struct, filled with its
+// defaults. Config.ConfigurePlugins decodes the plugin's section of the config
+// file into it before Init is called.
+type Configurable interface {
+	Config() any
+}
+
+// Reloader is implemented by Configurable plugins that can apply a new
+// configuration while running. cfg is a new configuration of the type Config
+// returns, decoded and validated.
+type Reloader interface {
+	Reload(ctx context.Context, cfg any) error
+}
+
+// Starter is implemented by plugins that run background work. Start is called
+// in registration order when the bot starts running; ctx is cancelled once the
+// bot has stopped handling events.
+type Starter interface {
+	Start(ctx context.Context) error
+}
+
+// Stopper is implemented by plugins that need to flush state on shutdown. Stop
+// is called in reverse registration order after in-flight handlers drained.
+type Stopper interface {
+	Stop(ctx context.Context) error
+}
+
+// HealthChecker is implemented by plugins that can report their health
+type HealthChecker interface {
+	// Health returns nil if the plugin is healthy
+	Health() error
+}
+
+// Register registers a plugin factory under the plugin's name, so the plugin
+// can be enabled by name. It is meant to be called from the init function of
+// the plugin's package, and panics if the name is already registered.
+func Register(name string, factory Factory) {
+	factoriesMu.Lock()
+	defer factoriesMu.Unlock()
+
+	if _, ok := factories[name]; ok {
 		panic("plugin already registered: " + name)
 	}
 
-	plugins[name] = plug
+	factories[name] = factory
+}
+
+// Registered returns the names of the registered plugins, sorted
+func Registered() []string {
+	factoriesMu.RLock()
+	defer factoriesMu.RUnlock()
+
+	names := make([]string, 0, len(factories))
+	for name := range factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// newPlugin creates an instance of the named plugin, or nil if it isn't
+// registered
+func newPlugin(name string) Plugin {
+	factoriesMu.RLock()
+	defer factoriesMu.RUnlock()
+
+	factory, ok := factories[name]
+	if !ok {
+		return nil
+	}
+
+	return factory()
+}
+
+// NewPlugins creates instances of the named plugins, in the given order
+func NewPlugins(names ...string) ([]Plugin, error) {
+	factoriesMu.RLock()
+	defer factoriesMu.RUnlock()
+
+	plugs := make([]Plugin, 0, len(names))
+	seen := make(map[string]struct{}, len(names))
+	for _, name := range names {
+		if _, ok := seen[name]; ok {
+			return nil, errors.Errorf("plugin enabled twice: %s", name)
+		}
+		seen[name] = struct{}{}
+
+		factory, ok := factories[name]
+		if !ok {
+			return nil, errors.Errorf("unknown plugin: %s", name)
+		}
+
+		plugs = append(plugs, factory())
+	}
+
+	return plugs, nil
 }
@@ -0,0 +1,284 @@
+package athenais
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+	"maunium.net/go/mautrix/util/dbutil"
+)
+
+// PluginPolicy is the policy of a plugin in a room
+type PluginPolicy struct {
+	// Enabled is whether the plugin handles events in the room
+	Enabled bool
+
+	// Settings are the plugin's settings for the room
+	Settings map[string]string
+}
+
+// policyStore stores the per-room plugin policies. Policies are cached per
+// room; without a database they only live in memory.
+type policyStore struct {
+	db *dbutil.Database
+
+	mu    sync.RWMutex
+	rooms map[id.RoomID]map[string]*PluginPolicy
+}
+
+func newPolicyStore() *policyStore {
+	return &policyStore{
+		rooms: make(map[id.RoomID]map[string]*PluginPolicy),
+	}
+}
+
+// room returns the policies of a room, loading them from the database on
+// first use
+func (s *policyStore) room(ctx context.Context, roomID id.RoomID) (map[string]*PluginPolicy, error) {
+	s.mu.RLock()
+	policies, ok := s.rooms[roomID]
+	s.mu.RUnlock()
+	if ok {
+		return policies, nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if policies, ok := s.rooms[roomID]; ok {
+		return policies, nil
+	}
+
+	policies = make(map[string]*PluginPolicy)
+	if s.db != nil {
+		rows, err := s.db.QueryContext(ctx, "SELECT plugin, enabled, settings FROM athenais_room_plugins WHERE room_id = $1", roomID)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to load room plugin policies")
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var (
+				plugin   string
+				settings string
+				p        = &PluginPolicy{}
+			)
+
+			if err := rows.Scan(&plugin, &p.Enabled, &settings); err != nil {
+				return nil, errors.Wrap(err, "failed to scan room plugin policy")
+			}
+
+			if err := json.Unmarshal([]byte(settings), &p.Settings); err != nil {
+				return nil, errors.Wrapf(err, "invalid settings for plugin %s", plugin)
+			}
+
+			policies[plugin] = p
+		}
+
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	s.rooms[roomID] = policies
+	return policies, nil
+}
+
+// get returns the policy of a plugin in a room. Plugins are enabled unless
+// disabled in the room.
+func (s *policyStore) get(ctx context.Context, roomID id.RoomID, plugin string) (PluginPolicy, error) {
+	policies, err := s.room(ctx, roomID)
+	if err != nil {
+		return PluginPolicy{Enabled: true}, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	p, ok := policies[plugin]
+	if !ok {
+		return PluginPolicy{Enabled: true}, nil
+	}
+
+	settings := make(map[string]string, len(p.Settings))
+	for k, v := range p.Settings {
+		settings[k] = v
+	}
+
+	return PluginPolicy{Enabled: p.Enabled, Settings: settings}, nil
+}
+
+// update applies fn to the policy of a plugin in a room and persists it
+func (s *policyStore) update(ctx context.Context, roomID id.RoomID, plugin string, fn func(*PluginPolicy)) error {
+	policies, err := s.room(ctx, roomID)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p, ok := policies[plugin]
+	if !ok {
+		p = &PluginPolicy{Enabled: true}
+	}
+
+	updated := &PluginPolicy{Enabled: p.Enabled, Settings: make(map[string]string, len(p.Settings))}
+	for k, v := range p.Settings {
+		updated.Settings[k] = v
+	}
+	fn(updated)
+
+	if s.db != nil {
+		settings, err := json.Marshal(updated.Settings)
+		if err != nil {
+			return err
+		}
+
+		_, err = s.db.ExecContext(ctx, `
+INSERT INTO athenais_room_plugins (room_id, plugin, enabled, settings) VALUES ($1, $2, $3, $4)
+ON CONFLICT (room_id, plugin) DO UPDATE SET enabled = excluded.enabled, settings = excluded.settings
+`, roomID, plugin, updated.Enabled, string(settings))
+		if err != nil {
+			return errors.Wrap(err, "failed to save room plugin policy")
+		}
+	}
+
+	policies[plugin] = updated
+	return nil
+}
+
+// PluginEnabled returns whether the plugin handles events in the room
+func (b *Bot) PluginEnabled(ctx context.Context, roomID id.RoomID, plugin string) bool {
+	p, err := b.policies.get(ctx, roomID, plugin)
+	if err != nil {
+		b.log.Error().Err(err).Stringer("room_id", roomID).Msg("Failed to load room plugin policy")
+	}
+
+	return p.Enabled
+}
+
+// RoomSetting returns a setting of the plugin for the room, as set by room
+// moderators with the plugin command
+func (b *Bot) RoomSetting(ctx context.Context, roomID id.RoomID, plugin, key string) (string, bool) {
+	p, err := b.policies.get(ctx, roomID, plugin)
+	if err != nil {
+		b.log.Error().Err(err).Stringer("room_id", roomID).Msg("Failed to load room plugin policy")
+	}
+
+	v, ok := p.Settings[key]
+	return v, ok
+}
+
+// allowRoute is the Router filter enforcing the room plugin policies and
+// route permissions. Routes of the bot itself are always enabled. Routes the
+// sender lacks the permission for are skipped silently.
+func (b *Bot) allowRoute(ctx context.Context, evt *event.Event, route *Route) bool {
+	if route.Plugin != "" && !b.PluginEnabled(ctx, evt.RoomID, route.Plugin) {
+		return false
+	}
+
+	if b.HasPermission(evt.RoomID, evt.Sender, route.Permission) {
+		return true
+	}
+
+	// routes can match any message, so denials are not announced in the room
+	b.log.Debug().
+		Str("plugin", route.Plugin).
+		Str("route", route.Name).
+		Stringer("room_id", evt.RoomID).
+		Stringer("sender", evt.Sender).
+		Stringer("permission", route.Permission).
+		Msg("Permission denied")
+
+	return false
+}
+
+func (b *Bot) handlePlugins(ctx context.Context, cc *CommandContext) error {
+	roomID := cc.Event.RoomID
+
+	var sb strings.Builder
+	sb.WriteString("Plugins in this room:")
+	for _, plug := range b.plugins {
+		p, err := b.policies.get(ctx, roomID, plug.Name())
+		if err != nil {
+			return err
+		}
+
+		state := "enabled"
+		if !p.Enabled {
+			state = "disabled"
+		}
+		fmt.Fprintf(&sb, "\n%s: %s", plug.Name(), state)
+
+		keys := make([]string, 0, len(p.Settings))
+		for k := range p.Settings {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			fmt.Fprintf(&sb, "\n  %s = %s", k, p.Settings[k])
+		}
+	}
+
+	return b.sendNotice(ctx, roomID, sb.String())
+}
+
+func (b *Bot) handlePlugin(ctx context.Context, cc *CommandContext) error {
+	roomID := cc.Event.RoomID
+
+	name := cc.String("plugin")
+	known := false
+	for _, plug := range b.plugins {
+		known = known || plug.Name() == name
+	}
+	if !known {
+		return b.sendNotice(ctx, roomID, "Unknown plugin: "+name)
+	}
+
+	var (
+		fn    func(*PluginPolicy)
+		reply string
+	)
+
+	key, value := cc.String("key"), cc.String("value")
+	switch action := cc.String("action"); action {
+	case "enable", "disable":
+		enabled := action == "enable"
+		fn = func(p *PluginPolicy) { p.Enabled = enabled }
+		reply = fmt.Sprintf("Plugin %s %sd in this room.", name, action)
+	case "set":
+		if key == "" || value == "" {
+			return b.sendNotice(ctx, roomID, "usage: "+cc.Command.Prefix+"plugin set <plugin> <key> <value>")
+		}
+		fn = func(p *PluginPolicy) { p.Settings[key] = value }
+		reply = fmt.Sprintf("Set %s %s to %s in this room.", name, key, value)
+	case "unset":
+		if key == "" {
+			return b.sendNotice(ctx, roomID, "usage: "+cc.Command.Prefix+"plugin unset <plugin> <key>")
+		}
+		fn = func(p *PluginPolicy) { delete(p.Settings, key) }
+		reply = fmt.Sprintf("Unset %s %s in this room.", name, key)
+	default:
+		return b.sendNotice(ctx, roomID, "Unknown action: "+action+". Use enable, disable, set or unset.")
+	}
+
+	if err := b.policies.update(ctx, roomID, name, fn); err != nil {
+		return err
+	}
+
+	b.log.Info().
+		Str("plugin", name).
+		Stringer("room_id", roomID).
+		Stringer("sender", cc.Event.Sender).
+		Str("action", cc.String("action")).
+		Msg("Updated room plugin policy")
+
+	return b.sendNotice(ctx, roomID, reply)
+}
@@ -0,0 +1,326 @@
+package athenais
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"maunium.net/go/mautrix/event"
+)
+
+// DefaultRateLimitReaction is the reaction LimitReact adds to limited events
+const DefaultRateLimitReaction = "🐢"
+
+// maxBuckets is the number of buckets a limiter keeps before it forgets the
+// ones that are full again
+const maxBuckets = 10000
+
+// RateLimit is a token bucket allowing Burst events, refilled evenly over Per.
+// The zero value is unlimited.
+type RateLimit struct {
+	Burst int
+	Per   time.Duration
+}
+
+// ParseRateLimit parses a rate limit like "10/1m", allowing bursts of 10
+// events and refilling at 10 per minute. An empty string is unlimited.
+func ParseRateLimit(s string) (RateLimit, error) {
+	if s == "" {
+		return RateLimit{}, nil
+	}
+
+	burst, per, ok := strings.Cut(s, "/")
+	if !ok {
+		return RateLimit{}, errors.Errorf("invalid rate limit %q, expected count/duration", s)
+	}
+
+	n, err := strconv.Atoi(burst)
+	if err != nil || n < 1 {
+		return RateLimit{}, errors.Errorf("invalid rate limit %q, count must be a positive number", s)
+	}
+
+	d, err := time.ParseDuration(per)
+	if err != nil || d <= 0 {
+		return RateLimit{}, errors.Errorf("invalid rate limit %q, duration must be positive", s)
+	}
+
+	return RateLimit{Burst: n, Per: d}, nil
+}
+
+func (l RateLimit) unlimited() bool {
+	return l.Burst <= 0 || l.Per <= 0
+}
+
+// RateLimitAction decides what happens to events over a rate limit. Limited
+// events are never responded to.
+type RateLimitAction int
+
+const (
+	// LimitDrop silently drops limited events
+	LimitDrop RateLimitAction = iota
+
+	// LimitReact reacts to limited events with an emoji
+	LimitReact
+
+	// LimitNotice sends a notice the first time events are limited, until the
+	// limit allows events again
+	LimitNotice
+)
+
+// ParseRateLimitAction parses a rate limit action name: drop, react or notice
+func ParseRateLimitAction(s string) (RateLimitAction, error) {
+	switch strings.ToLower(s) {
+	case "", "drop":
+		return LimitDrop, nil
+	case "react":
+		return LimitReact, nil
+	case "notice":
+		return LimitNotice, nil
+	default:
+		return LimitDrop, errors.Errorf("unknown rate limit action: %s", s)
+	}
+}
+
+// RateLimits are the rate limits of message events sent to the bot. Bot
+// admins are not limited.
+type RateLimits struct {
+	// User limits each user across all rooms
+	User RateLimit
+
+	// Room limits each room
+	Room RateLimit
+
+	// Global limits all events together
+	Global RateLimit
+
+	// Action is what happens to limited events
+	Action RateLimitAction
+
+	// Reaction is the emoji LimitReact reacts with. Defaults to
+	// DefaultRateLimitReaction.
+	Reaction string
+}
+
+type bucket struct {
+	tokens  float64
+	last    time.Time
+	limited bool
+}
+
+// limiter is a set of token buckets sharing a rate limit
+type limiter struct {
+	limit RateLimit
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+}
+
+func newLimiter(limit RateLimit) *limiter {
+	return &limiter{
+		limit:   limit,
+		buckets: make(map[string]*bucket),
+	}
+}
+
+// lock locks the limiter, if it limits anything
+func (l *limiter) lock() {
+	if l != nil {
+		l.mu.Lock()
+	}
+}
+
+// unlock unlocks the limiter, if it limits anything
+func (l *limiter) unlock() {
+	if l != nil {
+		l.mu.Unlock()
+	}
+}
+
+// check returns whether the bucket of key has a token, without taking it.
+// first is true when the event is the first limited one since the bucket last
+// allowed an event. The limiter must be locked.
+func (l *limiter) check(key string, now time.Time) (ok, first bool) {
+	if l == nil {
+		return true, false
+	}
+
+	b := l.bucket(key, now)
+	if b.tokens < 1 {
+		first = !b.limited
+		b.limited = true
+		return false, first
+	}
+
+	return true, false
+}
+
+// take takes a token from the bucket of key, which check allowed. The limiter
+// must be locked.
+func (l *limiter) take(key string) {
+	if l == nil {
+		return
+	}
+
+	b := l.buckets[key]
+	b.tokens--
+	b.limited = false
+}
+
+// bucket returns the bucket of key, refilled up to now
+func (l *limiter) bucket(key string, now time.Time) *bucket {
+	burst := float64(l.limit.Burst)
+	rate := burst / l.limit.Per.Seconds()
+
+	b, found := l.buckets[key]
+	if !found {
+		if len(l.buckets) >= maxBuckets {
+			l.sweep(now, rate)
+		}
+
+		b = &bucket{tokens: burst, last: now}
+		l.buckets[key] = b
+	}
+
+	b.tokens += now.Sub(b.last).Seconds() * rate
+	if b.tokens > burst {
+		b.tokens = burst
+	}
+	b.last = now
+
+	return b
+}
+
+// sweep forgets the buckets that have refilled, as they are the same as new ones
+func (l *limiter) sweep(now time.Time, rate float64) {
+	burst := float64(l.limit.Burst)
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*rate >= burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// rateLimiter enforces RateLimits on the events the bot handles
+type rateLimiter struct {
+	user, room, global *limiter
+
+	action   RateLimitAction
+	reaction string
+
+	limited atomic.Uint64
+}
+
+func newRateLimiter(limits RateLimits) *rateLimiter {
+	rl := &rateLimiter{
+		action:   limits.Action,
+		reaction: limits.Reaction,
+	}
+
+	if rl.reaction == "" {
+		rl.reaction = DefaultRateLimitReaction
+	}
+
+	if !limits.User.unlimited() {
+		rl.user = newLimiter(limits.User)
+	}
+	if !limits.Room.unlimited() {
+		rl.room = newLimiter(limits.Room)
+	}
+	if !limits.Global.unlimited() {
+		rl.global = newLimiter(limits.Global)
+	}
+
+	return rl
+}
+
+// allow checks the event against the user, room and global limits, in that
+// order, and only takes a token from each if all of them allow the event. It
+// returns the scope that limited the event and whether it is the first
+// limited event in that scope.
+func (rl *rateLimiter) allow(evt *event.Event, now time.Time) (scope string, first bool) {
+	scopes := []struct {
+		name string
+		l    *limiter
+		key  string
+	}{
+		{"user", rl.user, evt.Sender.String()},
+		{"room", rl.room, evt.RoomID.String()},
+		{"global", rl.global, ""},
+	}
+
+	// always locked in the same order, so concurrent events can't deadlock
+	for _, s := range scopes {
+		s.l.lock()
+		defer s.l.unlock()
+	}
+
+	for _, s := range scopes {
+		if ok, first := s.l.check(s.key, now); !ok {
+			return s.name, first
+		}
+	}
+
+	for _, s := range scopes {
+		s.l.take(s.key)
+	}
+
+	return "", false
+}
+
+// AllowResponse reports whether the bot may respond to evt within the rate
+// limits, taking a token if it may. Routes call it once they decide to
+// respond, limited events get the rate limit action.
+func (b *Bot) AllowResponse(ctx context.Context, evt *event.Event) bool {
+	if evt.Type.Class != event.MessageEventType || b.IsAdmin(evt.Sender) {
+		return true
+	}
+
+	scope, first := b.rl.allow(evt, time.Now())
+	if scope == "" {
+		return true
+	}
+
+	b.rl.limited.Add(1)
+
+	log := b.log.With().
+		Str("scope", scope).
+		Stringer("event_id", evt.ID).
+		Stringer("room_id", evt.RoomID).
+		Stringer("sender", evt.Sender).
+		Logger()
+	log.Debug().Msg("Rate limited event")
+
+	var err error
+	switch b.rl.action {
+	case LimitReact:
+		// only messages are reacted to, reacting to reactions or redactions
+		// would answer spam with more events
+		if evt.Type != event.EventMessage {
+			break
+		}
+		_, err = b.React(ctx, evt.RoomID, evt.ID, b.rl.reaction)
+	case LimitNotice:
+		if !first {
+			break
+		}
+
+		text := "Slow down! I'm ignoring your messages for a little while."
+		switch scope {
+		case "room":
+			text = "This room is busy, I'm ignoring messages here for a little while."
+		case "global":
+			text = "I'm busy, I'm ignoring messages for a little while."
+		}
+		err = b.sendNotice(ctx, evt.RoomID, text)
+	}
+
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to report rate limit")
+	}
+
+	return false
+}
@@ -0,0 +1,256 @@
+package athenais
+
+import (
+	"testing"
+	"time"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestParseRateLimit(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    RateLimit
+		wantErr bool
+	}{
+		{input: "", want: RateLimit{}},
+		{input: "10/1m", want: RateLimit{Burst: 10, Per: time.Minute}},
+		{input: "1/500ms", want: RateLimit{Burst: 1, Per: 500 * time.Millisecond}},
+		{input: "10", wantErr: true},
+		{input: "0/1m", wantErr: true},
+		{input: "x/1m", wantErr: true},
+		{input: "10/0s", wantErr: true},
+		{input: "10/minute", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseRateLimit(tt.input)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseRateLimit(%q) error = %v, want error %v", tt.input, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseRateLimit(%q) = %+v, want %+v", tt.input, got, tt.want)
+		}
+	}
+}
+
+func TestLimiter(t *testing.T) {
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	type step struct {
+		after     time.Duration
+		key       string
+		wantOK    bool
+		wantFirst bool
+	}
+
+	tests := []struct {
+		name  string
+		limit RateLimit
+		steps []step
+	}{
+		{
+			name:  "burst then limited",
+			limit: RateLimit{Burst: 2, Per: time.Minute},
+			steps: []step{
+				{key: "a", wantOK: true},
+				{key: "a", wantOK: true},
+				{key: "a", wantOK: false, wantFirst: true},
+				{key: "a", wantOK: false},
+			},
+		},
+		{
+			name:  "keys have their own buckets",
+			limit: RateLimit{Burst: 1, Per: time.Minute},
+			steps: []step{
+				{key: "a", wantOK: true},
+				{key: "b", wantOK: true},
+				{key: "a", wantOK: false, wantFirst: true},
+			},
+		},
+		{
+			name:  "refills evenly",
+			limit: RateLimit{Burst: 2, Per: time.Minute},
+			steps: []step{
+				{key: "a", wantOK: true},
+				{key: "a", wantOK: true},
+				{after: 20 * time.Second, key: "a", wantOK: false, wantFirst: true},
+				{after: 30 * time.Second, key: "a", wantOK: true},
+				{after: 5 * time.Second, key: "a", wantOK: false, wantFirst: true},
+			},
+		},
+		{
+			name:  "refills up to the burst",
+			limit: RateLimit{Burst: 2, Per: time.Minute},
+			steps: []step{
+				{key: "a", wantOK: true},
+				{after: time.Hour, key: "a", wantOK: true},
+				{key: "a", wantOK: true},
+				{key: "a", wantOK: false, wantFirst: true},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newLimiter(tt.limit)
+			now := start
+
+			for i, s := range tt.steps {
+				now = now.Add(s.after)
+
+				l.lock()
+				ok, first := l.check(s.key, now)
+				if ok {
+					l.take(s.key)
+				}
+				l.unlock()
+
+				if ok != s.wantOK || first != s.wantFirst {
+					t.Errorf("step %d: check(%s) = %v, %v, want %v, %v", i, s.key, ok, first, s.wantOK, s.wantFirst)
+				}
+			}
+		})
+	}
+}
+
+func TestLimiterNil(t *testing.T) {
+	var l *limiter
+
+	l.lock()
+	defer l.unlock()
+
+	if ok, first := l.check("a", time.Now()); !ok || first {
+		t.Errorf("nil limiter check = %v, %v, want true, false", ok, first)
+	}
+	l.take("a")
+}
+
+func TestLimiterSweep(t *testing.T) {
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	l := newLimiter(RateLimit{Burst: 1, Per: time.Second})
+
+	for i := 0; i < maxBuckets; i++ {
+		key := string(rune('a'+i%26)) + string(rune(i))
+		if ok, _ := l.check(key, start); ok {
+			l.take(key)
+		}
+	}
+
+	if ok, _ := l.check("new", start.Add(time.Minute)); !ok {
+		t.Fatal("new key was limited")
+	}
+	if len(l.buckets) != 1 {
+		t.Errorf("%d buckets after sweeping refilled ones, want 1", len(l.buckets))
+	}
+}
+
+func TestRateLimiterAllow(t *testing.T) {
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	evt := func(sender id.UserID, room id.RoomID) *event.Event {
+		return &event.Event{Type: event.EventMessage, Sender: sender, RoomID: room}
+	}
+
+	type step struct {
+		evt       *event.Event
+		wantScope string
+		wantFirst bool
+	}
+
+	tests := []struct {
+		name   string
+		limits RateLimits
+		steps  []step
+	}{
+		{
+			name:   "unlimited",
+			limits: RateLimits{},
+			steps: []step{
+				{evt: evt("@a:x", "!r:x")},
+				{evt: evt("@a:x", "!r:x")},
+			},
+		},
+		{
+			name:   "user limit across rooms",
+			limits: RateLimits{User: RateLimit{Burst: 1, Per: time.Minute}},
+			steps: []step{
+				{evt: evt("@a:x", "!r:x")},
+				{evt: evt("@a:x", "!s:x"), wantScope: "user", wantFirst: true},
+				{evt: evt("@b:x", "!r:x")},
+			},
+		},
+		{
+			name:   "room limit across users",
+			limits: RateLimits{Room: RateLimit{Burst: 1, Per: time.Minute}},
+			steps: []step{
+				{evt: evt("@a:x", "!r:x")},
+				{evt: evt("@b:x", "!r:x"), wantScope: "room", wantFirst: true},
+				{evt: evt("@b:x", "!s:x")},
+			},
+		},
+		{
+			name:   "global limit",
+			limits: RateLimits{Global: RateLimit{Burst: 2, Per: time.Minute}},
+			steps: []step{
+				{evt: evt("@a:x", "!r:x")},
+				{evt: evt("@b:x", "!s:x")},
+				{evt: evt("@c:x", "!t:x"), wantScope: "global", wantFirst: true},
+				{evt: evt("@d:x", "!u:x"), wantScope: "global"},
+			},
+		},
+		{
+			name: "user limit is checked first",
+			limits: RateLimits{
+				User: RateLimit{Burst: 1, Per: time.Minute},
+				Room: RateLimit{Burst: 1, Per: time.Minute},
+			},
+			steps: []step{
+				{evt: evt("@a:x", "!r:x")},
+				{evt: evt("@a:x", "!r:x"), wantScope: "user", wantFirst: true},
+			},
+		},
+		{
+			name: "limited events take no tokens",
+			limits: RateLimits{
+				User:   RateLimit{Burst: 1, Per: time.Minute},
+				Global: RateLimit{Burst: 2, Per: time.Minute},
+			},
+			steps: []step{
+				{evt: evt("@a:x", "!r:x")},
+				// limited by the user bucket, so the global token is kept
+				{evt: evt("@a:x", "!r:x"), wantScope: "user", wantFirst: true},
+				{evt: evt("@a:x", "!r:x"), wantScope: "user"},
+				{evt: evt("@b:x", "!r:x")},
+				{evt: evt("@c:x", "!r:x"), wantScope: "global", wantFirst: true},
+			},
+		},
+		{
+			name: "room limit doesn't drain the user bucket",
+			limits: RateLimits{
+				User: RateLimit{Burst: 2, Per: time.Minute},
+				Room: RateLimit{Burst: 1, Per: time.Minute},
+			},
+			steps: []step{
+				{evt: evt("@a:x", "!r:x")},
+				{evt: evt("@a:x", "!r:x"), wantScope: "room", wantFirst: true},
+				{evt: evt("@a:x", "!s:x")},
+				{evt: evt("@a:x", "!t:x"), wantScope: "user", wantFirst: true},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rl := newRateLimiter(tt.limits)
+
+			for i, s := range tt.steps {
+				scope, first := rl.allow(s.evt, start)
+				if scope != s.wantScope || first != s.wantFirst {
+					t.Errorf("step %d: allow = %q, %v, want %q, %v", i, scope, first, s.wantScope, s.wantFirst)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,197 @@
+package athenais
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/unerror/athenais/internal/matrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+const (
+	// typingTimeout is how long a typing notification lasts, and
+	// typingRefresh how often it is renewed while a handler runs
+	typingTimeout = 30 * time.Second
+	typingRefresh = 20 * time.Second
+)
+
+// Receipts configures the read receipts the bot sends for the events it
+// handles. The zero value marks every event read, publicly, once handled.
+type Receipts struct {
+	// Disabled stops the bot from sending read receipts
+	Disabled bool
+
+	// AfterSuccess only marks events read that were handled without errors
+	AfterSuccess bool
+
+	// BatchInterval sends receipts at most once per interval, for the latest
+	// handled event of each room. Zero sends them right away.
+	BatchInterval time.Duration
+
+	// Private sends private read receipts, which only the bot's own clients see
+	Private bool
+
+	// DisabledRooms are rooms the bot never sends read receipts in
+	DisabledRooms []id.RoomID
+}
+
+// receipter sends read receipts according to a Receipts configuration
+type receipter struct {
+	cfg      Receipts
+	disabled map[id.RoomID]struct{}
+	mc       *matrix.Client
+	log      *zerolog.Logger
+
+	mu      sync.Mutex
+	pending map[id.RoomID]*event.Event
+
+	quit chan struct{}
+	done chan struct{}
+}
+
+func newReceipter(mc *matrix.Client, o *options) *receipter {
+	r := &receipter{
+		cfg:      o.receipts,
+		disabled: make(map[id.RoomID]struct{}, len(o.receipts.DisabledRooms)),
+		mc:       mc,
+		log:      o.log,
+		pending:  make(map[id.RoomID]*event.Event),
+		quit:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+
+	for _, roomID := range o.receipts.DisabledRooms {
+		r.disabled[roomID] = struct{}{}
+	}
+
+	return r
+}
+
+// start flushes batched receipts every batch interval until stop is called
+func (r *receipter) start(ctx context.Context) {
+	if r.cfg.BatchInterval <= 0 {
+		close(r.done)
+		return
+	}
+
+	go func() {
+		defer close(r.done)
+
+		t := time.NewTicker(r.cfg.BatchInterval)
+		defer t.Stop()
+
+		for {
+			select {
+			case <-r.quit:
+				r.flush(ctx)
+				return
+			case <-t.C:
+				r.flush(ctx)
+			}
+		}
+	}()
+}
+
+// stop flushes the batched receipts and stops flushing
+func (r *receipter) stop() {
+	close(r.quit)
+	<-r.done
+}
+
+// markRead marks a handled event read. handled is false when the event was
+// not routed, e.g. because of a rate limit, and err is the routing error.
+func (r *receipter) markRead(ctx context.Context, evt *event.Event, handled bool, err error) {
+	if r.cfg.Disabled || evt.ID == "" || evt.RoomID == "" {
+		return
+	}
+
+	if _, ok := r.disabled[evt.RoomID]; ok {
+		return
+	}
+
+	if r.cfg.AfterSuccess && (!handled || err != nil) {
+		return
+	}
+
+	if r.cfg.BatchInterval > 0 {
+		r.mu.Lock()
+		if prev, ok := r.pending[evt.RoomID]; !ok || evt.Timestamp >= prev.Timestamp {
+			r.pending[evt.RoomID] = evt
+		}
+		r.mu.Unlock()
+		return
+	}
+
+	r.send(ctx, evt.RoomID, evt.ID)
+}
+
+// flush sends the batched receipts
+func (r *receipter) flush(ctx context.Context) {
+	r.mu.Lock()
+	pending := r.pending
+	r.pending = make(map[id.RoomID]*event.Event)
+	r.mu.Unlock()
+
+	for roomID, evt := range pending {
+		r.send(ctx, roomID, evt.ID)
+	}
+}
+
+func (r *receipter) send(ctx context.Context, roomID id.RoomID, eventID id.EventID) {
+	receiptType := event.ReceiptTypeRead
+	if r.cfg.Private {
+		receiptType = event.ReceiptTypeReadPrivate
+	}
+
+	if err := r.mc.SendReceiptContext(ctx, roomID, eventID, receiptType); err != nil {
+		r.log.Error().Err(err).Stringer("room_id", roomID).Stringer("event_id", eventID).Msg("Failed to mark read")
+	}
+}
+
+// Typing shows the bot as typing in a room until the returned function is
+// called, e.g. while a plugin generates a long answer
+//
+//	stop := bot.Typing(ctx, evt.RoomID)
+//	defer stop()
+func (b *Bot) Typing(ctx context.Context, roomID id.RoomID) (stop func()) {
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		t := time.NewTicker(typingRefresh)
+		defer t.Stop()
+
+		for {
+			if err := b.mc.UserTypingContext(ctx, roomID, true, typingTimeout); err != nil && ctx.Err() == nil {
+				b.log.Warn().Err(err).Stringer("room_id", roomID).Msg("Failed to send typing notification")
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			cancel()
+			<-done
+
+			// the handler's context may be done, so stop typing regardless
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			if err := b.mc.UserTypingContext(ctx, roomID, false, 0); err != nil {
+				b.log.Warn().Err(err).Stringer("room_id", roomID).Msg("Failed to stop typing notification")
+			}
+		})
+	}
+}
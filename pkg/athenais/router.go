@@ -1,57 +1,386 @@
 package athenais
 
-import "maunium.net/go/mautrix/event"
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
 
-type RouteHandler func(*event.Event) error
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/trace"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
 
-// Route defines a plugin route handler, based on event type and room ID
+// RouteHandler handles an event. The context is cancelled when the bot shuts
+// down or the route's timeout expires.
+type RouteHandler func(context.Context, *event.Event) error
+
+// MatchHandler is a route handler that receives the values captured by the
+// route's matchers
+type MatchHandler func(context.Context, *event.Event, *Match) error
+
+// AdaptHandler adapts a handler that doesn't take a context to a RouteHandler
+func AdaptHandler(h func(*event.Event) error) RouteHandler {
+	return func(_ context.Context, evt *event.Event) error {
+		return h(evt)
+	}
+}
+
+// Route defines a plugin route handler, based on the event type and the
+// route's matchers
 type Route struct {
+	// Name identifies the route in logs. Defaults to the event type and the
+	// registration order.
+	Name string
+
 	// EventType is the event type to match
 	EventType event.Type
 
+	// Matchers must all match for the route to be handled. Routes matching
+	// rooms with InRooms are indexed by room.
+	Matchers []Matcher
+
 	// Handler is the handler to call
 	Handler RouteHandler
+
+	// MatchHandler is called instead of Handler when set, with the values
+	// captured by the matchers
+	MatchHandler MatchHandler
+
+	// Middleware wraps the handler of this route, inside the Router's middleware
+	Middleware []Middleware
+
+	// Timeout is the deadline for the handler, enforced with the Timeout
+	// middleware. Defaults to the Router's timeout.
+	Timeout time.Duration
+
+	// Permission is what the sender needs to trigger the route
+	Permission Permission
+
+	// Plugin is the name of the plugin that registered the route
+	Plugin string
 }
 
-func NewRoute(eventType event.Type, handler RouteHandler) Route {
+func NewRoute(eventType event.Type, handler RouteHandler, matchers ...Matcher) Route {
 	return Route{
 		EventType: eventType,
+		Matchers:  matchers,
 		Handler:   handler,
 	}
 }
 
-// Router is a router for plugin routes
+// match runs the route's matchers against the event
+func (r *Route) match(evt *event.Event) (*Match, bool) {
+	m := &Match{}
+	for _, matcher := range r.Matchers {
+		if !matcher.Match(evt, m) {
+			return nil, false
+		}
+	}
+
+	return m, true
+}
+
+// handler returns the route's handler for the match, wrapped in the route's
+// middleware
+func (r *Route) handler(m *Match) RouteHandler {
+	h := r.Handler
+	if r.MatchHandler != nil {
+		h = func(ctx context.Context, evt *event.Event) error {
+			return r.MatchHandler(ctx, evt, m)
+		}
+	}
+
+	return chain(*r, h, r.Middleware)
+}
+
+// rooms returns the rooms the route is restricted to, or nil if it applies to
+// all rooms
+func (r *Route) rooms() roomMatcher {
+	var rooms roomMatcher
+	for _, matcher := range r.Matchers {
+		rm, ok := matcher.(roomMatcher)
+		if !ok {
+			continue
+		}
+
+		if rooms == nil {
+			rooms = rm
+			continue
+		}
+
+		// multiple room matchers must all match, so only their intersection applies
+		both := make(roomMatcher)
+		for room := range rooms {
+			if _, ok := rm[room]; ok {
+				both[room] = struct{}{}
+			}
+		}
+		rooms = both
+	}
+
+	return rooms
+}
+
+// routeEntry is a route with its registration order
+type routeEntry struct {
+	seq   int
+	route Route
+}
+
+// routeIndex indexes the routes for an event type by room
+type routeIndex struct {
+	// all are all routes for the event type
+	all []*routeEntry
+
+	// any are the routes that apply to every room
+	any []*routeEntry
+
+	// rooms are the routes restricted to a room
+	rooms map[id.RoomID][]*routeEntry
+}
+
+// candidates returns the routes that may apply to an event in the room, in
+// registration order
+func (idx *routeIndex) candidates(roomID id.RoomID) []*routeEntry {
+	scoped := idx.rooms[roomID]
+	if len(scoped) == 0 {
+		return idx.any
+	}
+
+	out := make([]*routeEntry, 0, len(idx.any)+len(scoped))
+	i, j := 0, 0
+	for i < len(idx.any) && j < len(scoped) {
+		if idx.any[i].seq < scoped[j].seq {
+			out = append(out, idx.any[i])
+			i++
+		} else {
+			out = append(out, scoped[j])
+			j++
+		}
+	}
+	out = append(out, idx.any[i:]...)
+	out = append(out, scoped[j:]...)
+
+	return out
+}
+
+// RouteFilter decides whether a matching route may handle an event
+type RouteFilter func(ctx context.Context, evt *event.Event, route *Route) bool
+
+// Router is a router for plugin routes. Routes may be added and removed while
+// events are handled.
 type Router struct {
-	routes          []Route
-	routeEventCache map[event.Type][]Route
+	// mu guards the routes, their index and the settings below
+	mu              sync.RWMutex
+	routes          []*routeEntry
+	routeEventCache map[event.Type]*routeIndex
+	seq             int
+
+	middleware []Middleware
+
+	// timeout is the default handler timeout, zero meaning no timeout
+	timeout time.Duration
+
+	// filter is checked for every matching route before it is handled
+	filter RouteFilter
 }
 
 func NewRouter() *Router {
 	return &Router{
-		routes:          make([]Route, 0),
-		routeEventCache: make(map[event.Type][]Route),
+		routes:          make([]*routeEntry, 0),
+		routeEventCache: make(map[event.Type]*routeIndex),
 	}
 }
 
+// Use adds middleware that wraps the handlers of all routes
+func (r *Router) Use(mws ...Middleware) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.middleware = append(r.middleware, mws...)
+}
+
+// SetTimeout sets the default timeout for routes without their own
+func (r *Router) SetTimeout(d time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.timeout = d
+}
+
+// SetFilter sets the filter checked before a matching route is handled
+func (r *Router) SetFilter(f RouteFilter) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.filter = f
+}
+
 func (r *Router) AddRoute(route Route) {
-	r.routes = append(r.routes, route)
-	r.routeEventCache[route.EventType] = append(r.routeEventCache[route.EventType], route)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if route.Name == "" {
+		route.Name = fmt.Sprintf("%s#%d", route.EventType.Type, r.seq)
+	}
+
+	entry := &routeEntry{seq: r.seq, route: route}
+	r.seq++
+	r.routes = append(r.routes, entry)
+	r.index(entry)
+}
+
+// RemoveRoutes removes the routes registered by a plugin, returning how many
+// were removed
+func (r *Router) RemoveRoutes(plugin string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	kept := make([]*routeEntry, 0, len(r.routes))
+	for _, entry := range r.routes {
+		if entry.route.Plugin != plugin {
+			kept = append(kept, entry)
+		}
+	}
+
+	removed := len(r.routes) - len(kept)
+	if removed == 0 {
+		return 0
+	}
+
+	// rebuild the index rather than updating it in place, as events being
+	// handled may still hold candidates from the old one
+	r.routes = kept
+	r.routeEventCache = make(map[event.Type]*routeIndex)
+	for _, entry := range kept {
+		r.index(entry)
+	}
+
+	return removed
+}
+
+// index adds a route entry to the index of its event type
+func (r *Router) index(entry *routeEntry) {
+	route := entry.route
+
+	idx, ok := r.routeEventCache[route.EventType]
+	if !ok {
+		idx = &routeIndex{rooms: make(map[id.RoomID][]*routeEntry)}
+		r.routeEventCache[route.EventType] = idx
+	}
+	idx.all = append(idx.all, entry)
+
+	rooms := route.rooms()
+	if rooms == nil {
+		idx.any = append(idx.any, entry)
+		return
+	}
+
+	for room := range rooms {
+		idx.rooms[room] = append(idx.rooms[room], entry)
+	}
 }
 
 func (r *Router) GetRoutesByEvent(eventType event.Type) []Route {
-	return r.routeEventCache[eventType]
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	idx, ok := r.routeEventCache[eventType]
+	if !ok {
+		return nil
+	}
+
+	routes := make([]Route, 0, len(idx.all))
+	for _, entry := range idx.all {
+		routes = append(routes, entry.route)
+	}
+
+	return routes
 }
 
 func (r *Router) GetRoutes() []Route {
-	return r.routes
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	routes := make([]Route, 0, len(r.routes))
+	for _, entry := range r.routes {
+		routes = append(routes, entry.route)
+	}
+
+	return routes
 }
 
-func (r *Router) Handle(evt *event.Event) error {
-	for _, route := range r.GetRoutesByEvent(evt.Type) {
-		if err := route.Handler(evt); err != nil {
-			return err
+// Handle calls every route matching the event. A failing route doesn't stop
+// the others; the errors are returned as a *HandleError.
+func (r *Router) Handle(ctx context.Context, evt *event.Event) error {
+	r.mu.RLock()
+	idx, ok := r.routeEventCache[evt.Type]
+	var candidates []*routeEntry
+	if ok {
+		candidates = idx.candidates(evt.RoomID)
+	}
+	mws, timeout, filter := r.middleware, r.timeout, r.filter
+	r.mu.RUnlock()
+
+	var herr HandleError
+	for _, entry := range candidates {
+		route := entry.route
+		m, ok := route.match(evt)
+		if !ok {
+			continue
+		}
+
+		if filter != nil && !filter(ctx, evt, &route) {
+			continue
+		}
+
+		err := handleRoute(ctx, route, m, evt, mws, timeout)
+		if err == nil {
+			continue
 		}
+
+		var rerr *RouteError
+		if !errors.As(err, &rerr) {
+			rerr = &RouteError{Plugin: route.Plugin, Route: route.Name, Err: err}
+		}
+		herr.Errors = append(herr.Errors, rerr)
+	}
+
+	if len(herr.Errors) > 0 {
+		return &herr
 	}
 
 	return nil
 }
+
+// handleRoute calls the route's handler wrapped in the router's middleware,
+// with the router's default timeout unless the route sets its own
+func handleRoute(ctx context.Context, route Route, m *Match, evt *event.Event, mws []Middleware, timeout time.Duration) error {
+	if route.Timeout != 0 {
+		timeout = route.Timeout
+	}
+
+	h := chain(route, route.handler(m), mws)
+	if timeout > 0 {
+		h = Timeout(timeout)(route, h)
+	}
+
+	ctx, span := tracer().Start(ctx, "route "+route.Name, trace.WithAttributes(
+		AttrEventID.String(evt.ID.String()),
+		AttrRoute.String(route.Name),
+		AttrPlugin.String(route.Plugin),
+	))
+	defer span.End()
+
+	start := time.Now()
+	err := h(ctx, evt)
+	routeDuration.WithLabelValues(route.Name, route.Plugin).Observe(time.Since(start).Seconds())
+	if err != nil {
+		routeErrors.WithLabelValues(route.Name, route.Plugin).Inc()
+		recordError(span, err)
+	}
+
+	return err
+}
@@ -0,0 +1,98 @@
+package athenais
+
+import (
+	"reflect"
+	"testing"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestRouteIndexCandidates(t *testing.T) {
+	const (
+		roomA = id.RoomID("!a:example.org")
+		roomB = id.RoomID("!b:example.org")
+		roomC = id.RoomID("!c:example.org")
+	)
+
+	// routes are identified by their registration order
+	routes := []Route{
+		{EventType: event.EventMessage, Matchers: []Matcher{InRooms(roomA)}},
+		{EventType: event.EventMessage},
+		{EventType: event.EventMessage, Matchers: []Matcher{InRooms(roomA, roomB)}},
+		{EventType: event.EventMessage},
+		{EventType: event.EventMessage, Matchers: []Matcher{InRooms(roomA)}},
+		{EventType: event.EventReaction},
+		{EventType: event.EventMessage, Matchers: []Matcher{InRooms(roomA, roomB), InRooms(roomB, roomC)}},
+	}
+
+	r := NewRouter()
+	for _, route := range routes {
+		r.AddRoute(route)
+	}
+
+	tests := []struct {
+		name      string
+		eventType event.Type
+		room      id.RoomID
+		want      []int
+	}{
+		{name: "merged in registration order", eventType: event.EventMessage, room: roomA, want: []int{0, 1, 2, 3, 4}},
+		{name: "room matchers intersect", eventType: event.EventMessage, room: roomB, want: []int{1, 2, 3, 6}},
+		{name: "unindexed room", eventType: event.EventMessage, room: "!d:example.org", want: []int{1, 3}},
+		{name: "other event type", eventType: event.EventReaction, room: roomA, want: []int{5}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []int
+			for _, entry := range r.routeEventCache[tt.eventType].candidates(tt.room) {
+				got = append(got, entry.seq)
+			}
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("candidates(%s) = %v, want %v", tt.room, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRouterRemoveRoutes(t *testing.T) {
+	const room = id.RoomID("!a:example.org")
+
+	// routes are identified by their registration order
+	routes := []Route{
+		{EventType: event.EventMessage},
+		{EventType: event.EventMessage, Plugin: "p"},
+		{EventType: event.EventMessage, Matchers: []Matcher{InRooms(room)}, Plugin: "p"},
+		{EventType: event.EventMessage, Matchers: []Matcher{InRooms(room)}},
+		{EventType: event.EventReaction, Plugin: "p"},
+	}
+
+	r := NewRouter()
+	for _, route := range routes {
+		r.AddRoute(route)
+	}
+
+	if n := r.RemoveRoutes("p"); n != 3 {
+		t.Fatalf("RemoveRoutes = %d, want 3", n)
+	}
+	if n := r.RemoveRoutes("p"); n != 0 {
+		t.Fatalf("RemoveRoutes again = %d, want 0", n)
+	}
+
+	// routes added afterwards come after the remaining ones
+	r.AddRoute(Route{EventType: event.EventMessage, Plugin: "p"})
+
+	var got []int
+	for _, entry := range r.routeEventCache[event.EventMessage].candidates(room) {
+		got = append(got, entry.seq)
+	}
+	if want := []int{0, 3, 5}; !reflect.DeepEqual(got, want) {
+		t.Errorf("candidates(%s) = %v, want %v", room, got, want)
+	}
+
+	if routes := r.GetRoutesByEvent(event.EventReaction); len(routes) != 0 {
+		t.Errorf("%d reaction routes left, want 0", len(routes))
+	}
+}
@@ -0,0 +1,91 @@
+package athenais
+
+import (
+	"regexp"
+
+	"github.com/pkg/errors"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// RouteSpec declares a route as data, for plugins whose routes come from
+// outside Go, e.g. external processes or scripts. All matchers that are set
+// must match.
+type RouteSpec struct {
+	// Name identifies the route
+	Name string
+
+	// EventType is the event type to match. Defaults to m.room.message.
+	EventType string
+
+	// MsgTypes are the message types to match, e.g. m.text
+	MsgTypes []string
+
+	// BodyRegex is a regular expression the body must match
+	BodyRegex string
+
+	// Rooms are the room IDs to match
+	Rooms []string
+
+	// Senders are the sender globs to match, e.g. @*:example.com
+	Senders []string
+
+	// Addressed only matches messages mentioning or replying to the bot
+	Addressed bool
+
+	// Permission is what the sender needs to trigger the route
+	Permission Permission
+}
+
+// Route creates a route matching the spec for the bot. The caller sets the
+// plugin and handler.
+func (s RouteSpec) Route(b *Bot) (Route, error) {
+	eventType := event.EventMessage
+	if s.EventType != "" {
+		eventType = event.NewEventType(s.EventType)
+		if eventType.Class == event.UnknownEventType {
+			// custom event types arrive as timeline events
+			eventType.Class = event.MessageEventType
+		}
+	}
+
+	var matchers []Matcher
+	if len(s.MsgTypes) > 0 {
+		types := make([]event.MessageType, 0, len(s.MsgTypes))
+		for _, t := range s.MsgTypes {
+			types = append(types, event.MessageType(t))
+		}
+		matchers = append(matchers, MsgTypes(types...))
+	}
+
+	if s.BodyRegex != "" {
+		re, err := regexp.Compile(s.BodyRegex)
+		if err != nil {
+			return Route{}, errors.Wrap(err, "invalid body_regex")
+		}
+		matchers = append(matchers, BodyRegex(re))
+	}
+
+	if len(s.Rooms) > 0 {
+		rooms := make([]id.RoomID, 0, len(s.Rooms))
+		for _, r := range s.Rooms {
+			rooms = append(rooms, id.RoomID(r))
+		}
+		matchers = append(matchers, InRooms(rooms...))
+	}
+
+	if len(s.Senders) > 0 {
+		matchers = append(matchers, FromSenders(s.Senders...))
+	}
+
+	if s.Addressed {
+		matchers = append(matchers, b.Addressed(b.ID()))
+	}
+
+	return Route{
+		Name:       s.Name,
+		EventType:  eventType,
+		Matchers:   matchers,
+		Permission: s.Permission,
+	}, nil
+}
@@ -0,0 +1,61 @@
+package athenais
+
+import (
+	"testing"
+
+	"maunium.net/go/mautrix/event"
+)
+
+func TestRouteSpecRoute(t *testing.T) {
+	evt := message(&event.MessageEventContent{Body: "remind me in 5m"})
+
+	tests := []struct {
+		name      string
+		spec      RouteSpec
+		wantType  event.Type
+		wantMatch bool
+		wantErr   bool
+	}{
+		{name: "defaults to messages", spec: RouteSpec{}, wantType: event.EventMessage, wantMatch: true},
+		{
+			name:      "custom event type",
+			spec:      RouteSpec{EventType: "org.example.custom"},
+			wantType:  event.Type{Type: "org.example.custom", Class: event.MessageEventType},
+			wantMatch: true,
+		},
+		{name: "state event type", spec: RouteSpec{EventType: "m.room.topic"}, wantType: event.StateTopic, wantMatch: true},
+		{
+			name: "all matchers match",
+			spec: RouteSpec{
+				MsgTypes:  []string{"m.text"},
+				BodyRegex: `in \d+m`,
+				Rooms:     []string{testRoom.String()},
+				Senders:   []string{"@*:example.org"},
+			},
+			wantType:  event.EventMessage,
+			wantMatch: true,
+		},
+		{name: "other room", spec: RouteSpec{Rooms: []string{"!other:example.org"}}, wantType: event.EventMessage},
+		{name: "other msgtype", spec: RouteSpec{MsgTypes: []string{"m.notice"}}, wantType: event.EventMessage},
+		{name: "invalid body regex", spec: RouteSpec{BodyRegex: "("}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			route, err := tt.spec.Route(&Bot{})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Route() error = %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+
+			if route.EventType != tt.wantType {
+				t.Errorf("EventType = %+v, want %+v", route.EventType, tt.wantType)
+			}
+			if _, ok := route.match(evt); ok != tt.wantMatch {
+				t.Errorf("match = %v, want %v", ok, tt.wantMatch)
+			}
+		})
+	}
+}
@@ -0,0 +1,533 @@
+package athenais
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/robfig/cron/v3"
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/util/dbutil"
+)
+
+// MaxCatchUpRuns caps the number of missed runs CatchUp replays for a job
+const MaxCatchUpRuns = 100
+
+// ErrJobNotFound is returned when cancelling a job that does not exist
+var ErrJobNotFound = errors.New("job not found")
+
+// MissedRunPolicy decides what happens to runs of a job that were due while
+// the bot was not running
+type MissedRunPolicy int
+
+const (
+	// RunOnce runs a job once for all its missed runs
+	RunOnce MissedRunPolicy = iota
+
+	// Skip drops missed runs. One-off jobs that were missed are cancelled.
+	Skip
+
+	// CatchUp runs a job once for every missed run, up to MaxCatchUpRuns
+	CatchUp
+)
+
+// ParseMissedRunPolicy parses a missed run policy name: run-once, skip or
+// catch-up
+func ParseMissedRunPolicy(s string) (MissedRunPolicy, error) {
+	switch strings.ToLower(s) {
+	case "", "run-once":
+		return RunOnce, nil
+	case "skip":
+		return Skip, nil
+	case "catch-up":
+		return CatchUp, nil
+	default:
+		return RunOnce, errors.Errorf("unknown missed run policy: %s", s)
+	}
+}
+
+func (p MissedRunPolicy) String() string {
+	switch p {
+	case Skip:
+		return "skip"
+	case CatchUp:
+		return "catch-up"
+	default:
+		return "run-once"
+	}
+}
+
+// JobHandler handles a run of a job. scheduled is the time the run was due,
+// which is in the past for missed runs.
+type JobHandler func(ctx context.Context, job Job, scheduled time.Time) error
+
+// Job is a scheduled job
+type Job struct {
+	// ID identifies the job. Scheduling a job with the ID of an existing job
+	// replaces it.
+	ID string
+
+	// Plugin is the plugin that registered the job's handler
+	Plugin string
+
+	// Handler is the name of the handler running the job
+	Handler string
+
+	// Spec is the cron expression of a recurring job, empty for one-off jobs
+	Spec string
+
+	// Payload is passed to the handler, e.g. the room to post a reminder in
+	Payload string
+
+	// Missed is the policy for runs missed while the bot was not running
+	Missed MissedRunPolicy
+
+	// NextRun is when the job runs next
+	NextRun time.Time
+
+	schedule cron.Schedule
+	missed   []time.Time
+	running  bool
+}
+
+// JobOption configures a scheduled job
+type JobOption func(*Job)
+
+// WithJobID sets the ID of the job, so the job is replaced rather than
+// duplicated when it is scheduled again, e.g. on every start
+func WithJobID(id string) JobOption {
+	return func(j *Job) {
+		j.ID = id
+	}
+}
+
+// WithPayload sets the payload passed to the job's handler
+func WithPayload(payload string) JobOption {
+	return func(j *Job) {
+		j.Payload = payload
+	}
+}
+
+// WithMissedRunPolicy sets the policy for runs missed while the bot was not
+// running. Defaults to RunOnce.
+func WithMissedRunPolicy(p MissedRunPolicy) JobOption {
+	return func(j *Job) {
+		j.Missed = p
+	}
+}
+
+type jobHandler struct {
+	plugin string
+	fn     JobHandler
+}
+
+// scheduler runs cron and delayed jobs. Jobs are persisted in the database
+// when there is one, so they survive restarts.
+type scheduler struct {
+	db  *dbutil.Database
+	log *zerolog.Logger
+
+	mu       sync.Mutex
+	handlers map[string]jobHandler
+	jobs     map[string]*Job
+
+	wake chan struct{}
+	quit chan struct{}
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+func newScheduler(log *zerolog.Logger) *scheduler {
+	return &scheduler{
+		log:      log,
+		handlers: make(map[string]jobHandler),
+		jobs:     make(map[string]*Job),
+		wake:     make(chan struct{}, 1),
+		quit:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// load loads the persisted jobs and applies their missed run policies
+func (s *scheduler) load(ctx context.Context) error {
+	if s.db == nil {
+		return nil
+	}
+
+	rows, err := s.db.QueryContext(ctx, "SELECT id, plugin, handler, spec, payload, missed, next_run FROM athenais_jobs")
+	if err != nil {
+		return errors.Wrap(err, "failed to load jobs")
+	}
+	defer rows.Close()
+
+	var jobs []*Job
+	for rows.Next() {
+		var (
+			j       = &Job{}
+			missed  string
+			nextRun int64
+		)
+
+		if err := rows.Scan(&j.ID, &j.Plugin, &j.Handler, &j.Spec, &j.Payload, &missed, &nextRun); err != nil {
+			return errors.Wrap(err, "failed to scan job")
+		}
+
+		if j.Missed, err = ParseMissedRunPolicy(missed); err != nil {
+			return errors.Wrapf(err, "invalid job %s", j.ID)
+		}
+
+		if j.Spec != "" {
+			if j.schedule, err = cron.ParseStandard(j.Spec); err != nil {
+				return errors.Wrapf(err, "invalid job %s", j.ID)
+			}
+		}
+
+		j.NextRun = time.UnixMilli(nextRun)
+		jobs = append(jobs, j)
+	}
+
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for _, j := range jobs {
+		if j.NextRun.After(now) {
+			s.jobs[j.ID] = j
+			continue
+		}
+
+		if !j.applyMissed(now) {
+			s.log.Info().Str("job", j.ID).Msg("Skipping missed job")
+			if err := s.remove(ctx, j.ID); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if j.Missed == Skip {
+			if err := s.save(ctx, j); err != nil {
+				return err
+			}
+		}
+
+		s.jobs[j.ID] = j
+	}
+
+	return nil
+}
+
+// applyMissed applies the missed run policy of a job that was due before now.
+// It returns false if the job is dropped.
+func (j *Job) applyMissed(now time.Time) bool {
+	switch j.Missed {
+	case Skip:
+		if j.schedule == nil {
+			return false
+		}
+
+		j.NextRun = j.schedule.Next(now)
+	case CatchUp:
+		if j.schedule != nil {
+			for t := j.NextRun; !t.After(now) && len(j.missed) < MaxCatchUpRuns; t = j.schedule.Next(t) {
+				j.missed = append(j.missed, t)
+			}
+		}
+	}
+
+	return true
+}
+
+// start runs due jobs until stop is called
+func (s *scheduler) start(ctx context.Context) {
+	go func() {
+		defer close(s.done)
+
+		for {
+			var timer *time.Timer
+			if next, ok := s.next(); ok {
+				timer = time.NewTimer(time.Until(next))
+			} else {
+				timer = time.NewTimer(time.Hour)
+			}
+
+			select {
+			case <-s.quit:
+				timer.Stop()
+				return
+			case <-s.wake:
+				timer.Stop()
+			case now := <-timer.C:
+				s.runDue(ctx, now)
+			}
+		}
+	}()
+}
+
+// stop stops scheduling jobs and waits for running jobs to finish
+func (s *scheduler) stop() {
+	close(s.quit)
+	<-s.done
+	s.wg.Wait()
+}
+
+// next returns when the next job is due
+func (s *scheduler) next() (time.Time, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var (
+		next time.Time
+		ok   bool
+	)
+	for _, j := range s.jobs {
+		if j.running {
+			continue
+		}
+
+		if !ok || j.NextRun.Before(next) {
+			next, ok = j.NextRun, true
+		}
+	}
+
+	return next, ok
+}
+
+// runDue runs the jobs that are due, advancing recurring jobs to their next
+// run and removing one-off jobs
+func (s *scheduler) runDue(ctx context.Context, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, j := range s.jobs {
+		if j.running || j.NextRun.After(now) {
+			continue
+		}
+
+		h, ok := s.handlers[j.Handler]
+		if !ok {
+			s.log.Warn().Str("job", j.ID).Str("handler", j.Handler).Msg("No handler for job, postponing")
+			j.NextRun = now.Add(time.Minute)
+			continue
+		}
+
+		runs := j.missed
+		if len(runs) == 0 {
+			runs = []time.Time{j.NextRun}
+		}
+		j.missed = nil
+
+		if j.schedule != nil {
+			j.NextRun = j.schedule.Next(now)
+			if err := s.save(ctx, j); err != nil {
+				s.log.Error().Err(err).Str("job", j.ID).Msg("Failed to save job")
+			}
+		} else {
+			delete(s.jobs, j.ID)
+			if err := s.remove(ctx, j.ID); err != nil {
+				s.log.Error().Err(err).Str("job", j.ID).Msg("Failed to remove job")
+			}
+		}
+
+		j.running = true
+		s.wg.Add(1)
+		go s.run(ctx, h, *j, runs)
+	}
+}
+
+// run runs a job once for each of runs
+func (s *scheduler) run(ctx context.Context, h jobHandler, job Job, runs []time.Time) {
+	defer s.wg.Done()
+	defer func() {
+		s.mu.Lock()
+		if j, ok := s.jobs[job.ID]; ok {
+			j.running = false
+		}
+		s.mu.Unlock()
+		s.poke()
+	}()
+
+	log := s.log.With().Str("plugin", h.plugin).Str("job", job.ID).Logger()
+
+	for _, scheduled := range runs {
+		if ctx.Err() != nil {
+			return
+		}
+
+		func() {
+			defer func() {
+				if rec := recover(); rec != nil {
+					log.Error().Interface("panic", rec).Msg("Job panicked")
+				}
+			}()
+
+			if err := h.fn(ctx, job, scheduled); err != nil {
+				log.Error().Err(err).Time("scheduled", scheduled).Msg("Job failed")
+			}
+		}()
+	}
+}
+
+// poke wakes the scheduler loop to pick up changed jobs
+func (s *scheduler) poke() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// add schedules a job, replacing any job with the same ID
+func (s *scheduler) add(ctx context.Context, j *Job) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	h, ok := s.handlers[j.Handler]
+	if !ok {
+		return errors.Errorf("unknown job handler: %s", j.Handler)
+	}
+	j.Plugin = h.plugin
+
+	if j.ID == "" {
+		j.ID = newJobID()
+	} else if old, ok := s.jobs[j.ID]; ok {
+		j.running = old.running
+
+		// rescheduling an unchanged recurring job keeps its pending and missed runs
+		if j.Spec != "" && j.Spec == old.Spec {
+			j.NextRun, j.missed = old.NextRun, old.missed
+		}
+	}
+
+	if err := s.save(ctx, j); err != nil {
+		return err
+	}
+
+	s.jobs[j.ID] = j
+	s.poke()
+	return nil
+}
+
+// cancel removes a job. A running job finishes its current run.
+func (s *scheduler) cancel(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.jobs[id]; !ok {
+		return ErrJobNotFound
+	}
+
+	if err := s.remove(ctx, id); err != nil {
+		return err
+	}
+
+	delete(s.jobs, id)
+	s.poke()
+	return nil
+}
+
+func (s *scheduler) save(ctx context.Context, j *Job) error {
+	if s.db == nil {
+		return nil
+	}
+
+	_, err := s.db.ExecContext(ctx, `
+INSERT INTO athenais_jobs (id, plugin, handler, spec, payload, missed, next_run) VALUES ($1, $2, $3, $4, $5, $6, $7)
+ON CONFLICT (id) DO UPDATE SET plugin = excluded.plugin, handler = excluded.handler, spec = excluded.spec,
+	payload = excluded.payload, missed = excluded.missed, next_run = excluded.next_run
+`, j.ID, j.Plugin, j.Handler, j.Spec, j.Payload, j.Missed.String(), j.NextRun.UnixMilli())
+
+	return errors.Wrapf(err, "failed to save job %s", j.ID)
+}
+
+func (s *scheduler) remove(ctx context.Context, id string) error {
+	if s.db == nil {
+		return nil
+	}
+
+	_, err := s.db.ExecContext(ctx, "DELETE FROM athenais_jobs WHERE id = $1", id)
+	return errors.Wrapf(err, "failed to remove job %s", id)
+}
+
+func newJobID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return time.Now().Format("20060102150405.000000000")
+	}
+
+	return hex.EncodeToString(b)
+}
+
+// HandleJob registers a job handler. Handler names are global, so plugins
+// should prefix them with their name. Handlers must be registered in Init, so
+// they are known when persisted jobs are loaded.
+func (b *Bot) HandleJob(name string, fn JobHandler) {
+	b.s.mu.Lock()
+	defer b.s.mu.Unlock()
+
+	b.s.handlers[name] = jobHandler{plugin: b.plugin, fn: fn}
+}
+
+// Schedule schedules a recurring job running handler on a cron expression,
+// e.g. "0 9 * * *" or "@daily", and returns its ID. Jobs are persisted, so
+// plugins should schedule them from Start or handlers, with WithJobID to avoid
+// duplicates across restarts.
+func (b *Bot) Schedule(ctx context.Context, handler, spec string, opts ...JobOption) (string, error) {
+	sched, err := cron.ParseStandard(spec)
+	if err != nil {
+		return "", errors.Wrapf(err, "invalid cron expression %q", spec)
+	}
+
+	j := &Job{Handler: handler, Spec: spec, schedule: sched}
+	for _, opt := range opts {
+		opt(j)
+	}
+	j.NextRun = sched.Next(time.Now())
+
+	if err := b.s.add(ctx, j); err != nil {
+		return "", err
+	}
+
+	return j.ID, nil
+}
+
+// ScheduleAfter schedules a one-off job running handler after delay, and
+// returns its ID
+func (b *Bot) ScheduleAfter(ctx context.Context, handler string, delay time.Duration, opts ...JobOption) (string, error) {
+	j := &Job{Handler: handler, NextRun: time.Now().Add(delay)}
+	for _, opt := range opts {
+		opt(j)
+	}
+
+	if err := b.s.add(ctx, j); err != nil {
+		return "", err
+	}
+
+	return j.ID, nil
+}
+
+// CancelJob cancels a scheduled job, or returns ErrJobNotFound
+func (b *Bot) CancelJob(ctx context.Context, id string) error {
+	return b.s.cancel(ctx, id)
+}
+
+// Jobs returns the scheduled jobs, ordered by their next run
+func (b *Bot) Jobs() []Job {
+	b.s.mu.Lock()
+	defer b.s.mu.Unlock()
+
+	jobs := make([]Job, 0, len(b.s.jobs))
+	for _, j := range b.s.jobs {
+		jobs = append(jobs, *j)
+	}
+
+	sort.Slice(jobs, func(i, k int) bool {
+		return jobs[i].NextRun.Before(jobs[k].NextRun)
+	})
+
+	return jobs
+}
@@ -0,0 +1,138 @@
+package athenais
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/robfig/cron/v3"
+	"github.com/rs/zerolog"
+)
+
+func TestApplyMissed(t *testing.T) {
+	now := time.Date(2026, 1, 1, 12, 30, 0, 0, time.UTC)
+	at := func(hour, min int) time.Time {
+		return time.Date(2026, 1, 1, hour, min, 0, 0, time.UTC)
+	}
+
+	tests := []struct {
+		name       string
+		spec       string
+		policy     MissedRunPolicy
+		nextRun    time.Time
+		wantKept   bool
+		wantNext   time.Time
+		wantMissed int
+		wantFirst  time.Time
+	}{
+		{name: "recurring run once", spec: "0 * * * *", policy: RunOnce, nextRun: at(9, 0), wantKept: true, wantNext: at(9, 0)},
+		{name: "recurring skip", spec: "0 * * * *", policy: Skip, nextRun: at(9, 0), wantKept: true, wantNext: at(13, 0)},
+		{
+			name: "recurring catch up", spec: "0 * * * *", policy: CatchUp, nextRun: at(9, 0),
+			wantKept: true, wantNext: at(9, 0), wantMissed: 4, wantFirst: at(9, 0),
+		},
+		{
+			name: "catch up is capped", spec: "* * * * *", policy: CatchUp, nextRun: at(9, 0),
+			wantKept: true, wantNext: at(9, 0), wantMissed: MaxCatchUpRuns, wantFirst: at(9, 0),
+		},
+		{name: "one-off run once", policy: RunOnce, nextRun: at(9, 0), wantKept: true, wantNext: at(9, 0)},
+		{name: "one-off skip", policy: Skip, nextRun: at(9, 0), wantKept: false},
+		{name: "one-off catch up", policy: CatchUp, nextRun: at(9, 0), wantKept: true, wantNext: at(9, 0)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			j := &Job{ID: "job", Spec: tt.spec, Missed: tt.policy, NextRun: tt.nextRun}
+			if tt.spec != "" {
+				var err error
+				if j.schedule, err = cron.ParseStandard(tt.spec); err != nil {
+					t.Fatalf("invalid spec: %v", err)
+				}
+			}
+
+			if kept := j.applyMissed(now); kept != tt.wantKept {
+				t.Fatalf("applyMissed = %v, want %v", kept, tt.wantKept)
+			}
+			if !tt.wantKept {
+				return
+			}
+
+			if !j.NextRun.Equal(tt.wantNext) {
+				t.Errorf("NextRun = %s, want %s", j.NextRun, tt.wantNext)
+			}
+			if len(j.missed) != tt.wantMissed {
+				t.Fatalf("missed %d runs, want %d", len(j.missed), tt.wantMissed)
+			}
+			if tt.wantMissed > 0 && !j.missed[0].Equal(tt.wantFirst) {
+				t.Errorf("first missed run = %s, want %s", j.missed[0], tt.wantFirst)
+			}
+		})
+	}
+}
+
+func TestRunDueMissedRuns(t *testing.T) {
+	now := time.Date(2026, 1, 1, 12, 30, 0, 0, time.UTC)
+	at := func(hour int) time.Time {
+		return time.Date(2026, 1, 1, hour, 0, 0, 0, time.UTC)
+	}
+
+	hourly, err := cron.ParseStandard("0 * * * *")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	log := zerolog.Nop()
+	s := newScheduler(&log)
+
+	var (
+		mu   sync.Mutex
+		runs = make(map[string][]time.Time)
+	)
+	s.handlers["test"] = jobHandler{plugin: "test", fn: func(_ context.Context, job Job, scheduled time.Time) error {
+		mu.Lock()
+		defer mu.Unlock()
+		runs[job.ID] = append(runs[job.ID], scheduled)
+		return nil
+	}}
+
+	jobs := []*Job{
+		{ID: "once", Handler: "test", Spec: "0 * * * *", Missed: RunOnce, NextRun: at(9), schedule: hourly},
+		{ID: "catch-up", Handler: "test", Spec: "0 * * * *", Missed: CatchUp, NextRun: at(9), schedule: hourly},
+		{ID: "one-off", Handler: "test", Missed: RunOnce, NextRun: at(10)},
+		{ID: "later", Handler: "test", Missed: RunOnce, NextRun: at(14)},
+	}
+	for _, j := range jobs {
+		if !j.applyMissed(now) {
+			t.Fatalf("job %s dropped", j.ID)
+		}
+		s.jobs[j.ID] = j
+	}
+
+	s.runDue(context.Background(), now)
+	s.wg.Wait()
+
+	want := map[string][]time.Time{
+		"once":     {at(9)},
+		"catch-up": {at(9), at(10), at(11), at(12)},
+		"one-off":  {at(10)},
+	}
+	if !reflect.DeepEqual(runs, want) {
+		t.Errorf("runs = %v, want %v", runs, want)
+	}
+
+	for _, id := range []string{"once", "catch-up"} {
+		j := s.jobs[id]
+		if !j.NextRun.Equal(at(13)) || len(j.missed) != 0 || j.running {
+			t.Errorf("job %s: next run %s, %d missed runs, running %v; want next run %s", id, j.NextRun, len(j.missed), j.running, at(13))
+		}
+	}
+
+	if _, ok := s.jobs["one-off"]; ok {
+		t.Error("one-off job was not removed after running")
+	}
+	if _, ok := s.jobs["later"]; !ok {
+		t.Error("job not yet due was removed")
+	}
+}
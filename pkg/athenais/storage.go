@@ -0,0 +1,200 @@
+package athenais
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/pkg/errors"
+	"maunium.net/go/mautrix/util/dbutil"
+)
+
+// StorageVersionTableName is the table tracking the schema version of the
+// plugin storage tables
+const StorageVersionTableName = "athenais_storage_version"
+
+var (
+	// ErrNotFound is returned when a key does not exist or has expired
+	ErrNotFound = errors.New("key not found")
+
+	// ErrNoDatabase is returned by storage when the bot has no database
+	ErrNoDatabase = errors.New("no database configured")
+)
+
+// storageUpgrades are the schema upgrades of the plugin storage tables
+var storageUpgrades dbutil.UpgradeTable
+
+func init() {
+	storageUpgrades.Register(-1, 1, "Add plugin key-value storage", true, func(tx dbutil.Execable, db *dbutil.Database) error {
+		_, err := tx.Exec(`
+CREATE TABLE athenais_storage (
+	plugin     TEXT   NOT NULL,
+	key        TEXT   NOT NULL,
+	value      BLOB   NOT NULL,
+	expires_at BIGINT,
+	PRIMARY KEY (plugin, key)
+);
+`)
+		return err
+	})
+}
+
+// Entry is a key-value pair in a plugin's storage
+type Entry struct {
+	Key   string
+	Value []byte
+
+	// ExpiresAt is when the entry expires, zero if it never does
+	ExpiresAt time.Time
+}
+
+// Storage is a key-value store namespaced to a plugin. Keys of one plugin are
+// not visible to others. Expired entries are never returned and are purged
+// when the bot starts.
+type Storage struct {
+	db     *dbutil.Database
+	exec   dbutil.ContextExecable
+	plugin string
+}
+
+// Storage returns the key-value storage of a plugin
+func (b *Bot) Storage(plugin string) *Storage {
+	s := &Storage{db: b.storage, plugin: plugin}
+	if b.storage != nil {
+		s.exec = b.storage
+	}
+
+	return s
+}
+
+// Get returns the value of key, or ErrNotFound
+func (s *Storage) Get(ctx context.Context, key string) ([]byte, error) {
+	if s.exec == nil {
+		return nil, ErrNoDatabase
+	}
+
+	var value []byte
+	err := s.exec.QueryRowContext(ctx, `
+SELECT value FROM athenais_storage
+WHERE plugin = $1 AND key = $2 AND (expires_at IS NULL OR expires_at > $3)
+`, s.plugin, key, time.Now().UnixMilli()).Scan(&value)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, errors.Wrapf(err, "failed to get %s", key)
+	}
+
+	return value, nil
+}
+
+// Put sets the value of key. A ttl of zero keeps the entry until it is
+// deleted.
+func (s *Storage) Put(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	if s.exec == nil {
+		return ErrNoDatabase
+	}
+
+	var expiresAt sql.NullInt64
+	if ttl > 0 {
+		expiresAt = sql.NullInt64{Int64: time.Now().Add(ttl).UnixMilli(), Valid: true}
+	}
+
+	_, err := s.exec.ExecContext(ctx, `
+INSERT INTO athenais_storage (plugin, key, value, expires_at) VALUES ($1, $2, $3, $4)
+ON CONFLICT (plugin, key) DO UPDATE SET value = excluded.value, expires_at = excluded.expires_at
+`, s.plugin, key, value, expiresAt)
+	if err != nil {
+		return errors.Wrapf(err, "failed to put %s", key)
+	}
+
+	return nil
+}
+
+// Delete removes key. Deleting a missing key is not an error.
+func (s *Storage) Delete(ctx context.Context, key string) error {
+	if s.exec == nil {
+		return ErrNoDatabase
+	}
+
+	_, err := s.exec.ExecContext(ctx, "DELETE FROM athenais_storage WHERE plugin = $1 AND key = $2", s.plugin, key)
+	if err != nil {
+		return errors.Wrapf(err, "failed to delete %s", key)
+	}
+
+	return nil
+}
+
+// List returns the entries whose key starts with prefix, ordered by key
+func (s *Storage) List(ctx context.Context, prefix string) ([]Entry, error) {
+	if s.exec == nil {
+		return nil, ErrNoDatabase
+	}
+
+	rows, err := s.exec.QueryContext(ctx, `
+SELECT key, value, expires_at FROM athenais_storage
+WHERE plugin = $1 AND substr(key, 1, length($2)) = $2 AND (expires_at IS NULL OR expires_at > $3)
+ORDER BY key
+`, s.plugin, prefix, time.Now().UnixMilli())
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to list %s", prefix)
+	}
+	defer rows.Close()
+
+	var entries []Entry
+	for rows.Next() {
+		var (
+			e         Entry
+			expiresAt sql.NullInt64
+		)
+
+		if err := rows.Scan(&e.Key, &e.Value, &expiresAt); err != nil {
+			return nil, errors.Wrap(err, "failed to scan entry")
+		}
+
+		if expiresAt.Valid {
+			e.ExpiresAt = time.UnixMilli(expiresAt.Int64)
+		}
+
+		entries = append(entries, e)
+	}
+
+	return entries, rows.Err()
+}
+
+// Txn runs fn in a transaction. The storage passed to fn reads and writes
+// within the transaction, which is committed if fn returns nil and rolled
+// back otherwise.
+func (s *Storage) Txn(ctx context.Context, fn func(*Storage) error) error {
+	if s.db == nil {
+		return ErrNoDatabase
+	}
+
+	if _, ok := s.exec.(dbutil.Transaction); ok {
+		// already in a transaction
+		return fn(s)
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "failed to begin transaction")
+	}
+
+	if err := fn(&Storage{db: s.db, exec: tx, plugin: s.plugin}); err != nil {
+		if rerr := tx.Rollback(); rerr != nil {
+			return errors.Wrapf(err, "failed to roll back transaction: %s", rerr)
+		}
+		return err
+	}
+
+	return errors.Wrap(tx.Commit(), "failed to commit transaction")
+}
+
+// purgeExpired deletes the expired entries of all plugins
+func purgeExpired(ctx context.Context, db *dbutil.Database) (int64, error) {
+	res, err := db.ExecContext(ctx, "DELETE FROM athenais_storage WHERE expires_at IS NOT NULL AND expires_at <= $1", time.Now().UnixMilli())
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to purge expired entries")
+	}
+
+	return res.RowsAffected()
+}
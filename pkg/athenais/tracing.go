@@ -0,0 +1,80 @@
+package athenais
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// TracerName is the name of the bot's tracer
+const TracerName = "github.com/unerror/athenais/pkg/athenais"
+
+// Span attributes
+const (
+	// AttrEventID is the ID of the event being handled. Every span of an event
+	// carries it, from receipt to the messages sent in response.
+	AttrEventID = attribute.Key("matrix.event_id")
+
+	// AttrRoomID is the ID of the room of the event
+	AttrRoomID = attribute.Key("matrix.room_id")
+
+	// AttrEventType is the type of the event
+	AttrEventType = attribute.Key("matrix.event_type")
+
+	// AttrSender is the sender of the event
+	AttrSender = attribute.Key("matrix.sender")
+
+	// AttrSentEventID is the ID of an event the bot sent
+	AttrSentEventID = attribute.Key("matrix.sent_event_id")
+
+	// AttrRoute is the name of the route handling the event
+	AttrRoute = attribute.Key("athenais.route")
+
+	// AttrPlugin is the plugin of the route handling the event
+	AttrPlugin = attribute.Key("athenais.plugin")
+)
+
+type eventIDKey struct{}
+
+// withEventID returns a context carrying the ID of the event being handled
+func withEventID(ctx context.Context, evtID id.EventID) context.Context {
+	return context.WithValue(ctx, eventIDKey{}, evtID)
+}
+
+// EventIDFromContext returns the ID of the event being handled with ctx, if
+// any, so spans started by plugins can carry it as AttrEventID
+func EventIDFromContext(ctx context.Context) (id.EventID, bool) {
+	evtID, ok := ctx.Value(eventIDKey{}).(id.EventID)
+	return evtID, ok
+}
+
+// tracer returns the tracer of the global tracer provider, so the provider
+// can be set up after the bot is created
+func tracer() trace.Tracer {
+	return otel.Tracer(TracerName)
+}
+
+// eventAttributes returns the span attributes of an event
+func eventAttributes(evt *event.Event) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		AttrEventID.String(evt.ID.String()),
+		AttrRoomID.String(evt.RoomID.String()),
+		AttrEventType.String(evt.Type.Type),
+		AttrSender.String(evt.Sender.String()),
+	}
+}
+
+// recordError marks the span as failed with err, if it isn't nil
+func recordError(span trace.Span, err error) {
+	if err == nil {
+		return
+	}
+
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
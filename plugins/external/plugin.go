@@ -0,0 +1,497 @@
+// Package external runs plugins as separate executables. The bot talks to a
+// plugin process over its stdin and stdout with newline delimited JSON-RPC 2.0:
+// the process declares its routes and commands when initialized, is called
+// for the events and commands it handles, and calls back into the Bot API to
+// send messages, react and use its storage. Crashed processes are restarted
+// with backoff.
+package external
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+	"github.com/unerror/athenais/pkg/athenais"
+	"maunium.net/go/mautrix/event"
+)
+
+const (
+	// DefaultHandshakeTimeout is how long a process may take to answer the
+	// initialize request
+	DefaultHandshakeTimeout = 10 * time.Second
+
+	// DefaultMaxRestartBackoff is the longest wait before restarting a crashed
+	// process
+	DefaultMaxRestartBackoff = time.Minute
+
+	// minRestartBackoff is the first wait before restarting a crashed process
+	minRestartBackoff = time.Second
+
+	// stableAfter is how long a process must run for its backoff to reset
+	stableAfter = time.Minute
+)
+
+// ErrUnavailable is returned by handlers while the plugin process is down
+var ErrUnavailable = errors.New("plugin process is not running")
+
+// errStopping is returned by spawn when the plugin was stopped while the
+// process was starting
+var errStopping = errors.New("plugin is stopping")
+
+// Configuration configures a plugin process
+type Configuration struct {
+	// Command is the executable to run
+	Command string `yaml:"command"`
+
+	// Args are the arguments to run the executable with
+	Args []string `yaml:"args"`
+
+	// Env are extra environment variables for the process, as KEY=VALUE
+	Env []string `yaml:"env"`
+
+	// Dir is the working directory of the process
+	Dir string `yaml:"dir"`
+
+	// Settings are passed to the process in the initialize request
+	Settings map[string]any `yaml:"settings"`
+
+	// HandshakeTimeout is how long the process may take to initialize
+	HandshakeTimeout time.Duration `yaml:"handshake_timeout"`
+
+	// MaxRestartBackoff is the longest wait before restarting a crashed process
+	MaxRestartBackoff time.Duration `yaml:"max_restart_backoff"`
+}
+
+// Validate validates the configuration
+func (c *Configuration) Validate() error {
+	if c.Command == "" {
+		return errors.New("command is required")
+	}
+
+	if c.HandshakeTimeout <= 0 {
+		return errors.Errorf("handshake_timeout must be positive, got %s", c.HandshakeTimeout)
+	}
+
+	if c.MaxRestartBackoff < minRestartBackoff {
+		return errors.Errorf("max_restart_backoff must be at least %s, got %s", minRestartBackoff, c.MaxRestartBackoff)
+	}
+
+	return nil
+}
+
+// Plugin runs a plugin process
+type Plugin struct {
+	name string
+	cfg  *Configuration
+
+	// bot is the bot instance
+	bot *athenais.Bot
+
+	// log is the logger to use for logging
+	log *zerolog.Logger
+
+	// mu guards the running process
+	mu      sync.RWMutex
+	proc    *process
+	lastErr error
+
+	stopping chan struct{}
+	stopOnce sync.Once
+	started  atomic.Bool
+	done     chan struct{}
+}
+
+// process is a running plugin process
+type process struct {
+	cmd     *exec.Cmd
+	conn    *conn
+	stdin   io.Closer
+	started time.Time
+
+	// exited is closed once the process exited, after which err is set
+	exited chan struct{}
+	err    error
+}
+
+// Factory returns a factory for a plugin process registered under name,
+// configured by the name's section of the config file
+//
+//	athenais.Register("weather", external.Factory("weather"))
+func Factory(name string) athenais.Factory {
+	return func() athenais.Plugin {
+		return NewPlugin(name, Configuration{
+			HandshakeTimeout:  DefaultHandshakeTimeout,
+			MaxRestartBackoff: DefaultMaxRestartBackoff,
+		})
+	}
+}
+
+// NewPlugin creates a plugin running a plugin process
+func NewPlugin(name string, cfg Configuration) *Plugin {
+	return &Plugin{
+		name:     name,
+		cfg:      &cfg,
+		stopping: make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+func (p *Plugin) Name() string {
+	return p.name
+}
+
+// Config returns the configuration of the plugin, populated before Init
+func (p *Plugin) Config() any {
+	return p.cfg
+}
+
+func (p *Plugin) Init(bot *athenais.Bot, log *zerolog.Logger) {
+	p.log = log
+	p.bot = bot
+
+	p.log.Info().Str("command", p.cfg.Command).Msg("Initializing external plugin")
+	p.setErr(ErrUnavailable)
+}
+
+// Start runs the plugin process and supervises it, restarting it when it
+// crashes. The process is started here rather than in Init, so the database
+// is ready for the storage calls it makes. A process that fails to start is
+// retried like a crashed one.
+func (p *Plugin) Start(ctx context.Context) error {
+	if err := p.spawn(); err != nil {
+		p.log.Error().Err(err).Msg("Failed to start plugin process")
+		p.setErr(err)
+	}
+
+	p.started.Store(true)
+	go p.supervise(ctx)
+	return nil
+}
+
+// Stop asks the plugin process to exit, and kills it if it doesn't in time
+func (p *Plugin) Stop(ctx context.Context) error {
+	p.stopOnce.Do(func() { close(p.stopping) })
+
+	// wait for a restart in progress, so no process outlives the plugin
+	if p.started.Load() {
+		select {
+		case <-p.done:
+		case <-ctx.Done():
+		}
+	}
+
+	proc := p.current()
+	if proc == nil {
+		return nil
+	}
+
+	_ = proc.conn.notify(MethodShutdown, struct{}{})
+	_ = proc.stdin.Close()
+
+	select {
+	case <-proc.exited:
+		return nil
+	case <-ctx.Done():
+		_ = proc.cmd.Process.Kill()
+		<-proc.exited
+		return errors.Wrap(ctx.Err(), "plugin process did not exit in time")
+	}
+}
+
+// Health returns the reason the plugin process is not running, if it isn't
+func (p *Plugin) Health() error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if p.proc == nil {
+		if p.lastErr != nil {
+			return p.lastErr
+		}
+		return ErrUnavailable
+	}
+
+	return nil
+}
+
+func (p *Plugin) current() *process {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return p.proc
+}
+
+func (p *Plugin) setErr(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.proc = nil
+	p.lastErr = err
+}
+
+// spawn starts the plugin process, initializes it and registers the routes
+// and commands it declares
+func (p *Plugin) spawn() error {
+	cmd := exec.Command(p.cfg.Command, p.cfg.Args...)
+	cmd.Env = append(os.Environ(), p.cfg.Env...)
+	cmd.Dir = p.cfg.Dir
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return err
+	}
+
+	if err := cmd.Start(); err != nil {
+		return errors.Wrap(err, "failed to run plugin process")
+	}
+
+	proc := &process{
+		cmd:     cmd,
+		conn:    newConn(stdout, stdin, p.handleRequest),
+		stdin:   stdin,
+		started: time.Now(),
+		exited:  make(chan struct{}),
+	}
+
+	logged := make(chan struct{})
+	go func() {
+		defer close(logged)
+
+		s := bufio.NewScanner(stderr)
+		for s.Scan() {
+			p.log.Info().Str("stream", "stderr").Msg(s.Text())
+		}
+	}()
+
+	go func() {
+		if err := proc.conn.serve(context.Background()); err != nil {
+			// nothing drains stdout anymore, so the process could block on
+			// its writes and never exit
+			p.log.Error().Err(err).Msg("Failed to read from plugin process, killing it")
+			_ = cmd.Process.Kill()
+		}
+	}()
+
+	go func() {
+		// the pipes must be drained before waiting for the process
+		<-proc.conn.done
+		<-logged
+
+		proc.err = cmd.Wait()
+		close(proc.exited)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), p.cfg.HandshakeTimeout)
+	defer cancel()
+
+	manifest := &Manifest{}
+	if err := proc.conn.call(ctx, MethodInitialize, InitializeParams{
+		Name:     p.name,
+		UserID:   p.bot.ID(),
+		Settings: p.cfg.Settings,
+	}, manifest); err != nil {
+		_ = cmd.Process.Kill()
+		<-proc.exited
+		return errors.Wrap(err, "failed to initialize plugin process")
+	}
+
+	// Stop may have given up waiting for this spawn, so a process published
+	// now would never be stopped
+	p.mu.Lock()
+	select {
+	case <-p.stopping:
+		p.mu.Unlock()
+		_ = cmd.Process.Kill()
+		<-proc.exited
+		return errStopping
+	default:
+	}
+	p.proc = proc
+	p.lastErr = nil
+	p.mu.Unlock()
+
+	p.log.Info().
+		Int("pid", cmd.Process.Pid).
+		Int("routes", len(manifest.Routes)).
+		Int("commands", len(manifest.Commands)).
+		Msg("Plugin process started")
+
+	p.register(manifest)
+
+	return nil
+}
+
+// register replaces the plugin's routes and commands with those declared in
+// the manifest, as a restarted process may declare different ones
+func (p *Plugin) register(manifest *Manifest) {
+	p.bot.RemoveRoutes(p.name)
+	p.bot.RemoveCommands(p.name)
+
+	for _, spec := range manifest.Routes {
+		route, err := p.route(spec)
+		if err != nil {
+			p.log.Error().Err(err).Str("route", spec.Name).Msg("Failed to register route")
+			continue
+		}
+		p.bot.Route(route)
+	}
+
+	for _, spec := range manifest.Commands {
+		cmd, err := p.command(spec)
+		if err == nil {
+			err = p.bot.Command(cmd)
+		}
+		if err != nil {
+			p.log.Error().Err(err).Str("command", spec.Name).Msg("Failed to register command")
+		}
+	}
+}
+
+// supervise restarts the plugin process whenever it exits, until the plugin
+// is stopped. While the process is down its routes and commands stay
+// registered, and fail with ErrUnavailable.
+func (p *Plugin) supervise(ctx context.Context) {
+	defer close(p.done)
+
+	backoff := minRestartBackoff
+	for {
+		if proc := p.current(); proc != nil {
+			select {
+			case <-proc.exited:
+			case <-p.stopping:
+				return
+			}
+
+			if time.Since(proc.started) > stableAfter {
+				backoff = minRestartBackoff
+			}
+
+			err := proc.err
+			if err == nil {
+				err = errors.New("plugin process exited")
+			}
+			p.setErr(err)
+		}
+
+		select {
+		case <-p.stopping:
+			return
+		default:
+		}
+
+		p.log.Warn().Err(p.Health()).Dur("backoff", backoff).Msg("Plugin process is down, restarting")
+
+		select {
+		case <-time.After(backoff):
+		case <-p.stopping:
+			return
+		case <-ctx.Done():
+			return
+		}
+
+		backoff *= 2
+		if backoff > p.cfg.MaxRestartBackoff {
+			backoff = p.cfg.MaxRestartBackoff
+		}
+
+		if err := p.spawn(); errors.Is(err, errStopping) {
+			return
+		} else if err != nil {
+			p.log.Error().Err(err).Msg("Failed to restart plugin process")
+			p.setErr(err)
+		}
+	}
+}
+
+// call calls a method on the running plugin process
+func (p *Plugin) call(ctx context.Context, method string, params any) error {
+	proc := p.current()
+	if proc == nil {
+		return ErrUnavailable
+	}
+
+	return proc.conn.call(ctx, method, params, nil)
+}
+
+// route creates a route for a route declared by the plugin process
+func (p *Plugin) route(spec RouteSpec) (athenais.Route, error) {
+	route, err := athenais.RouteSpec{
+		Name:       p.name + "." + spec.Name,
+		EventType:  spec.EventType,
+		MsgTypes:   spec.MsgTypes,
+		BodyRegex:  spec.BodyRegex,
+		Rooms:      spec.Rooms,
+		Senders:    spec.Senders,
+		Addressed:  spec.Addressed,
+		Permission: spec.Permission.permission(),
+	}.Route(p.bot)
+	if err != nil {
+		return route, err
+	}
+
+	route.Plugin = p.name
+	route.MatchHandler = func(ctx context.Context, evt *event.Event, m *athenais.Match) error {
+		return p.call(ctx, MethodHandleEvent, HandleEventParams{
+			Route:  spec.Name,
+			Event:  evt,
+			Groups: m.Groups,
+			Named:  m.Named,
+		})
+	}
+
+	return route, nil
+}
+
+// command creates a command for a command declared by the plugin process
+func (p *Plugin) command(spec CommandSpec) (athenais.Command, error) {
+	cmd := athenais.Command{
+		Name:       spec.Name,
+		Aliases:    spec.Aliases,
+		Prefix:     spec.Prefix,
+		Usage:      spec.Usage,
+		Plugin:     p.name,
+		Permission: spec.Permission.permission(),
+		Handler: func(ctx context.Context, cc *athenais.CommandContext) error {
+			return p.call(ctx, MethodHandleCommand, HandleCommandParams{
+				Command: spec.Name,
+				Invoked: cc.Invoked,
+				Event:   cc.Event,
+				Values:  cc.Values,
+			})
+		},
+	}
+
+	for _, a := range spec.Args {
+		t, err := athenais.ParseArgType(a.Type)
+		if err != nil {
+			return cmd, errors.Wrapf(err, "invalid argument %s", a.Name)
+		}
+		cmd.Args = append(cmd.Args, athenais.Arg{Name: a.Name, Type: t, Optional: a.Optional, Rest: a.Rest})
+	}
+
+	for _, f := range spec.Flags {
+		t, err := athenais.ParseArgType(f.Type)
+		if err != nil {
+			return cmd, errors.Wrapf(err, "invalid flag %s", f.Name)
+		}
+		cmd.Flags = append(cmd.Flags, athenais.Flag{Name: f.Name, Type: t, Default: f.Default, Usage: f.Usage})
+	}
+
+	return cmd, nil
+}
@@ -0,0 +1,246 @@
+package external
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/unerror/athenais/pkg/athenais"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// Methods the bot calls on plugin processes
+const (
+	// MethodInitialize is called once the process started, and returns its
+	// Manifest
+	MethodInitialize = "initialize"
+
+	// MethodHandleEvent is called for events matching a route of the plugin
+	MethodHandleEvent = "handle_event"
+
+	// MethodHandleCommand is called for invocations of a command of the plugin
+	MethodHandleCommand = "handle_command"
+
+	// MethodShutdown is a notification asking the process to exit
+	MethodShutdown = "shutdown"
+)
+
+// InitializeParams are the params of the initialize request
+type InitializeParams struct {
+	// Name is the name the plugin is registered under
+	Name string `json:"name"`
+
+	// UserID is the Matrix ID of the bot
+	UserID id.UserID `json:"user_id"`
+
+	// Settings are the plugin's settings from the config file
+	Settings map[string]any `json:"settings,omitempty"`
+}
+
+// Manifest declares the routes and commands of a plugin process
+type Manifest struct {
+	Routes   []RouteSpec   `json:"routes"`
+	Commands []CommandSpec `json:"commands"`
+}
+
+// PermissionSpec declares the permission needed to trigger a route or command
+type PermissionSpec struct {
+	PowerLevel int    `json:"power_level,omitempty"`
+	Name       string `json:"name,omitempty"`
+	Admin      bool   `json:"admin,omitempty"`
+}
+
+// RouteSpec declares a route. All matchers that are set must match.
+type RouteSpec struct {
+	// Name identifies the route in handle_event requests
+	Name string `json:"name"`
+
+	// EventType is the event type to match. Defaults to m.room.message.
+	EventType string `json:"event_type,omitempty"`
+
+	// MsgTypes are the message types to match, e.g. m.text
+	MsgTypes []string `json:"msg_types,omitempty"`
+
+	// BodyRegex is a regular expression the body must match. Its groups are
+	// passed in handle_event requests.
+	BodyRegex string `json:"body_regex,omitempty"`
+
+	// Rooms are the room IDs to match
+	Rooms []string `json:"rooms,omitempty"`
+
+	// Senders are the sender globs to match, e.g. @*:example.com
+	Senders []string `json:"senders,omitempty"`
+
+	// Addressed only matches messages mentioning or replying to the bot
+	Addressed bool `json:"addressed,omitempty"`
+
+	Permission PermissionSpec `json:"permission"`
+}
+
+// ArgSpec declares a command argument
+type ArgSpec struct {
+	Name     string `json:"name"`
+	Type     string `json:"type,omitempty"`
+	Optional bool   `json:"optional,omitempty"`
+	Rest     bool   `json:"rest,omitempty"`
+}
+
+// FlagSpec declares a command flag
+type FlagSpec struct {
+	Name    string `json:"name"`
+	Type    string `json:"type,omitempty"`
+	Default string `json:"default,omitempty"`
+	Usage   string `json:"usage,omitempty"`
+}
+
+// CommandSpec declares a command
+type CommandSpec struct {
+	Name    string     `json:"name"`
+	Aliases []string   `json:"aliases,omitempty"`
+	Prefix  string     `json:"prefix,omitempty"`
+	Usage   string     `json:"usage,omitempty"`
+	Args    []ArgSpec  `json:"args,omitempty"`
+	Flags   []FlagSpec `json:"flags,omitempty"`
+
+	Permission PermissionSpec `json:"permission"`
+}
+
+// HandleEventParams are the params of the handle_event request
+type HandleEventParams struct {
+	Route  string            `json:"route"`
+	Event  *event.Event      `json:"event"`
+	Groups []string          `json:"groups,omitempty"`
+	Named  map[string]string `json:"named,omitempty"`
+}
+
+// HandleCommandParams are the params of the handle_command request. Duration
+// values are in nanoseconds.
+type HandleCommandParams struct {
+	Command string         `json:"command"`
+	Invoked string         `json:"invoked"`
+	Event   *event.Event   `json:"event"`
+	Values  map[string]any `json:"values"`
+}
+
+// Bot API params, for the methods plugin processes call on the bot
+
+type sendParams struct {
+	RoomID id.RoomID `json:"room_id"`
+	Text   string    `json:"text"`
+}
+
+type replyParams struct {
+	Event    *event.Event `json:"event"`
+	Markdown string       `json:"markdown"`
+}
+
+type reactParams struct {
+	RoomID  id.RoomID  `json:"room_id"`
+	EventID id.EventID `json:"event_id"`
+	Key     string     `json:"key"`
+}
+
+type storageParams struct {
+	Key    string `json:"key"`
+	Prefix string `json:"prefix"`
+	Value  []byte `json:"value"`
+	TTLMS  int64  `json:"ttl_ms"`
+}
+
+type sendResult struct {
+	EventID id.EventID `json:"event_id"`
+}
+
+type storageEntry struct {
+	Key       string `json:"key"`
+	Value     []byte `json:"value"`
+	ExpiresAt int64  `json:"expires_at,omitempty"`
+}
+
+func (p PermissionSpec) permission() athenais.Permission {
+	return athenais.Permission{PowerLevel: p.PowerLevel, Name: p.Name, Admin: p.Admin}
+}
+
+// handleRequest serves the Bot API to the plugin process
+func (p *Plugin) handleRequest(ctx context.Context, method string, params json.RawMessage) (any, error) {
+	switch method {
+	case "send_text", "send_notice", "send_markdown":
+		var sp sendParams
+		if err := json.Unmarshal(params, &sp); err != nil {
+			return nil, &RPCError{Code: codeInvalidParams, Message: err.Error()}
+		}
+
+		send := p.bot.SendText
+		switch method {
+		case "send_notice":
+			send = p.bot.SendNotice
+		case "send_markdown":
+			send = p.bot.SendMarkdown
+		}
+
+		evtID, err := send(ctx, sp.RoomID, sp.Text)
+		return sendResult{EventID: evtID}, err
+	case "reply":
+		var rp replyParams
+		if err := json.Unmarshal(params, &rp); err != nil || rp.Event == nil {
+			return nil, &RPCError{Code: codeInvalidParams, Message: "reply needs the event to reply to"}
+		}
+		_ = rp.Event.Content.ParseRaw(rp.Event.Type)
+
+		evtID, err := p.bot.Reply(ctx, rp.Event, rp.Markdown)
+		return sendResult{EventID: evtID}, err
+	case "react":
+		var rp reactParams
+		if err := json.Unmarshal(params, &rp); err != nil {
+			return nil, &RPCError{Code: codeInvalidParams, Message: err.Error()}
+		}
+
+		evtID, err := p.bot.React(ctx, rp.RoomID, rp.EventID, rp.Key)
+		return sendResult{EventID: evtID}, err
+	case "storage_get", "storage_put", "storage_delete", "storage_list":
+		var sp storageParams
+		if err := json.Unmarshal(params, &sp); err != nil {
+			return nil, &RPCError{Code: codeInvalidParams, Message: err.Error()}
+		}
+
+		return p.handleStorage(ctx, method, sp)
+	default:
+		return nil, &RPCError{Code: codeMethodNotFound, Message: "unknown method: " + method}
+	}
+}
+
+func (p *Plugin) handleStorage(ctx context.Context, method string, sp storageParams) (any, error) {
+	store := p.bot.Storage(p.name)
+
+	switch method {
+	case "storage_get":
+		value, err := store.Get(ctx, sp.Key)
+		if errors.Is(err, athenais.ErrNotFound) {
+			return map[string]any{"found": false}, nil
+		} else if err != nil {
+			return nil, err
+		}
+		return map[string]any{"found": true, "value": value}, nil
+	case "storage_put":
+		return struct{}{}, store.Put(ctx, sp.Key, sp.Value, time.Duration(sp.TTLMS)*time.Millisecond)
+	case "storage_delete":
+		return struct{}{}, store.Delete(ctx, sp.Key)
+	default:
+		entries, err := store.List(ctx, sp.Prefix)
+		if err != nil {
+			return nil, err
+		}
+
+		out := make([]storageEntry, 0, len(entries))
+		for _, e := range entries {
+			se := storageEntry{Key: e.Key, Value: e.Value}
+			if !e.ExpiresAt.IsZero() {
+				se.ExpiresAt = e.ExpiresAt.UnixMilli()
+			}
+			out = append(out, se)
+		}
+		return map[string]any{"entries": out}, nil
+	}
+}
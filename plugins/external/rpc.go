@@ -0,0 +1,198 @@
+package external
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"strconv"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// ErrClosed is returned by calls to a plugin process that exited
+var ErrClosed = errors.New("plugin process exited")
+
+// JSON-RPC error codes
+const (
+	codeMethodNotFound = -32601
+	codeInvalidParams  = -32602
+	codeInternal       = -32603
+)
+
+// message is a JSON-RPC 2.0 request, notification or response
+type message struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method,omitempty"`
+	Params  json.RawMessage `json:"params,omitempty"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *RPCError       `json:"error,omitempty"`
+}
+
+// RPCError is a JSON-RPC error
+type RPCError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *RPCError) Error() string {
+	return e.Message
+}
+
+// handlerFunc handles a request from the plugin process
+type handlerFunc func(ctx context.Context, method string, params json.RawMessage) (any, error)
+
+// conn is a bidirectional JSON-RPC 2.0 connection over newline delimited JSON.
+// Both sides can send requests.
+type conn struct {
+	w   io.Writer
+	wmu sync.Mutex
+
+	r       *bufio.Scanner
+	handler handlerFunc
+
+	mu      sync.Mutex
+	nextID  int64
+	pending map[string]chan *message
+
+	done chan struct{}
+}
+
+func newConn(r io.Reader, w io.Writer, handler handlerFunc) *conn {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+	return &conn{
+		w:       w,
+		r:       scanner,
+		handler: handler,
+		pending: make(map[string]chan *message),
+		done:    make(chan struct{}),
+	}
+}
+
+// serve reads messages until the connection is closed. Requests are handled
+// with ctx. The read error is returned, nil if the connection was closed.
+func (c *conn) serve(ctx context.Context) error {
+	defer close(c.done)
+
+	for c.r.Scan() {
+		msg := &message{}
+		if err := json.Unmarshal(c.r.Bytes(), msg); err != nil {
+			continue
+		}
+
+		if msg.Method != "" {
+			go c.handle(ctx, msg)
+			continue
+		}
+
+		c.mu.Lock()
+		ch, ok := c.pending[string(msg.ID)]
+		delete(c.pending, string(msg.ID))
+		c.mu.Unlock()
+
+		if ok {
+			ch <- msg
+		}
+	}
+
+	return c.r.Err()
+}
+
+// handle handles a request, responding unless it is a notification
+func (c *conn) handle(ctx context.Context, req *message) {
+	result, err := c.handler(ctx, req.Method, req.Params)
+	if req.ID == nil {
+		return
+	}
+
+	resp := &message{JSONRPC: "2.0", ID: req.ID}
+	if err != nil {
+		var rerr *RPCError
+		if !errors.As(err, &rerr) {
+			rerr = &RPCError{Code: codeInternal, Message: err.Error()}
+		}
+		resp.Error = rerr
+	} else {
+		data, err := json.Marshal(result)
+		if err != nil {
+			resp.Error = &RPCError{Code: codeInternal, Message: err.Error()}
+		} else {
+			resp.Result = data
+		}
+	}
+
+	_ = c.write(resp)
+}
+
+// call sends a request and decodes its result into result, if not nil
+func (c *conn) call(ctx context.Context, method string, params, result any) error {
+	data, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	c.nextID++
+	id := json.RawMessage(strconv.FormatInt(c.nextID, 10))
+	ch := make(chan *message, 1)
+	c.pending[string(id)] = ch
+	c.mu.Unlock()
+
+	defer func() {
+		c.mu.Lock()
+		delete(c.pending, string(id))
+		c.mu.Unlock()
+	}()
+
+	if err := c.write(&message{JSONRPC: "2.0", ID: id, Method: method, Params: data}); err != nil {
+		return err
+	}
+
+	select {
+	case resp := <-ch:
+		if resp.Error != nil {
+			return resp.Error
+		}
+		if result != nil {
+			return json.Unmarshal(resp.Result, result)
+		}
+		return nil
+	case <-c.done:
+		return ErrClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// notify sends a notification, which has no response
+func (c *conn) notify(method string, params any) error {
+	data, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+
+	return c.write(&message{JSONRPC: "2.0", Method: method, Params: data})
+}
+
+func (c *conn) write(msg *message) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	select {
+	case <-c.done:
+		return ErrClosed
+	default:
+	}
+
+	_, err = c.w.Write(append(data, '\n'))
+	return err
+}
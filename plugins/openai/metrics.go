@@ -0,0 +1,56 @@
+package openai
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/unerror/athenais/pkg/athenais"
+)
+
+const (
+	endpointChat       = "chat_completion"
+	endpointModeration = "moderation"
+)
+
+var (
+	requests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: athenais.MetricsNamespace,
+		Subsystem: "openai",
+		Name:      "requests_total",
+		Help:      "Requests to the OpenAI API, by endpoint and result.",
+	}, []string{"endpoint", "result"})
+
+	requestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: athenais.MetricsNamespace,
+		Subsystem: "openai",
+		Name:      "request_duration_seconds",
+		Help:      "Time requests to the OpenAI API take, by endpoint.",
+		Buckets:   []float64{.1, .25, .5, 1, 2.5, 5, 10, 30, 60},
+	}, []string{"endpoint"})
+
+	tokens = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: athenais.MetricsNamespace,
+		Subsystem: "openai",
+		Name:      "tokens_total",
+		Help:      "Tokens used by chat completions, by kind (prompt or completion).",
+	}, []string{"kind"})
+
+	moderationFlagged = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: athenais.MetricsNamespace,
+		Subsystem: "openai",
+		Name:      "moderation_flagged_total",
+		Help:      "Prompts flagged by moderation, and not sent for completion.",
+	})
+)
+
+// observe records a request to an endpoint that started at start
+func observe(endpoint string, start time.Time, err error) {
+	result := "success"
+	if err != nil {
+		result = "error"
+	}
+
+	requests.WithLabelValues(endpoint, result).Inc()
+	requestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds())
+}
@@ -3,9 +3,15 @@ package openai
 import (
 	"context"
 	"fmt"
+	"time"
 
 	"github.com/rs/zerolog"
 	"github.com/sashabaranov/go-openai"
+	"github.com/unerror/athenais/pkg/athenais"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
 const (
@@ -16,6 +22,9 @@ const (
 	DefaultChance = 50
 )
 
+// tracer traces requests to the OpenAI API
+var tracer = otel.Tracer("github.com/unerror/athenais/plugins/openai")
+
 // Client is an OpenAI client
 type Client struct {
 	*openai.Client
@@ -69,12 +78,30 @@ func NewClient(apiKey string, opts ...Option) *Client {
 }
 
 func (c *Client) Prompt(ctx context.Context, prompt string) (string, error) {
+	ctx, span := tracer.Start(ctx, "openai.prompt", eventAttribute(ctx))
+	defer span.End()
+
 	c.log.Debug().Str("prompt", prompt).Str("sys_prompt", c.sysPrompt).Msg("prompting")
 	err := c.moderate(ctx, prompt)
 	if err != nil {
+		recordError(span, err)
 		return "", err
 	}
 
+	out, err := c.complete(ctx, prompt)
+	recordError(span, err)
+
+	return out, err
+}
+
+// complete creates a chat completion for the prompt
+func (c *Client) complete(ctx context.Context, prompt string) (string, error) {
+	ctx, span := tracer.Start(ctx, "openai.chat_completion", eventAttribute(ctx), trace.WithAttributes(
+		attribute.String("openai.model", openai.GPT3Dot5Turbo),
+	))
+	defer span.End()
+
+	start := time.Now()
 	resp, err := c.CreateChatCompletion(ctx, openai.ChatCompletionRequest{
 		Model:     openai.GPT3Dot5Turbo,
 		MaxTokens: 100,
@@ -89,26 +116,66 @@ func (c *Client) Prompt(ctx context.Context, prompt string) (string, error) {
 			},
 		},
 	})
+	observe(endpointChat, start, err)
 	if err != nil {
+		recordError(span, err)
 		return "", err
 	}
 
+	tokens.WithLabelValues("prompt").Add(float64(resp.Usage.PromptTokens))
+	tokens.WithLabelValues("completion").Add(float64(resp.Usage.CompletionTokens))
+	span.SetAttributes(
+		attribute.Int("openai.usage.prompt_tokens", resp.Usage.PromptTokens),
+		attribute.Int("openai.usage.completion_tokens", resp.Usage.CompletionTokens),
+	)
+
 	return resp.Choices[0].Message.Content, nil
 }
 
 func (c *Client) moderate(ctx context.Context, input string) error {
+	ctx, span := tracer.Start(ctx, "openai.moderate", eventAttribute(ctx))
+	defer span.End()
+
+	start := time.Now()
 	mods, err := c.Moderations(ctx, openai.ModerationRequest{
 		Input: input,
 	})
+	observe(endpointModeration, start, err)
 	if err != nil {
+		recordError(span, err)
 		return err
 	}
 
 	for _, mod := range mods.Results {
 		if mod.Flagged {
+			moderationFlagged.Inc()
+			span.SetAttributes(attribute.Bool("openai.moderation.flagged", true))
 			return fmt.Errorf("moderation flagged input")
 		}
 	}
 
+	span.SetAttributes(attribute.Bool("openai.moderation.flagged", false))
+
 	return nil
 }
+
+// eventAttribute returns the span option carrying the ID of the event being
+// handled with ctx, if any
+func eventAttribute(ctx context.Context) trace.SpanStartOption {
+	var attrs []attribute.KeyValue
+	if evtID, ok := athenais.EventIDFromContext(ctx); ok {
+		attrs = append(attrs, athenais.AttrEventID.String(evtID.String()))
+	}
+
+	return trace.WithAttributes(attrs...)
+}
+
+// recordError marks the span as failed with err, if it isn't nil
+func recordError(span trace.Span, err error) {
+	if err == nil {
+		return
+	}
+
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
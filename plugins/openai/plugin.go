@@ -3,6 +3,8 @@ package openai
 import (
 	"context"
 	"math/rand"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/pkg/errors"
@@ -25,34 +27,54 @@ type Plugin struct {
 	// log is the logger to use for logging
 	log *zerolog.Logger
 
-	r *rand.Rand
+	// r is guarded by mu, as events from different rooms are handled
+	// concurrently, and so are cfg and client, which are replaced on reload
+	r  *rand.Rand
+	mu sync.Mutex
 
 	cfg *Configuration
 }
 
 type Configuration struct {
 	// Prompt is the system Prompt to use to prime responses
-	Prompt string
+	Prompt string `yaml:"prompt" env:"OPENAI_PROMPT"`
 
 	// Chance is the Chance to respond to a message
-	Chance int
+	Chance int `yaml:"chance" env:"OPENAI_CHANCE"`
 
 	// APIKey is the API key for OpenAI
-	APIKey string
+	APIKey string `yaml:"api_key" env:"OPEN_AI_KEY"`
+}
+
+// Validate validates the configuration
+func (c *Configuration) Validate() error {
+	if c.APIKey == "" {
+		return errors.New("api_key is required, set it in the config file or with $OPEN_AI_KEY, or leave openai out of --plugins")
+	}
+
+	if c.Chance < 0 || c.Chance > 100 {
+		return errors.Errorf("chance must be between 0 and 100, got %d", c.Chance)
+	}
+
+	return nil
+}
+
+func init() {
+	athenais.Register("openai", func() athenais.Plugin {
+		return NewPlugin(Configuration{
+			Prompt: DefaultPrompt,
+			Chance: DefaultChance,
+		})
+	})
 }
 
 // NewPlugin creates a new OpenAI plugin
 func NewPlugin(cfg Configuration) *Plugin {
 	r := rand.New(rand.NewSource(time.Now().UnixNano()))
-	aiClient := NewClient(
-		cfg.APIKey,
-		WithPrompt(cfg.Prompt),
-	)
 
 	return &Plugin{
-		client: aiClient,
-		r:      r,
-		cfg:    &cfg,
+		r:   r,
+		cfg: &cfg,
 	}
 }
 
@@ -60,35 +82,88 @@ func (p *Plugin) Name() string {
 	return "openai"
 }
 
+// Config returns the configuration of the plugin, populated before Init
+func (p *Plugin) Config() any {
+	return p.cfg
+}
+
 func (p *Plugin) Init(bot *athenais.Bot, log *zerolog.Logger) {
 	p.log = log
 	p.bot = bot
 
 	p.log.Info().Msg("Initializing OpenAI plugin")
 
+	p.client = NewClient(
+		p.cfg.APIKey,
+		WithPrompt(p.cfg.Prompt),
+		WithLogger(log),
+	)
+
 	bot.Route(
 		athenais.Route{
 			Handler:   p.handleMessage,
 			EventType: event.EventMessage,
+			Matchers: []athenais.Matcher{
+				athenais.MsgTypes(event.MsgText),
+			},
 		},
 	)
 }
 
-func (p *Plugin) handleMessage(evt *event.Event) error {
+// Reload applies a new configuration
+func (p *Plugin) Reload(_ context.Context, cfg any) error {
+	c, ok := cfg.(*Configuration)
+	if !ok {
+		return errors.Errorf("unexpected configuration type %T", cfg)
+	}
+
+	client := NewClient(
+		c.APIKey,
+		WithPrompt(c.Prompt),
+		WithLogger(p.log),
+	)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.cfg = c
+	p.client = client
+
+	return nil
+}
+
+func (p *Plugin) handleMessage(ctx context.Context, evt *event.Event) error {
 	msg := evt.Content.AsMessage()
 
-	if msg.MsgType == event.MsgText {
+	p.mu.Lock()
+	cfg, client := p.cfg, p.client
+	p.mu.Unlock()
+
+	if !p.bot.IsCommand(evt) {
+		chance := cfg.Chance
+		if v, ok := p.bot.RoomSetting(ctx, evt.RoomID, p.Name(), "chance"); ok {
+			if c, err := strconv.Atoi(v); err == nil {
+				chance = c
+			}
+		}
+
+		p.mu.Lock()
 		r := p.r.Int() % 100
+		p.mu.Unlock()
 		p.log.Info().Int("r", r).Msg("Random number")
-		if r < p.cfg.Chance {
+		if r < chance && p.bot.AllowResponse(ctx, evt) {
 			p.log.Debug().Str("msg", msg.Body).Msg("Responding to message")
-			out, err := p.client.Prompt(context.Background(), msg.Body)
+
+			stop := p.bot.Typing(ctx, evt.RoomID)
+			defer stop()
+
+			out, err := client.Prompt(ctx, msg.Body)
 			if err != nil {
 				p.log.Error().Err(err).Msg("Failed to generate response")
 				return errors.Wrap(err, "failed to generate response")
 			}
 
-			if err := p.bot.SendText(evt.RoomID, out); err != nil {
+			if _, err := p.bot.Reply(ctx, evt, out); err != nil && !errors.Is(err, athenais.ErrQueued) {
 				return errors.Wrap(err, "failed to send message")
 			}
 		}
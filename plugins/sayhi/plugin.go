@@ -1,9 +1,10 @@
 package sayhi
 
 import (
+	"context"
+
 	"github.com/rs/zerolog"
 	"github.com/unerror/athenais/pkg/athenais"
-	"maunium.net/go/mautrix/event"
 )
 
 type Plugin struct {
@@ -14,6 +15,12 @@ type Plugin struct {
 	log *zerolog.Logger
 }
 
+func init() {
+	athenais.Register("sayhi", func() athenais.Plugin {
+		return NewPlugin()
+	})
+}
+
 // NewPlugin creates a new SayHi plugin
 func NewPlugin() *Plugin {
 	return &Plugin{}
@@ -29,24 +36,19 @@ func (p *Plugin) Init(bot *athenais.Bot, log *zerolog.Logger) {
 
 	p.log.Info().Msg("Initializing SayHi plugin")
 
-	bot.Route(
-		athenais.Route{
-			Handler:   p.handleMessage,
-			EventType: event.EventMessage,
-		},
-	)
+	if err := bot.Command(athenais.Command{
+		Name:    "say",
+		Aliases: []string{"hi"},
+		Usage:   "Say hello",
+		Handler: p.handleSay,
+	}); err != nil {
+		p.log.Error().Err(err).Msg("Failed to register command")
+	}
 }
 
-func (p *Plugin) handleMessage(evt *event.Event) error {
-	msg := evt.Content.AsMessage()
-
-	p.log.Debug().Str("msg", msg.Body).Msg("Received message")
-
-	if msg.MsgType == event.MsgText {
-		if msg.Body == "!say" {
-			p.bot.SendText(evt.RoomID, "Hello!")
-		}
-	}
+func (p *Plugin) handleSay(ctx context.Context, cc *athenais.CommandContext) error {
+	p.log.Debug().Str("command", cc.Invoked).Msg("Received command")
 
-	return nil
+	_, err := p.bot.Reply(ctx, cc.Event, "Hello!")
+	return err
 }
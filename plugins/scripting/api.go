@@ -0,0 +1,514 @@
+package scripting
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/unerror/athenais/pkg/athenais"
+	"go.starlark.net/lib/json"
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// Thread locals
+const (
+	// localContext is the context of a handler call
+	localContext = "context"
+
+	// localScript is the script being loaded, which routes and commands are
+	// registered on
+	localScript = "script"
+
+	// localStorage is the storage of the script being run
+	localStorage = "storage"
+)
+
+// predeclared returns the names available to scripts
+func (p *Plugin) predeclared() starlark.StringDict {
+	return starlark.StringDict{
+		"bot": &starlarkstruct.Module{
+			Name: "bot",
+			Members: starlark.StringDict{
+				"id":       starlark.String(p.bot.ID()),
+				"route":    starlark.NewBuiltin("bot.route", p.builtinRoute),
+				"command":  starlark.NewBuiltin("bot.command", p.builtinCommand),
+				"send":     starlark.NewBuiltin("bot.send", p.builtinSend),
+				"notice":   starlark.NewBuiltin("bot.notice", p.builtinSend),
+				"markdown": starlark.NewBuiltin("bot.markdown", p.builtinSend),
+				"reply":    starlark.NewBuiltin("bot.reply", p.builtinReply),
+				"react":    starlark.NewBuiltin("bot.react", p.builtinReact),
+			},
+		},
+		"storage": &starlarkstruct.Module{
+			Name: "storage",
+			Members: starlark.StringDict{
+				"get":    starlark.NewBuiltin("storage.get", builtinStorageGet),
+				"put":    starlark.NewBuiltin("storage.put", builtinStoragePut),
+				"delete": starlark.NewBuiltin("storage.delete", builtinStorageDelete),
+				"list":   starlark.NewBuiltin("storage.list", builtinStorageList),
+			},
+		},
+		"json": json.Module,
+	}
+}
+
+// loading returns the script being loaded, for builtins that may only be
+// called at the top level of a script
+func loading(thread *starlark.Thread, fn *starlark.Builtin) (*script, error) {
+	s, ok := thread.Local(localScript).(*script)
+	if !ok {
+		return nil, errors.Errorf("%s: can only be called while the script loads", fn.Name())
+	}
+	return s, nil
+}
+
+// handling returns the context of the handler being run, for builtins that
+// may only be called from handlers
+func handling(thread *starlark.Thread, fn *starlark.Builtin) (context.Context, error) {
+	ctx, ok := thread.Local(localContext).(context.Context)
+	if !ok {
+		return nil, errors.Errorf("%s: can only be called from handlers", fn.Name())
+	}
+	return ctx, nil
+}
+
+func (p *Plugin) builtinRoute(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	s, err := loading(thread, fn)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		handler                     starlark.Callable
+		name, bodyRegex, permission string
+		eventType                   = event.EventMessage.Type
+		msgTypes, rooms, senders    *starlark.List
+		addressed, admin            bool
+		powerLevel                  int
+	)
+	if err := starlark.UnpackArgs(fn.Name(), args, kwargs,
+		"handler", &handler,
+		"name?", &name,
+		"event_type?", &eventType,
+		"msg_types?", &msgTypes,
+		"body_regex?", &bodyRegex,
+		"rooms?", &rooms,
+		"senders?", &senders,
+		"addressed?", &addressed,
+		"power_level?", &powerLevel,
+		"permission?", &permission,
+		"admin?", &admin,
+	); err != nil {
+		return nil, err
+	}
+
+	if name == "" {
+		name = fmt.Sprintf("route#%d", len(s.routes))
+	}
+
+	spec := athenais.RouteSpec{
+		Name:       name,
+		EventType:  eventType,
+		BodyRegex:  bodyRegex,
+		Addressed:  addressed,
+		Permission: athenais.Permission{PowerLevel: powerLevel, Name: permission, Admin: admin},
+	}
+	if spec.MsgTypes, err = stringList(fn, "msg_types", msgTypes); err != nil {
+		return nil, err
+	}
+	if spec.Rooms, err = stringList(fn, "rooms", rooms); err != nil {
+		return nil, err
+	}
+	if spec.Senders, err = stringList(fn, "senders", senders); err != nil {
+		return nil, err
+	}
+
+	route, err := spec.Route(p.bot)
+	if err != nil {
+		return nil, errors.Wrap(err, fn.Name())
+	}
+
+	s.routes = append(s.routes, scriptRoute{route: route, handler: handler})
+
+	return starlark.None, nil
+}
+
+func (p *Plugin) builtinCommand(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	s, err := loading(thread, fn)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		handler                         starlark.Callable
+		name, prefix, usage, permission string
+		aliases, cmdArgs, flags         *starlark.List
+		admin                           bool
+		powerLevel                      int
+	)
+	if err := starlark.UnpackArgs(fn.Name(), args, kwargs,
+		"name", &name,
+		"handler", &handler,
+		"aliases?", &aliases,
+		"prefix?", &prefix,
+		"usage?", &usage,
+		"args?", &cmdArgs,
+		"flags?", &flags,
+		"power_level?", &powerLevel,
+		"permission?", &permission,
+		"admin?", &admin,
+	); err != nil {
+		return nil, err
+	}
+
+	cmd := athenais.Command{
+		Name:       name,
+		Prefix:     prefix,
+		Usage:      usage,
+		Permission: athenais.Permission{PowerLevel: powerLevel, Name: permission, Admin: admin},
+	}
+
+	if cmd.Aliases, err = stringList(fn, "aliases", aliases); err != nil {
+		return nil, err
+	}
+
+	specs, err := stringList(fn, "args", cmdArgs)
+	if err != nil {
+		return nil, err
+	}
+	for _, spec := range specs {
+		arg, err := parseArg(spec)
+		if err != nil {
+			return nil, errors.Wrapf(err, "%s: invalid argument %q", fn.Name(), spec)
+		}
+		cmd.Args = append(cmd.Args, arg)
+	}
+
+	if specs, err = stringList(fn, "flags", flags); err != nil {
+		return nil, err
+	}
+	for _, spec := range specs {
+		flag, err := parseFlag(spec)
+		if err != nil {
+			return nil, errors.Wrapf(err, "%s: invalid flag %q", fn.Name(), spec)
+		}
+		cmd.Flags = append(cmd.Flags, flag)
+	}
+
+	s.commands = append(s.commands, scriptCommand{command: cmd, handler: handler})
+
+	return starlark.None, nil
+}
+
+// parseArg parses an argument spec: name, name:type, name? for an optional
+// argument, or name... for an argument taking the rest of the input
+func parseArg(spec string) (athenais.Arg, error) {
+	var arg athenais.Arg
+
+	if strings.HasSuffix(spec, "?") {
+		arg.Optional = true
+		spec = strings.TrimSuffix(spec, "?")
+	}
+
+	if strings.HasSuffix(spec, "...") {
+		arg.Rest = true
+		spec = strings.TrimSuffix(spec, "...")
+	}
+
+	name, typ, _ := strings.Cut(spec, ":")
+	t, err := athenais.ParseArgType(typ)
+	if err != nil {
+		return arg, err
+	}
+
+	arg.Name = name
+	arg.Type = t
+	return arg, nil
+}
+
+// parseFlag parses a flag spec: name, name:type or name:type=default
+func parseFlag(spec string) (athenais.Flag, error) {
+	var flag athenais.Flag
+
+	spec, flag.Default, _ = strings.Cut(spec, "=")
+
+	name, typ, _ := strings.Cut(spec, ":")
+	t, err := athenais.ParseArgType(typ)
+	if err != nil {
+		return flag, err
+	}
+
+	flag.Name = name
+	flag.Type = t
+	return flag, nil
+}
+
+// builtinSend implements bot.send, bot.notice and bot.markdown
+func (p *Plugin) builtinSend(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	ctx, err := handling(thread, fn)
+	if err != nil {
+		return nil, err
+	}
+
+	var roomID, text string
+	if err := starlark.UnpackPositionalArgs(fn.Name(), args, kwargs, 2, &roomID, &text); err != nil {
+		return nil, err
+	}
+
+	send := p.bot.SendText
+	switch fn.Name() {
+	case "bot.notice":
+		send = p.bot.SendNotice
+	case "bot.markdown":
+		send = p.bot.SendMarkdown
+	}
+
+	return sent(send(ctx, id.RoomID(roomID), text))
+}
+
+func (p *Plugin) builtinReply(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	ctx, err := handling(thread, fn)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		evt  *eventValue
+		text string
+	)
+	if err := starlark.UnpackPositionalArgs(fn.Name(), args, kwargs, 2, &evt, &text); err != nil {
+		return nil, err
+	}
+
+	return sent(p.bot.Reply(ctx, evt.evt, text))
+}
+
+func (p *Plugin) builtinReact(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	ctx, err := handling(thread, fn)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		evt *eventValue
+		key string
+	)
+	if err := starlark.UnpackPositionalArgs(fn.Name(), args, kwargs, 2, &evt, &key); err != nil {
+		return nil, err
+	}
+
+	return sent(p.bot.React(ctx, evt.evt.RoomID, evt.evt.ID, key))
+}
+
+// sent returns the ID of a sent event. Messages queued for a retry count as
+// sent, with an empty ID.
+func sent(evtID id.EventID, err error) (starlark.Value, error) {
+	if err != nil && !errors.Is(err, athenais.ErrQueued) {
+		return nil, err
+	}
+	return starlark.String(evtID), nil
+}
+
+// scriptStorage returns the storage of the running script
+func scriptStorage(thread *starlark.Thread, fn *starlark.Builtin) (context.Context, *athenais.Storage, error) {
+	ctx, err := handling(thread, fn)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return ctx, thread.Local(localStorage).(*athenais.Storage), nil
+}
+
+func builtinStorageGet(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	ctx, store, err := scriptStorage(thread, fn)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		key string
+		def starlark.Value = starlark.None
+	)
+	if err := starlark.UnpackArgs(fn.Name(), args, kwargs, "key", &key, "default?", &def); err != nil {
+		return nil, err
+	}
+
+	value, err := store.Get(ctx, key)
+	if errors.Is(err, athenais.ErrNotFound) {
+		return def, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return starlark.String(value), nil
+}
+
+func builtinStoragePut(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	ctx, store, err := scriptStorage(thread, fn)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		key, value string
+		ttl        starlark.Value = starlark.MakeInt(0)
+	)
+	if err := starlark.UnpackArgs(fn.Name(), args, kwargs, "key", &key, "value", &value, "ttl?", &ttl); err != nil {
+		return nil, err
+	}
+
+	seconds, ok := starlark.AsFloat(ttl)
+	if !ok {
+		return nil, errors.Errorf("%s: ttl must be a number of seconds, got %s", fn.Name(), ttl.Type())
+	}
+
+	return starlark.None, store.Put(ctx, key, []byte(value), time.Duration(seconds*float64(time.Second)))
+}
+
+func builtinStorageDelete(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	ctx, store, err := scriptStorage(thread, fn)
+	if err != nil {
+		return nil, err
+	}
+
+	var key string
+	if err := starlark.UnpackArgs(fn.Name(), args, kwargs, "key", &key); err != nil {
+		return nil, err
+	}
+
+	return starlark.None, store.Delete(ctx, key)
+}
+
+func builtinStorageList(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	ctx, store, err := scriptStorage(thread, fn)
+	if err != nil {
+		return nil, err
+	}
+
+	var prefix string
+	if err := starlark.UnpackArgs(fn.Name(), args, kwargs, "prefix?", &prefix); err != nil {
+		return nil, err
+	}
+
+	entries, err := store.List(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	d := starlark.NewDict(len(entries))
+	for _, e := range entries {
+		if err := d.SetKey(starlark.String(e.Key), starlark.String(e.Value)); err != nil {
+			return nil, err
+		}
+	}
+
+	return d, nil
+}
+
+// stringList converts an optional list argument to strings
+func stringList(fn *starlark.Builtin, name string, l *starlark.List) ([]string, error) {
+	if l == nil {
+		return nil, nil
+	}
+
+	out := make([]string, 0, l.Len())
+	for i := 0; i < l.Len(); i++ {
+		s, ok := starlark.AsString(l.Index(i))
+		if !ok {
+			return nil, errors.Errorf("%s: %s must be a list of strings, got %s", fn.Name(), name, l.Index(i).Type())
+		}
+		out = append(out, s)
+	}
+
+	return out, nil
+}
+
+// eventValue exposes a Matrix event to scripts
+type eventValue struct {
+	evt *event.Event
+}
+
+var _ starlark.HasAttrs = (*eventValue)(nil)
+
+func (v *eventValue) String() string        { return fmt.Sprintf("<event %s>", v.evt.ID) }
+func (v *eventValue) Type() string          { return "event" }
+func (v *eventValue) Freeze()               {}
+func (v *eventValue) Truth() starlark.Bool  { return starlark.True }
+func (v *eventValue) Hash() (uint32, error) { return starlark.String(v.evt.ID).Hash() }
+
+func (v *eventValue) Attr(name string) (starlark.Value, error) {
+	switch name {
+	case "id":
+		return starlark.String(v.evt.ID), nil
+	case "room_id":
+		return starlark.String(v.evt.RoomID), nil
+	case "sender":
+		return starlark.String(v.evt.Sender), nil
+	case "type":
+		return starlark.String(v.evt.Type.Type), nil
+	case "timestamp":
+		return starlark.MakeInt64(v.evt.Timestamp), nil
+	case "body":
+		return starlark.String(v.evt.Content.AsMessage().Body), nil
+	case "msgtype":
+		return starlark.String(v.evt.Content.AsMessage().MsgType), nil
+	default:
+		return nil, nil
+	}
+}
+
+func (v *eventValue) AttrNames() []string {
+	return []string{"body", "id", "msgtype", "room_id", "sender", "timestamp", "type"}
+}
+
+// matchValue converts the values captured by a route's matchers
+func matchValue(m *athenais.Match) starlark.Value {
+	groups := make(starlark.Tuple, 0, len(m.Groups))
+	for _, g := range m.Groups {
+		groups = append(groups, starlark.String(g))
+	}
+
+	named := starlark.NewDict(len(m.Named))
+	for k, v := range m.Named {
+		_ = named.SetKey(starlark.String(k), starlark.String(v))
+	}
+
+	return starlarkstruct.FromStringDict(starlarkstruct.Default, starlark.StringDict{
+		"groups": groups,
+		"named":  named,
+	})
+}
+
+// valuesDict converts the parsed arguments of a command. Durations are
+// converted to seconds.
+func valuesDict(values map[string]any) (*starlark.Dict, error) {
+	d := starlark.NewDict(len(values))
+	for k, v := range values {
+		var sv starlark.Value
+		switch v := v.(type) {
+		case string:
+			sv = starlark.String(v)
+		case int:
+			sv = starlark.MakeInt(v)
+		case float64:
+			sv = starlark.Float(v)
+		case bool:
+			sv = starlark.Bool(v)
+		case time.Duration:
+			sv = starlark.Float(v.Seconds())
+		default:
+			return nil, errors.Errorf("unsupported value for %s: %T", k, v)
+		}
+
+		if err := d.SetKey(starlark.String(k), sv); err != nil {
+			return nil, err
+		}
+	}
+
+	return d, nil
+}
@@ -0,0 +1,382 @@
+// Package scripting runs Starlark scripts as lightweight plugins. Scripts are
+// loaded from a directory and reloaded when they change. At the top level a
+// script registers routes and commands; its handlers use a sandboxed subset
+// of the Bot API:
+//
+//	def greet(event, match):
+//	    bot.reply(event, "Hello, %s!" % match.named["name"])
+//
+//	bot.route(greet, name = "greet", body_regex = "^hello (?P<name>\\w+)")
+//
+//	def note(event, args):
+//	    storage.put("last", args["text"])
+//	    bot.react(event, "📝")
+//
+//	bot.command("note", note, usage = "Take a note", args = ["text..."])
+//
+// Scripts can't load other files or reach the network, and every run is
+// limited in steps and time.
+package scripting
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+	"github.com/unerror/athenais/pkg/athenais"
+	"go.starlark.net/starlark"
+	"maunium.net/go/mautrix/event"
+)
+
+const (
+	// DefaultDir is the default directory scripts are loaded from
+	DefaultDir = "scripts"
+
+	// DefaultMaxSteps is the default number of steps a script may execute per run
+	DefaultMaxSteps = 1_000_000
+
+	// DefaultTimeout is the default time a script may run per run
+	DefaultTimeout = 5 * time.Second
+
+	// DefaultReloadInterval is the default interval scripts are checked for
+	// changes
+	DefaultReloadInterval = 2 * time.Second
+
+	// scriptExt is the extension of script files
+	scriptExt = ".star"
+)
+
+// Configuration configures the scripting plugin
+type Configuration struct {
+	// Dir is the directory the *.star scripts are loaded from
+	Dir string `yaml:"dir"`
+
+	// MaxSteps is the number of steps a script may execute per run
+	MaxSteps uint64 `yaml:"max_steps"`
+
+	// Timeout is the time a script may run per run
+	Timeout time.Duration `yaml:"timeout"`
+
+	// ReloadInterval is how often scripts are checked for changes. 0 disables
+	// reloading.
+	ReloadInterval time.Duration `yaml:"reload_interval"`
+}
+
+// Validate validates the configuration
+func (c *Configuration) Validate() error {
+	if c.Dir == "" {
+		return errors.New("dir is required")
+	}
+
+	if c.MaxSteps == 0 {
+		return errors.New("max_steps must be positive")
+	}
+
+	if c.Timeout <= 0 {
+		return errors.Errorf("timeout must be positive, got %s", c.Timeout)
+	}
+
+	if c.ReloadInterval < 0 {
+		return errors.Errorf("reload_interval must not be negative, got %s", c.ReloadInterval)
+	}
+
+	return nil
+}
+
+// Plugin runs Starlark scripts
+type Plugin struct {
+	cfg *Configuration
+
+	// bot is the bot instance
+	bot *athenais.Bot
+
+	// log is the logger to use for logging
+	log *zerolog.Logger
+
+	// mu guards scripts, which are keyed by file name
+	mu      sync.Mutex
+	scripts map[string]*script
+}
+
+// script is a loaded script
+type script struct {
+	name    string
+	modTime time.Time
+	size    int64
+
+	routes   []scriptRoute
+	commands []scriptCommand
+}
+
+// scriptRoute is a route registered by a script
+type scriptRoute struct {
+	route   athenais.Route
+	handler starlark.Callable
+}
+
+// scriptCommand is a command registered by a script
+type scriptCommand struct {
+	command athenais.Command
+	handler starlark.Callable
+}
+
+func init() {
+	athenais.Register("scripting", func() athenais.Plugin {
+		return NewPlugin(Configuration{
+			Dir:            DefaultDir,
+			MaxSteps:       DefaultMaxSteps,
+			Timeout:        DefaultTimeout,
+			ReloadInterval: DefaultReloadInterval,
+		})
+	})
+}
+
+// NewPlugin creates a new scripting plugin
+func NewPlugin(cfg Configuration) *Plugin {
+	return &Plugin{
+		cfg:     &cfg,
+		scripts: make(map[string]*script),
+	}
+}
+
+func (p *Plugin) Name() string {
+	return "scripting"
+}
+
+// Config returns the configuration of the plugin, populated before Init
+func (p *Plugin) Config() any {
+	return p.cfg
+}
+
+func (p *Plugin) Init(bot *athenais.Bot, log *zerolog.Logger) {
+	p.log = log
+	p.bot = bot
+
+	p.log.Info().Str("dir", p.cfg.Dir).Msg("Initializing scripting plugin")
+
+	p.reload()
+}
+
+// Start reloads changed scripts every reload interval
+func (p *Plugin) Start(ctx context.Context) error {
+	if p.cfg.ReloadInterval == 0 {
+		return nil
+	}
+
+	go func() {
+		t := time.NewTicker(p.cfg.ReloadInterval)
+		defer t.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+				p.reload()
+			}
+		}
+	}()
+
+	return nil
+}
+
+// reload loads new and changed scripts, and drops deleted ones. A script that
+// fails to load keeps its previous version. The routes and commands of all
+// scripts are registered again if anything changed.
+func (p *Plugin) reload() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	entries, err := os.ReadDir(p.cfg.Dir)
+	if err != nil {
+		p.log.Error().Err(err).Msg("Failed to list scripts")
+		return
+	}
+
+	changed := false
+	seen := make(map[string]struct{}, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != scriptExt {
+			continue
+		}
+
+		name := entry.Name()
+		seen[name] = struct{}{}
+
+		info, err := entry.Info()
+		if err != nil {
+			p.log.Error().Err(err).Str("script", name).Msg("Failed to stat script")
+			continue
+		}
+
+		if prev, ok := p.scripts[name]; ok && prev.modTime.Equal(info.ModTime()) && prev.size == info.Size() {
+			continue
+		}
+
+		s, err := p.load(name)
+		if err != nil {
+			p.log.Error().Err(err).Str("script", name).Msg("Failed to load script")
+
+			// keep the previous version, and don't retry until the file changes
+			prev, ok := p.scripts[name]
+			if !ok {
+				prev = &script{name: name}
+				p.scripts[name] = prev
+			}
+			prev.modTime = info.ModTime()
+			prev.size = info.Size()
+			continue
+		}
+
+		p.log.Info().
+			Str("script", name).
+			Int("routes", len(s.routes)).
+			Int("commands", len(s.commands)).
+			Msg("Loaded script")
+
+		s.modTime = info.ModTime()
+		s.size = info.Size()
+		p.scripts[name] = s
+		changed = true
+	}
+
+	for name := range p.scripts {
+		if _, ok := seen[name]; !ok {
+			p.log.Info().Str("script", name).Msg("Unloaded deleted script")
+			delete(p.scripts, name)
+			changed = true
+		}
+	}
+
+	if changed {
+		p.register()
+	}
+}
+
+// load runs a script's top level, collecting its routes and commands
+func (p *Plugin) load(name string) (*script, error) {
+	src, err := os.ReadFile(filepath.Join(p.cfg.Dir, name))
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), p.cfg.Timeout)
+	defer cancel()
+
+	s := &script{name: name}
+	thread := p.thread(name)
+	thread.SetLocal(localScript, s)
+
+	err = p.limit(ctx, thread, func() error {
+		_, err := starlark.ExecFile(thread, name, src, p.predeclared())
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// register replaces the plugin's routes and commands with those of the
+// loaded scripts, in file name order
+func (p *Plugin) register() {
+	p.bot.RemoveRoutes(p.Name())
+	p.bot.RemoveCommands(p.Name())
+
+	names := make([]string, 0, len(p.scripts))
+	for name := range p.scripts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		s := p.scripts[name]
+
+		for _, sr := range s.routes {
+			sr := sr
+			route := sr.route
+			route.Name = name + ":" + route.Name
+			route.Plugin = p.Name()
+			route.MatchHandler = func(ctx context.Context, evt *event.Event, m *athenais.Match) error {
+				return p.run(ctx, name, sr.handler, &eventValue{evt: evt}, matchValue(m))
+			}
+			p.bot.Route(route)
+		}
+
+		for _, sc := range s.commands {
+			sc := sc
+			cmd := sc.command
+			cmd.Plugin = p.Name()
+			cmd.Handler = func(ctx context.Context, cc *athenais.CommandContext) error {
+				values, err := valuesDict(cc.Values)
+				if err != nil {
+					return err
+				}
+				return p.run(ctx, name, sc.handler, &eventValue{evt: cc.Event}, values)
+			}
+
+			if err := p.bot.Command(cmd); err != nil {
+				p.log.Error().Err(err).Str("script", name).Str("command", cmd.Name).Msg("Failed to register command")
+			}
+		}
+	}
+}
+
+// run calls a script handler
+func (p *Plugin) run(ctx context.Context, name string, fn starlark.Callable, args ...starlark.Value) error {
+	ctx, cancel := context.WithTimeout(ctx, p.cfg.Timeout)
+	defer cancel()
+
+	thread := p.thread(name)
+	thread.SetLocal(localContext, ctx)
+	thread.SetLocal(localStorage, p.bot.Storage(p.Name()+"/"+strings.TrimSuffix(name, scriptExt)))
+
+	return p.limit(ctx, thread, func() error {
+		_, err := starlark.Call(thread, fn, args, nil)
+		return err
+	})
+}
+
+// thread creates a thread for running a script. Scripts can't load modules,
+// and print to the log.
+func (p *Plugin) thread(name string) *starlark.Thread {
+	thread := &starlark.Thread{
+		Name: name,
+		Print: func(_ *starlark.Thread, msg string) {
+			p.log.Info().Str("script", name).Msg(msg)
+		},
+	}
+	thread.SetMaxExecutionSteps(p.cfg.MaxSteps)
+
+	return thread
+}
+
+// limit runs fn, cancelling the thread once ctx is done
+func (p *Plugin) limit(ctx context.Context, thread *starlark.Thread, fn func() error) error {
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			thread.Cancel(ctx.Err().Error())
+		case <-done:
+		}
+	}()
+
+	err := fn()
+
+	var eerr *starlark.EvalError
+	if errors.As(err, &eerr) {
+		return errors.New(eerr.Backtrace())
+	}
+
+	return err
+}
@@ -0,0 +1,253 @@
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	htmltemplate "html/template"
+	"io"
+	"net/http"
+	"strings"
+	"text/template"
+
+	"github.com/pkg/errors"
+	"github.com/unerror/athenais/pkg/athenais"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// HookConfig configures a hook
+type HookConfig struct {
+	// Room is the ID of the room messages are posted into
+	Room string `yaml:"room"`
+
+	// Token is the secret callers authenticate with, as a bearer token, in the
+	// X-Webhook-Token header or in the token query parameter
+	Token string `yaml:"token"`
+
+	// Secret, if set, requires payloads to be signed with an HMAC-SHA256 of
+	// the body using the secret, hex encoded and optionally prefixed with
+	// "sha256=", like GitHub does
+	Secret string `yaml:"secret"`
+
+	// SignatureHeader is the header carrying the signature. Defaults to
+	// DefaultSignatureHeader.
+	SignatureHeader string `yaml:"signature_header"`
+
+	// Text is the text/template rendering the payload into the plain text body
+	Text string `yaml:"text"`
+
+	// HTML is the template rendering the payload into the HTML body. It is
+	// parsed with html/template, so payload values are escaped.
+	HTML string `yaml:"html"`
+
+	// Notice posts the messages as notices
+	Notice bool `yaml:"notice"`
+}
+
+func (c *HookConfig) validate() error {
+	if c.Room == "" {
+		return errors.New("room is required")
+	}
+
+	if c.Token == "" {
+		return errors.New("token is required")
+	}
+
+	if c.Text == "" {
+		return errors.New("text is required")
+	}
+
+	return nil
+}
+
+// hook is a configured hook with its parsed templates
+type hook struct {
+	name string
+	cfg  HookConfig
+	room id.RoomID
+
+	text *template.Template
+	html *htmltemplate.Template
+}
+
+// funcs are the functions available to templates
+var funcs = map[string]any{
+	"json": func(v any) (string, error) {
+		data, err := json.Marshal(v)
+		return string(data), err
+	},
+	"default": func(def, v any) any {
+		if v == nil || v == "" {
+			return def
+		}
+		return v
+	},
+	"join":  strings.Join,
+	"upper": strings.ToUpper,
+	"lower": strings.ToLower,
+}
+
+func newHook(name string, cfg HookConfig) (*hook, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+
+	if cfg.SignatureHeader == "" {
+		cfg.SignatureHeader = DefaultSignatureHeader
+	}
+
+	h := &hook{name: name, cfg: cfg, room: id.RoomID(cfg.Room)}
+
+	var err error
+	if h.text, err = template.New(name).Funcs(funcs).Parse(cfg.Text); err != nil {
+		return nil, errors.Wrap(err, "invalid text template")
+	}
+
+	if cfg.HTML != "" {
+		if h.html, err = htmltemplate.New(name).Funcs(funcs).Parse(cfg.HTML); err != nil {
+			return nil, errors.Wrap(err, "invalid html template")
+		}
+	}
+
+	return h, nil
+}
+
+// authorized returns whether the request carries the hook's token
+func (h *hook) authorized(r *http.Request) bool {
+	token := r.Header.Get("X-Webhook-Token")
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		token = strings.TrimPrefix(auth, "Bearer ")
+	}
+	if token == "" {
+		token = r.URL.Query().Get("token")
+	}
+
+	return subtle.ConstantTimeCompare([]byte(token), []byte(h.cfg.Token)) == 1
+}
+
+// verify checks the HMAC signature of the body, if the hook has a secret
+func (h *hook) verify(r *http.Request, body []byte) bool {
+	if h.cfg.Secret == "" {
+		return true
+	}
+
+	sig, err := hex.DecodeString(strings.TrimPrefix(r.Header.Get(h.cfg.SignatureHeader), "sha256="))
+	if err != nil {
+		return false
+	}
+
+	mac := hmac.New(sha256.New, []byte(h.cfg.Secret))
+	mac.Write(body)
+
+	return hmac.Equal(sig, mac.Sum(nil))
+}
+
+// render renders the payload into a message
+func (h *hook) render(payload any) (*event.MessageEventContent, error) {
+	var text bytes.Buffer
+	if err := h.text.Execute(&text, payload); err != nil {
+		return nil, errors.Wrap(err, "failed to render text template")
+	}
+
+	content := &event.MessageEventContent{
+		MsgType: event.MsgText,
+		Body:    text.String(),
+	}
+	if h.cfg.Notice {
+		content.MsgType = event.MsgNotice
+	}
+
+	if h.html != nil {
+		var html bytes.Buffer
+		if err := h.html.Execute(&html, payload); err != nil {
+			return nil, errors.Wrap(err, "failed to render html template")
+		}
+
+		content.Format = event.FormatHTML
+		content.FormattedBody = html.String()
+	}
+
+	return content, nil
+}
+
+// handleHook posts the payload of a hook request into the hook's room
+func (p *Plugin) handleHook(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, p.cfg.PathPrefix)
+
+	p.mu.RLock()
+	h, ok := p.hooks[name]
+	maxBodySize := p.cfg.MaxBodySize
+	p.mu.RUnlock()
+
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	log := p.log.With().Str("hook", name).Str("remote_addr", r.RemoteAddr).Logger()
+
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !h.authorized(r) {
+		log.Warn().Msg("Rejected webhook with invalid token")
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBodySize))
+	if err != nil {
+		var merr *http.MaxBytesError
+		if errors.As(err, &merr) {
+			http.Error(w, "payload too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, "failed to read payload", http.StatusBadRequest)
+		return
+	}
+
+	if !h.verify(r, body) {
+		log.Warn().Msg("Rejected webhook with invalid signature")
+		http.Error(w, "invalid signature", http.StatusUnauthorized)
+		return
+	}
+
+	var payload any
+	if len(bytes.TrimSpace(body)) > 0 {
+		dec := json.NewDecoder(bytes.NewReader(body))
+		dec.UseNumber()
+		if err := dec.Decode(&payload); err != nil {
+			http.Error(w, "invalid JSON payload", http.StatusBadRequest)
+			return
+		}
+	}
+
+	content, err := h.render(payload)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to render webhook")
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+
+	evtID, err := p.bot.SendMessage(r.Context(), h.room, content)
+	if errors.Is(err, athenais.ErrQueued) {
+		w.WriteHeader(http.StatusAccepted)
+		return
+	} else if err != nil {
+		log.Error().Err(err).Msg("Failed to post webhook")
+		http.Error(w, "failed to post message", http.StatusBadGateway)
+		return
+	}
+
+	log.Debug().Stringer("event_id", evtID).Msg("Posted webhook")
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]id.EventID{"event_id": evtID})
+}
@@ -0,0 +1,99 @@
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func sign(secret, body string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(body))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestHookVerify(t *testing.T) {
+	const body = `{"text":"deployed"}`
+
+	tests := []struct {
+		name   string
+		secret string
+		header string
+		value  string
+		want   bool
+	}{
+		{name: "no secret", want: true},
+		{name: "no secret ignores signature", header: DefaultSignatureHeader, value: "garbage", want: true},
+		{name: "valid", secret: "s3cret", header: DefaultSignatureHeader, value: sign("s3cret", body), want: true},
+		{name: "valid with prefix", secret: "s3cret", header: DefaultSignatureHeader, value: "sha256=" + sign("s3cret", body), want: true},
+		{name: "uppercase hex", secret: "s3cret", header: DefaultSignatureHeader, value: strings.ToUpper(sign("s3cret", body)), want: true},
+		{name: "custom header", secret: "s3cret", header: "X-Custom-Signature", value: sign("s3cret", body), want: true},
+		{name: "missing", secret: "s3cret", want: false},
+		{name: "wrong secret", secret: "s3cret", header: DefaultSignatureHeader, value: sign("other", body), want: false},
+		{name: "other body", secret: "s3cret", header: DefaultSignatureHeader, value: sign("s3cret", body+" "), want: false},
+		{name: "not hex", secret: "s3cret", header: DefaultSignatureHeader, value: "sha256=zz", want: false},
+		{name: "truncated", secret: "s3cret", header: DefaultSignatureHeader, value: sign("s3cret", body)[:32], want: false},
+		{name: "wrong header", secret: "s3cret", header: "X-Other", value: sign("s3cret", body), want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := HookConfig{Room: "!room:example.org", Token: "token", Text: "{{.text}}", Secret: tt.secret}
+			if tt.header == "X-Custom-Signature" {
+				cfg.SignatureHeader = tt.header
+			}
+
+			h, err := newHook("test", cfg)
+			if err != nil {
+				t.Fatalf("newHook error: %v", err)
+			}
+
+			r := httptest.NewRequest("POST", "/hooks/test", strings.NewReader(body))
+			if tt.header != "" {
+				r.Header.Set(tt.header, tt.value)
+			}
+
+			if got := h.verify(r, []byte(body)); got != tt.want {
+				t.Errorf("verify = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHookAuthorized(t *testing.T) {
+	tests := []struct {
+		name    string
+		target  string
+		headers map[string]string
+		want    bool
+	}{
+		{name: "bearer", target: "/hooks/test", headers: map[string]string{"Authorization": "Bearer token"}, want: true},
+		{name: "header", target: "/hooks/test", headers: map[string]string{"X-Webhook-Token": "token"}, want: true},
+		{name: "query", target: "/hooks/test?token=token", want: true},
+		{name: "bearer wins", target: "/hooks/test", headers: map[string]string{"Authorization": "Bearer wrong", "X-Webhook-Token": "token"}, want: false},
+		{name: "wrong token", target: "/hooks/test?token=tok", want: false},
+		{name: "no token", target: "/hooks/test", want: false},
+		{name: "basic auth", target: "/hooks/test", headers: map[string]string{"Authorization": "Basic token"}, want: false},
+	}
+
+	h, err := newHook("test", HookConfig{Room: "!room:example.org", Token: "token", Text: "{{.text}}"})
+	if err != nil {
+		t.Fatalf("newHook error: %v", err)
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", tt.target, nil)
+			for k, v := range tt.headers {
+				r.Header.Set(k, v)
+			}
+
+			if got := h.authorized(r); got != tt.want {
+				t.Errorf("authorized = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
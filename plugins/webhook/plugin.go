@@ -0,0 +1,204 @@
+// Package webhook posts messages into rooms for HTTP webhooks, e.g. from CI,
+// cron jobs and internal tools. Each hook has its own URL, secret token and
+// target room, and renders the JSON payload it receives with templates:
+//
+//	webhook:
+//	  listen: 127.0.0.1:8090
+//	  hooks:
+//	    deploys:
+//	      room: "!ops:example.com"
+//	      token: s3cret
+//	      text: "Deployed {{.service}} {{.version}}"
+//	      html: "Deployed <b>{{.service}}</b> <code>{{.version}}</code>"
+//
+//	curl -H "Authorization: Bearer s3cret" -d '{"service":"api","version":"1.2"}' \
+//	  http://127.0.0.1:8090/hooks/deploys
+package webhook
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+	"github.com/unerror/athenais/pkg/athenais"
+)
+
+const (
+	// DefaultListen is the default address the webhook server listens on
+	DefaultListen = "127.0.0.1:8090"
+
+	// DefaultPathPrefix is the default path hooks are served under
+	DefaultPathPrefix = "/hooks/"
+
+	// DefaultMaxBodySize is the default largest payload accepted, in bytes
+	DefaultMaxBodySize = 1 << 20
+
+	// DefaultSignatureHeader is the default header carrying the HMAC signature
+	// of the payload
+	DefaultSignatureHeader = "X-Hub-Signature-256"
+)
+
+// Configuration configures the webhook plugin
+type Configuration struct {
+	// Listen is the address the webhook server listens on
+	Listen string `yaml:"listen"`
+
+	// PathPrefix is the path hooks are served under, followed by the hook name
+	PathPrefix string `yaml:"path_prefix"`
+
+	// MaxBodySize is the largest payload accepted, in bytes
+	MaxBodySize int64 `yaml:"max_body_size"`
+
+	// Hooks are the hooks, keyed by name
+	Hooks map[string]HookConfig `yaml:"hooks"`
+}
+
+// Validate validates the configuration
+func (c *Configuration) Validate() error {
+	if c.Listen == "" {
+		return errors.New("listen is required")
+	}
+
+	if !strings.HasPrefix(c.PathPrefix, "/") || !strings.HasSuffix(c.PathPrefix, "/") {
+		return errors.Errorf("path_prefix must start and end with /, got %q", c.PathPrefix)
+	}
+
+	if c.MaxBodySize <= 0 {
+		return errors.Errorf("max_body_size must be positive, got %d", c.MaxBodySize)
+	}
+
+	for name, hc := range c.Hooks {
+		if _, err := newHook(name, hc); err != nil {
+			return errors.Wrapf(err, "hook %s", name)
+		}
+	}
+
+	return nil
+}
+
+// Plugin serves webhooks
+type Plugin struct {
+	cfg *Configuration
+
+	// bot is the bot instance
+	bot *athenais.Bot
+
+	// log is the logger to use for logging
+	log *zerolog.Logger
+
+	// mu guards hooks, which are replaced on reload
+	mu     sync.RWMutex
+	hooks  map[string]*hook
+	server *http.Server
+}
+
+func init() {
+	athenais.Register("webhook", func() athenais.Plugin {
+		return NewPlugin(Configuration{
+			Listen:      DefaultListen,
+			PathPrefix:  DefaultPathPrefix,
+			MaxBodySize: DefaultMaxBodySize,
+		})
+	})
+}
+
+// NewPlugin creates a new webhook plugin
+func NewPlugin(cfg Configuration) *Plugin {
+	return &Plugin{
+		cfg:   &cfg,
+		hooks: make(map[string]*hook),
+	}
+}
+
+func (p *Plugin) Name() string {
+	return "webhook"
+}
+
+// Config returns the configuration of the plugin, populated before Init
+func (p *Plugin) Config() any {
+	return p.cfg
+}
+
+func (p *Plugin) Init(bot *athenais.Bot, log *zerolog.Logger) {
+	p.log = log
+	p.bot = bot
+
+	p.log.Info().Int("hooks", len(p.cfg.Hooks)).Msg("Initializing webhook plugin")
+
+	p.hooks = p.newHooks(p.cfg)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(p.cfg.PathPrefix, p.handleHook)
+
+	p.server = &http.Server{
+		Addr:              p.cfg.Listen,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+}
+
+// Reload applies a new configuration. The hooks are replaced; changes to the
+// server settings need a restart.
+func (p *Plugin) Reload(_ context.Context, cfg any) error {
+	c, ok := cfg.(*Configuration)
+	if !ok {
+		return errors.Errorf("unexpected configuration type %T", cfg)
+	}
+
+	if c.Listen != p.cfg.Listen || c.PathPrefix != p.cfg.PathPrefix {
+		p.log.Warn().Msg("Changes to listen and path_prefix apply after a restart")
+	}
+
+	hooks := p.newHooks(c)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.hooks = hooks
+	p.cfg.MaxBodySize = c.MaxBodySize
+	p.cfg.Hooks = c.Hooks
+
+	return nil
+}
+
+func (p *Plugin) newHooks(cfg *Configuration) map[string]*hook {
+	hooks := make(map[string]*hook, len(cfg.Hooks))
+	for name, hc := range cfg.Hooks {
+		h, err := newHook(name, hc)
+		if err != nil {
+			p.log.Error().Err(err).Str("hook", name).Msg("Failed to create hook")
+			continue
+		}
+		hooks[name] = h
+	}
+
+	return hooks
+}
+
+// Start starts the webhook server
+func (p *Plugin) Start(ctx context.Context) error {
+	l, err := net.Listen("tcp", p.cfg.Listen)
+	if err != nil {
+		return errors.Wrap(err, "failed to listen for webhooks")
+	}
+
+	p.log.Info().Str("listen", l.Addr().String()).Msg("Listening for webhooks")
+
+	go func() {
+		if err := p.server.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			p.log.Error().Err(err).Msg("Webhook server failed")
+		}
+	}()
+
+	return nil
+}
+
+// Stop stops the webhook server, waiting for requests in flight
+func (p *Plugin) Stop(ctx context.Context) error {
+	return p.server.Shutdown(ctx)
+}